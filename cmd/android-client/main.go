@@ -1,6 +1,7 @@
 package main
 
 import (
+	stdcrypto "crypto"
 	"encoding/base64"
 	"flag"
 	"fmt"
@@ -14,6 +15,7 @@ import (
 	"phoenix/pkg/crypto"
 	"phoenix/pkg/protocol"
 	"phoenix/pkg/transport"
+	"strings"
 	"sync"
 	"syscall"
 
@@ -41,14 +43,34 @@ func main() {
 	getSS := flag.Bool("get-ss", false, "Generate Shadowsocks config from client config")
 	genKeys := flag.Bool("gen-keys", false, "Generate a new pair of Ed25519 keys (public/private)")
 	keyName := flag.String("key-name", "client.private.key", "Output filename for the generated private key (used with -gen-keys)")
+	keyType := flag.String("key-type", "ed25519", "Key type for -gen-keys: \"ed25519\", or \"ecdsa\" for certificates compatible with browser fingerprints")
+	encryptKey := flag.Bool("encrypt-key", false, "Protect the generated private key with a passphrase (used with -gen-keys)")
+	keyPassphrase := flag.String("key-passphrase", "", "Passphrase for -encrypt-key, as a literal or a file:/env: secret reference; prompted for if empty")
 	tunSocket := flag.String("tun-socket", "", "Abstract Unix socket name for receiving TUN fd via SCM_RIGHTS (VPN mode)")
+	share := flag.Bool("share", false, "Print the client config as a phoenix:// share link and terminal QR code")
+	retrust := flag.Bool("retrust", false, "Forget the pinned server key for remote_addr (tls_mode = \"tofu\") so the next connection trusts the new key")
+	migrateConfig := flag.Bool("migrate-config", false, "Upgrade the config file to the current schema version in place (keeps a .bak copy)")
+	shareSignKey := flag.String("share-sign-key", "", "Server private key used to sign the share link (used with -share)")
+	importLink := flag.String("import", "", "Save the profile in a phoenix:// share link to -config, keeping device-local settings of an existing profile")
+	trustKeys := flag.String("trust-key", "", "Comma-separated server keys or sha256/ pins the -import link must be signed by (an existing profile's pins always apply)")
+	enrollCode := flag.String("enroll", "", "Register private_key with the server using a one-time enrollment code")
+	enrollLabel := flag.String("enroll-label", "", "Name to register the key under (used with -enroll; defaults to a name derived from the key)")
 	flag.Parse()
 
 	if *genKeys {
-		priv, pub, err := crypto.GenerateKeypair()
+		priv, pub, err := generateKeypair(*keyType)
 		if err != nil {
 			log.Fatalf("Failed to generate keys: %v", err)
 		}
+		if *encryptKey {
+			pass, err := newKeyPassphrase(*keyPassphrase)
+			if err != nil {
+				log.Fatalf("Failed to get passphrase: %v", err)
+			}
+			if priv, err = crypto.EncryptPrivateKeyPEM(priv, pass); err != nil {
+				log.Fatalf("Failed to encrypt private key: %v", err)
+			}
+		}
 		keyPath := filepath.Join(*filesDir, *keyName)
 		if err := os.WriteFile(keyPath, priv, 0600); err != nil {
 			log.Fatalf("Failed to save private key: %v", err)
@@ -59,16 +81,84 @@ func main() {
 		return
 	}
 
+	if *importLink != "" {
+		var trusted []string
+		for _, k := range strings.Split(*trustKeys, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				trusted = append(trusted, k)
+			}
+		}
+		verified, err := config.ImportShareLink(*configPath, *importLink, trusted)
+		if err != nil {
+			log.Fatalf("Failed to import share link: %v", err)
+		}
+		// Print to stdout so the Android Service can tell the user whether
+		// the profile comes from a server they already trust.
+		fmt.Printf("IMPORTED=%s\n", *configPath)
+		fmt.Printf("VERIFIED=%t\n", verified)
+		return
+	}
+
+	if *migrateConfig {
+		migrated, err := config.MigrateClientConfigFile(*configPath)
+		if err != nil {
+			log.Fatalf("Failed to migrate config: %v", err)
+		}
+		if migrated {
+			fmt.Printf("Migrated %s to config_version %d\n", *configPath, config.ClientConfigVersion)
+		} else {
+			fmt.Printf("%s needs no changes for config_version %d\n", *configPath, config.ClientConfigVersion)
+		}
+		return
+	}
+
 	cfg, err := config.LoadClientConfig(*configPath)
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	if cfg.TLSMode == "tofu" && cfg.KnownHostsPath == "" {
+		cfg.KnownHostsPath = filepath.Join(*filesDir, "known_hosts")
+	}
+
+	if *retrust {
+		if cfg.TLSMode != "tofu" {
+			log.Fatalf("-retrust requires tls_mode = \"tofu\"")
+		}
+		removed, err := crypto.NewKnownHosts(cfg.KnownHostsPath).Remove(cfg.RemoteAddr)
+		if err != nil {
+			log.Fatalf("Failed to update known hosts: %v", err)
+		}
+		if removed {
+			fmt.Printf("Forgot server key for %s; the next connection will trust the key it presents\n", cfg.RemoteAddr)
+		} else {
+			fmt.Printf("No pinned key for %s in %s\n", cfg.RemoteAddr, cfg.KnownHostsPath)
+		}
+		return
+	}
+
 	if *getSS {
 		generateShadowsocksConfig(cfg)
 		return
 	}
 
+	if *share {
+		if err := printShareLink(cfg, *shareSignKey); err != nil {
+			log.Fatalf("Failed to create share link: %v", err)
+		}
+		return
+	}
+
+	if *enrollCode != "" {
+		label, err := transport.NewClient(cfg).Enroll(*enrollCode, *enrollLabel)
+		if err != nil {
+			log.Fatalf("Enrollment failed: %v", err)
+		}
+		// Print to stdout so the Android Service can confirm enrollment.
+		fmt.Printf("ENROLLED=%s\n", label)
+		return
+	}
+
 	client := transport.NewClient(cfg)
 	log.Printf("Phoenix Client started. Connecting to %s", cfg.RemoteAddr)
 
@@ -137,6 +227,53 @@ func main() {
 	wg.Wait()
 }
 
+// generateKeypair generates a private key of the given type and returns it as
+// PEM together with the pin peers use to authorize it.
+func generateKeypair(keyType string) ([]byte, string, error) {
+	switch keyType {
+	case "ed25519":
+		return crypto.GenerateKeypair()
+	case "ecdsa":
+		privPEM, err := crypto.GenerateECDSAKey()
+		if err != nil {
+			return nil, "", err
+		}
+		priv, err := crypto.ParsePrivateKeyPEM(privPEM)
+		if err != nil {
+			return nil, "", err
+		}
+		pin, err := crypto.PublicKeyPin(priv)
+		return privPEM, pin, err
+	default:
+		return nil, "", fmt.Errorf("unknown key type %q (expected \"ed25519\" or \"ecdsa\")", keyType)
+	}
+}
+
+// newKeyPassphrase returns the passphrase for a newly generated key, resolving
+// a secret reference or prompting twice on the terminal when none is given.
+func newKeyPassphrase(value string) ([]byte, error) {
+	if value != "" {
+		pass, err := config.ResolveSecret(value)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(pass), nil
+	}
+
+	pass, err := crypto.ReadPassphrase("New key passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	confirm, err := crypto.ReadPassphrase("Repeat passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if string(pass) != string(confirm) {
+		return nil, fmt.Errorf("passphrases do not match")
+	}
+	return pass, nil
+}
+
 // receiveTunFd connects to the abstract Unix socket created by the Android
 // VpnService, receives the TUN file descriptor via SCM_RIGHTS ancillary data,
 // and returns a duplicate of it that is safe to use in this process.
@@ -217,6 +354,28 @@ func generateShadowsocksConfig(cfg *config.ClientConfig) {
 	}
 }
 
+// printShareLink prints cfg as a phoenix:// link followed by a QR code of it,
+// so a phone can be onboarded by scanning the terminal.
+func printShareLink(cfg *config.ClientConfig, signKeyPath string) error {
+	var signer stdcrypto.PrivateKey
+	if signKeyPath != "" {
+		priv, err := crypto.LoadPrivateKeyWithPassphrase(signKeyPath, crypto.PassphraseSource("", signKeyPath))
+		if err != nil {
+			return fmt.Errorf("failed to load signing key: %w", err)
+		}
+		signer = priv
+	}
+
+	link, err := config.EncodeShareLink(cfg, signer)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(link)
+	fmt.Println()
+	return printQRCode(os.Stdout, link)
+}
+
 // startInbound starts a TCP listener for an inbound proxy and accepts
 // connections. If ready is non-nil it is closed once the listener is
 // successfully bound — callers can use this to synchronise on readiness.
@@ -251,7 +410,7 @@ func handleConnection(client *transport.Client, in config.ClientInbound, conn ne
 			Client: client,
 			Proto:  protocol.ProtocolSOCKS5,
 		}
-		if err := socks5.HandleConnection(conn, dialer, in.EnableUDP); err != nil {
+		if err := socks5.HandleConnection(conn, dialer, in.EnableUDP, ""); err != nil {
 			log.Printf("SOCKS5 Handler Error: %v", err)
 		}
 
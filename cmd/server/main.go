@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"phoenix/pkg/config"
+	"phoenix/pkg/crypto"
+	"phoenix/pkg/transport"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func main() {
+	configPath := flag.String("config", "server.toml", "Path to server configuration file")
+	genToken := flag.Bool("gen-token", false, "Print a random secret suitable for auth_token or enrollment.secret")
+	mintEnroll := flag.Bool("mint-enroll-code", false, "Print a one-time enrollment code for a new client (requires enrollment.secret)")
+	enrollTTL := flag.Duration("enroll-ttl", 15*time.Minute, "How long a minted enrollment code stays valid (used with -mint-enroll-code)")
+	genIssuerKey := flag.Bool("gen-issuer-key", false, "Generate an Ed25519 access token issuer key at -issuer-key and print its public key for token_issuer_keys")
+	mintToken := flag.Bool("mint-token", false, "Print a signed access token for -token-user, signed with -issuer-key")
+	issuerKey := flag.String("issuer-key", "token_issuer.key", "Path to the access token issuer private key")
+	force := flag.Bool("force", false, "Overwrite an existing -issuer-key (used with -gen-issuer-key; invalidates every token it minted)")
+	tokenUser := flag.String("token-user", "", "User ID the access token is issued to (used with -mint-token)")
+	tokenTTL := flag.Duration("token-ttl", 24*time.Hour, "How long the access token is valid (used with -mint-token)")
+	tokenProtocols := flag.String("token-protocols", "", "Comma-separated protocols the token allows, e.g. \"socks5,ssh\" (default: all enabled)")
+	tokenQuota := flag.String("token-quota", "", "Quota class recorded in the token (used with -mint-token)")
+	flag.Parse()
+
+	if *genToken {
+		token, err := crypto.GenerateToken()
+		if err != nil {
+			log.Fatalf("Failed to generate token: %v", err)
+		}
+		fmt.Println(token)
+		return
+	}
+
+	if *genIssuerKey {
+		priv, pub, err := crypto.GenerateKeypair()
+		if err != nil {
+			log.Fatalf("Failed to generate issuer key: %v", err)
+		}
+		if err := writeIssuerKey(*issuerKey, priv, *force); err != nil {
+			log.Fatalf("Failed to save issuer key: %v", err)
+		}
+		fmt.Printf("KEY_PATH=%s\n", *issuerKey)
+		fmt.Printf("PUBLIC_KEY=%s\n", pub)
+		return
+	}
+
+	if *mintToken {
+		token, err := mintAccessToken(*issuerKey, *tokenUser, *tokenTTL, *tokenProtocols, *tokenQuota)
+		if err != nil {
+			log.Fatalf("Failed to mint access token: %v", err)
+		}
+		fmt.Println(token)
+		return
+	}
+
+	cfg, err := config.LoadServerConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	if *mintEnroll {
+		if cfg.Enrollment.Secret == "" {
+			log.Fatalf("-mint-enroll-code requires enrollment.secret in %s", *configPath)
+		}
+		expires := time.Now().Add(*enrollTTL)
+		code, err := crypto.MintEnrollmentCode([]byte(cfg.Enrollment.Secret), expires)
+		if err != nil {
+			log.Fatalf("Failed to mint enrollment code: %v", err)
+		}
+		fmt.Println(code)
+		fmt.Printf("Valid until %s, for one client.\n", expires.Format(time.RFC3339))
+		return
+	}
+
+	srv := transport.NewServer(cfg)
+	srv.WatchConfig(*configPath)
+
+	// Stop cleanly on SIGINT/SIGTERM so that quota usage is saved.
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		log.Printf("Received %v, shutting down", <-sig)
+		srv.Close()
+	}()
+	if err := srv.Start(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
+// writeIssuerKey saves a new issuer key to path. An existing file is only
+// replaced with force, since every token signed with it would stop working.
+func writeIssuerKey(path string, priv []byte, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0600)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s already exists; replacing it invalidates every token it signed (use -force to overwrite)", path)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(priv); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// mintAccessToken signs an access token for user with the issuer key at keyPath.
+func mintAccessToken(keyPath, user string, ttl time.Duration, protocols, quota string) (string, error) {
+	if user == "" {
+		return "", fmt.Errorf("-token-user is required")
+	}
+	priv, err := crypto.LoadPrivateKeyWithPassphrase(keyPath, crypto.PassphraseSource("", keyPath))
+	if err != nil {
+		return "", fmt.Errorf("failed to load issuer key: %w", err)
+	}
+
+	now := time.Now()
+	claims := crypto.AccessClaims{
+		Subject:    user,
+		IssuedAt:   now.Unix(),
+		Expires:    now.Add(ttl).Unix(),
+		QuotaClass: quota,
+	}
+	for _, p := range strings.Split(protocols, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			claims.Protocols = append(claims.Protocols, p)
+		}
+	}
+	return crypto.SignAccessToken(priv, claims)
+}
@@ -3,11 +3,17 @@ module phoenix
 go 1.25.7
 
 require (
+	filippo.io/edwards25519 v1.1.0
+	github.com/flynn/noise v1.1.0
 	github.com/pelletier/go-toml v1.9.5
 	github.com/refraction-networking/utls v1.8.2
 	github.com/shadowsocks/go-shadowsocks2 v0.1.5
 	github.com/xjasonlyu/tun2socks/v2 v2.6.0
+	golang.org/x/crypto v0.48.0
 	golang.org/x/net v0.50.0
+	golang.org/x/term v0.40.0
+	golang.org/x/time v0.11.0
+	rsc.io/qr v0.2.0
 )
 
 require (
@@ -28,10 +34,8 @@ require (
 	go.uber.org/atomic v1.11.0 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
 	go.uber.org/zap v1.27.0 // indirect
-	golang.org/x/crypto v0.48.0 // indirect
 	golang.org/x/sys v0.41.0 // indirect
 	golang.org/x/text v0.34.0 // indirect
-	golang.org/x/time v0.11.0 // indirect
 	golang.zx2c4.com/wintun v0.0.0-20230126152724-0fa3db229ce2 // indirect
 	golang.zx2c4.com/wireguard v0.0.0-20250521234502-f333402bd9cb // indirect
 	gvisor.dev/gvisor v0.0.0-20250523182742-eede7a881b20 // indirect
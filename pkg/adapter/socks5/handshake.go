@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"log"
 	"net"
 )
 
@@ -19,11 +20,21 @@ func (d *NetDialer) Dial(target string) (io.ReadWriteCloser, error) {
 	return net.Dial("tcp", target)
 }
 
+// logf logs an adapter message, naming the client it concerns if known.
+func logf(peer, format string, args ...any) {
+	if peer != "" {
+		format += " (client %s)"
+		args = append(args, peer)
+	}
+	log.Printf(format, args...)
+}
+
 // HandleConnection performs the SOCKS5 handshake.
 // conn: The client connection.
 // dialer: The strategy to connect to the target.
 // enableUDP: Whether to allow UDP ASSOCIATE.
-func HandleConnection(conn io.ReadWriteCloser, dialer Dialer, enableUDP bool) error {
+// peer: The client, as named in log lines ("" if unknown).
+func HandleConnection(conn io.ReadWriteCloser, dialer Dialer, enableUDP bool, peer string) error {
 	defer conn.Close()
 
 	// 1. Negotiation Phase
@@ -107,7 +118,7 @@ func HandleConnection(conn io.ReadWriteCloser, dialer Dialer, enableUDP bool) er
 
 	// If UDP ASSOCIATE, handle it now
 	if cmd == 0x03 {
-		return HandleUDP(conn, dialer)
+		return HandleUDP(conn, dialer, peer)
 	}
 
 	target := fmt.Sprintf("%s:%d", targetAddr, port)
@@ -4,7 +4,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"sync"
 )
@@ -14,7 +13,18 @@ import (
 // dialer: The strategy to verify target connectivity (or tunnel).
 // clientAddr: The address of the client requesting UDP.
 // header: The client's UDP request header containing initial destination (optional/ignored for ASSOCIATE usually).
-func HandleUDP(conn io.ReadWriteCloser, dialer Dialer) error {
+// peer: The client, as named in log lines ("" if unknown).
+func HandleUDP(conn io.ReadWriteCloser, dialer Dialer, peer string) error {
+	// Create a tunnel stream to Server for UDP traffic
+	// We initiate ONE stream for this association. It is opened first so
+	// that a refusal can still be answered with a failure reply.
+	stream, err := dialer.Dial("udp-tunnel")
+	if err != nil {
+		conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0}) // General failure
+		return fmt.Errorf("failed to dial UDP tunnel: %v", err)
+	}
+	defer stream.Close()
+
 	// 1. Listen on a random UDP port
 	udpConn, err := net.ListenPacket("udp", ":0")
 	if err != nil {
@@ -28,7 +38,7 @@ func HandleUDP(conn io.ReadWriteCloser, dialer Dialer) error {
 	}
 
 	addr := udpConn.LocalAddr().(*net.UDPAddr)
-	log.Printf("[SOCKS5] UDP Associate bound to %s", addr)
+	logf(peer, "[SOCKS5] UDP Associate bound to %s", addr)
 
 	// 2. Send Reply: BND.ADDR and BND.PORT
 	// We need IP and Port separate.
@@ -58,14 +68,6 @@ func HandleUDP(conn io.ReadWriteCloser, dialer Dialer) error {
 	// 3. Keep TCP Connection open and monitor UDP
 	// The TCP connection serves as a keep-alive signal.
 
-	// Create a tunnel stream to Server for UDP traffic
-	// We initiate ONE stream for this association.
-	stream, err := dialer.Dial("udp-tunnel")
-	if err != nil {
-		return fmt.Errorf("failed to dial UDP tunnel: %v", err)
-	}
-	defer stream.Close()
-
 	// 4. Relay Loop
 	errChan := make(chan error, 2)
 
@@ -87,7 +89,7 @@ func HandleUDP(conn io.ReadWriteCloser, dialer Dialer) error {
 			mu.Lock()
 			if clientUDPAddr == nil || clientUDPAddr.String() != peerAddr.String() {
 				clientUDPAddr = peerAddr
-				log.Printf("[SOCKS5-UDP] Client Address set to: %s", peerAddr)
+				logf(peer, "[SOCKS5-UDP] Client Address set to: %s", peerAddr)
 			}
 			mu.Unlock()
 
@@ -97,7 +99,7 @@ func HandleUDP(conn io.ReadWriteCloser, dialer Dialer) error {
 			}
 			frag := buf[2]
 			if frag != 0x00 {
-				log.Printf("[SOCKS5] UDP Frag %d not supported", frag)
+				logf(peer, "[SOCKS5] UDP Frag %d not supported", frag)
 				continue
 			}
 
@@ -110,7 +112,7 @@ func HandleUDP(conn io.ReadWriteCloser, dialer Dialer) error {
 			copy(packet[2:], buf[:n])
 
 			if _, err := stream.Write(packet); err != nil {
-				log.Printf("[SOCKS5-UDP] Failed to write to stream: %v", err)
+				logf(peer, "[SOCKS5-UDP] Failed to write to stream: %v", err)
 				errChan <- err
 				return
 			}
@@ -134,7 +136,7 @@ func HandleUDP(conn io.ReadWriteCloser, dialer Dialer) error {
 
 			pktBuf := make([]byte, pktLen)
 			if _, err := io.ReadFull(stream, pktBuf); err != nil {
-				log.Printf("[SOCKS5-UDP] Failed to read packet body from stream: %v", err)
+				logf(peer, "[SOCKS5-UDP] Failed to read packet body from stream: %v", err)
 				errChan <- err
 				return
 			}
@@ -149,11 +151,11 @@ func HandleUDP(conn io.ReadWriteCloser, dialer Dialer) error {
 
 			if target != nil {
 				if _, err := udpConn.WriteTo(pktBuf, target); err != nil {
-					log.Printf("[SOCKS5-UDP] WriteTo error: %v", err)
+					logf(peer, "[SOCKS5-UDP] WriteTo error: %v", err)
 					// Don't error out on single packet failure
 				}
 			} else {
-				log.Printf("[SOCKS5-UDP] Dropped packet, client address unknown")
+				logf(peer, "[SOCKS5-UDP] Dropped packet, client address unknown")
 			}
 		}
 	}()
@@ -4,14 +4,20 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"log"
 	"net"
 )
 
 // HandleUDPTunnel handles the server-side logic for a UDP tunnel stream.
 // It reads encapsulated UDP packets from the stream, sends them to the target,
 // and relays responses back.
-func HandleUDPTunnel(stream io.ReadWriteCloser) error {
+// peer names the client in log lines ("" if unknown).
+func HandleUDPTunnel(stream io.ReadWriteCloser, peer string) error {
+	return HandleUDPTunnelFiltered(stream, nil, peer)
+}
+
+// HandleUDPTunnelFiltered is HandleUDPTunnel, but packets to destinations for
+// which allow returns false are dropped. A nil allow permits every destination.
+func HandleUDPTunnelFiltered(stream io.ReadWriteCloser, allow func(dest string) bool, peer string) error {
 	defer stream.Close()
 
 	// 1. Create a local UDP socket for this session
@@ -34,7 +40,7 @@ func HandleUDPTunnel(stream io.ReadWriteCloser) error {
 		for {
 			// Read Length
 			if _, err := io.ReadFull(stream, header); err != nil {
-				log.Printf("[SOCKS5-UDP-Server] Stream read error: %v", err)
+				logf(peer, "[SOCKS5-UDP-Server] Stream read error: %v", err)
 				errChan <- err
 				return
 			}
@@ -53,7 +59,7 @@ func HandleUDPTunnel(stream io.ReadWriteCloser) error {
 			// Parse SOCKS5 UDP Header to extract Destination
 			// Format: [RSV][FRAG][ATYP][DST.ADDR][DST.PORT][DATA]
 			if len(pktBuf) < 10 { // Min header size (IPv4)
-				log.Printf("[SOCKS5-UDP] Packet too short")
+				logf(peer, "[SOCKS5-UDP] Packet too short")
 				continue
 			}
 
@@ -92,14 +98,19 @@ func HandleUDPTunnel(stream io.ReadWriteCloser) error {
 				destAddr = fmt.Sprintf("[%s]:%d", ip, port)
 				dataOffset = 22
 			default:
-				log.Printf("[SOCKS5-UDP] Unknown ATYP %d", atyp)
+				logf(peer, "[SOCKS5-UDP] Unknown ATYP %d", atyp)
+				continue
+			}
+
+			// Dropped silently, like any undeliverable datagram
+			if allow != nil && !allow(destAddr) {
 				continue
 			}
 
 			// Resolve Address
 			uAddr, err := net.ResolveUDPAddr("udp", destAddr)
 			if err != nil {
-				log.Printf("[SOCKS5-UDP] Resolve error for %s: %v", destAddr, err)
+				logf(peer, "[SOCKS5-UDP] Resolve error for %s: %v", destAddr, err)
 				continue
 			}
 
@@ -108,7 +119,7 @@ func HandleUDPTunnel(stream io.ReadWriteCloser) error {
 
 			// Write to Target
 			if _, err := udpConn.WriteTo(payload, uAddr); err != nil {
-				log.Printf("[SOCKS5-UDP] WriteTo error: %v", err)
+				logf(peer, "[SOCKS5-UDP] WriteTo error: %v", err)
 				// Don't kill stream on single packet error
 				continue
 			}
@@ -121,7 +132,7 @@ func HandleUDPTunnel(stream io.ReadWriteCloser) error {
 		for {
 			n, peerAddr, err := udpConn.ReadFrom(buf)
 			if err != nil {
-				log.Printf("[SOCKS5-UDP-Server] ReadFrom UDP error: %v", err)
+				logf(peer, "[SOCKS5-UDP-Server] ReadFrom UDP error: %v", err)
 				errChan <- err
 				return
 			}
@@ -162,7 +173,7 @@ func HandleUDPTunnel(stream io.ReadWriteCloser) error {
 			copy(packet[2+len(header):], buf[:n])
 
 			if _, err := stream.Write(packet); err != nil {
-				log.Printf("[SOCKS5-UDP-Server] Failed to write to stream: %v", err)
+				logf(peer, "[SOCKS5-UDP-Server] Failed to write to stream: %v", err)
 				errChan <- err
 				return
 			}
@@ -170,6 +181,6 @@ func HandleUDPTunnel(stream io.ReadWriteCloser) error {
 	}()
 
 	err = <-errChan
-	log.Printf("[SOCKS5-UDP-Server] Closing session due to: %v", err)
+	logf(peer, "[SOCKS5-UDP-Server] Closing session due to: %v", err)
 	return err
 }
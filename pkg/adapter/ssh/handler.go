@@ -7,6 +7,9 @@ import (
 	"net"
 )
 
+// DefaultTarget is the SSH server used when the client sends no target.
+const DefaultTarget = "127.0.0.1:22"
+
 // HandleConnection receives an SSH connection from the client and proxies it to the target.
 // Note: Standard SSH connects to a specific server.
 // If the H2C stream contains an SSH handshake, we need to know WHERE to connect.
@@ -27,15 +30,21 @@ import (
 //
 // Let's modify the H2C protocol to include a Target header.
 // `X-Nerve-Target: host:port`
-func HandleConnection(rw io.ReadWriteCloser, target string) error {
+//
+// peer names the client in log lines ("" if unknown).
+func HandleConnection(rw io.ReadWriteCloser, target, peer string) error {
 	defer rw.Close()
 
 	if target == "" {
 		// Default to localhost SSH if no target specified?
-		target = "127.0.0.1:22"
+		target = DefaultTarget
 	}
 
-	log.Printf("[SSH] Tunneling to %s", target)
+	if peer != "" {
+		log.Printf("[SSH] Tunneling to %s (client %s)", target, peer)
+	} else {
+		log.Printf("[SSH] Tunneling to %s", target)
+	}
 	destConn, err := net.Dial("tcp", target)
 	if err != nil {
 		return fmt.Errorf("failed to dial SSH target %s: %v", target, err)
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"phoenix/pkg/crypto"
+	"phoenix/pkg/protocol"
+	"slices"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+// AuthorizedClient is one entry of the authorized clients file.
+//
+//	[[client]]
+//	key = "sha256/..."            # or a Base64 Ed25519 public key
+//	label = "alice-phone"
+//	expires = 2027-01-01T00:00:00Z  # optional
+//	protocols = ["socks5", "socks5-udp"]  # optional, defaults to all enabled
+type AuthorizedClient struct {
+	// Key is the client's public key pin.
+	Key string `toml:"key"`
+
+	// Label names the client in logs.
+	Label string `toml:"label"`
+
+	// Expires is when the key stops being accepted (optional).
+	Expires time.Time `toml:"expires,omitempty"`
+
+	// Protocols restricts which protocols this client may use (optional).
+	// Protocols disabled server-wide stay disabled.
+	Protocols []protocol.ProtocolType `toml:"protocols,omitempty"`
+}
+
+// AuthorizedClients is the structure of the authorized clients file.
+type AuthorizedClients struct {
+	Clients []AuthorizedClient `toml:"client"`
+}
+
+// tunnelProtocols are the protocols a server can be asked to carry.
+var tunnelProtocols = []protocol.ProtocolType{
+	protocol.ProtocolSOCKS5,
+	protocol.ProtocolSOCKS5UDP,
+	protocol.ProtocolShadowsocks,
+	protocol.ProtocolSSH,
+}
+
+// Validate checks every entry of the authorized clients file.
+func (a *AuthorizedClients) Validate() error {
+	var errs ValidationErrors
+	labels := make(map[string]bool)
+	for i, c := range a.Clients {
+		prefix := fmt.Sprintf("client[%d].", i)
+		if _, err := crypto.NormalizePin(c.Key); err != nil {
+			errs.add(prefix+"key", "%v", err)
+		}
+		if c.Label == "" {
+			errs.add(prefix+"label", "required")
+		} else if labels[c.Label] {
+			errs.add(prefix+"label", "duplicate label %q", c.Label)
+		}
+		labels[c.Label] = true
+		for _, p := range c.Protocols {
+			if !slices.Contains(tunnelProtocols, p) {
+				errs.add(prefix+"protocols", "unknown protocol %q (expected one of %s)", p, quoteProtocols(tunnelProtocols))
+			}
+		}
+	}
+	return errs.orNil()
+}
+
+// LoadAuthorizedClients reads and validates an authorized clients file.
+func LoadAuthorizedClients(filePath string) (*AuthorizedClients, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read authorized clients file: %w", err)
+	}
+
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse authorized clients file: %w", err)
+	}
+
+	clients := &AuthorizedClients{}
+	if err := decodeAndValidate(tree, clients, false); err != nil {
+		return nil, fmt.Errorf("invalid authorized clients file %s: %w", filePath, err)
+	}
+	return clients, nil
+}
+
+// AppendAuthorizedClient adds an entry to the end of an authorized clients
+// file, creating it if needed. Existing entries and comments are kept as-is.
+func AppendAuthorizedClient(filePath string, c AuthorizedClient) error {
+	data, err := toml.Marshal(AuthorizedClients{Clients: []AuthorizedClient{c}})
+	if err != nil {
+		return fmt.Errorf("failed to encode authorized client: %w", err)
+	}
+
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append([]byte("\n"), data...)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,91 @@
+package config
+
+// ServerBandwidth configures token-bucket rate limits on relayed traffic.
+// Each level applies independently, so a stream gets the lowest of the
+// global, per-user and per-stream limits. Changes to the server config or
+// users file take effect on open streams.
+//
+//	[bandwidth.global]
+//	download = "100MB"   # bytes per second, shared by all streams
+//	upload = "20MB"
+//
+//	[bandwidth.per_user]
+//	download = "10MB"    # each user; users file entries may override it
+//
+//	[bandwidth.per_stream]
+//	download = "5MB"
+//	burst = "2MB"
+type ServerBandwidth struct {
+	Global    BandwidthLimit `toml:"global"`
+	PerUser   BandwidthLimit `toml:"per_user"`
+	PerStream BandwidthLimit `toml:"per_stream"`
+}
+
+// BandwidthLimit is a rate limit in each direction, as a byte size per
+// second (see ParseByteSize). Empty means unlimited.
+type BandwidthLimit struct {
+	// Download limits traffic from the server to the client.
+	Download string `toml:"download,omitempty"`
+
+	// Upload limits traffic from the client to the server.
+	Upload string `toml:"upload,omitempty"`
+
+	// Burst is how many bytes may be sent at once above the rate
+	// (default: one second of traffic, at least 64KiB).
+	Burst string `toml:"burst,omitempty"`
+}
+
+// IsZero reports whether no limit is set.
+func (b BandwidthLimit) IsZero() bool {
+	return b.Download == "" && b.Upload == ""
+}
+
+// Or returns b, or fallback if b sets no limit.
+func (b BandwidthLimit) Or(fallback BandwidthLimit) BandwidthLimit {
+	if b.IsZero() {
+		return fallback
+	}
+	return b
+}
+
+// Rates returns the parsed download and upload rates and the burst size,
+// with 0 meaning unlimited.
+func (b BandwidthLimit) Rates() (download, upload, burst int64, err error) {
+	parse := func(s string) (int64, error) {
+		if s == "" {
+			return 0, nil
+		}
+		return ParseByteSize(s)
+	}
+	if download, err = parse(b.Download); err != nil {
+		return
+	}
+	if upload, err = parse(b.Upload); err != nil {
+		return
+	}
+	burst, err = parse(b.Burst)
+	return
+}
+
+func (b BandwidthLimit) validate(errs *ValidationErrors, prefix string) {
+	check := func(key, v string) {
+		if v == "" {
+			return
+		}
+		if n, err := ParseByteSize(v); err != nil {
+			errs.add(prefix+key, "%v", err)
+		} else if n == 0 {
+			errs.add(prefix+key, "must be greater than zero (leave it unset for no limit)")
+		}
+	}
+	check("download", b.Download)
+	check("upload", b.Upload)
+	check("burst", b.Burst)
+}
+
+// validate checks every bandwidth limit.
+func (b *ServerBandwidth) validate(errs *ValidationErrors) {
+	b.Global.validate(errs, "bandwidth.global.")
+	b.PerUser.validate(errs, "bandwidth.per_user.")
+	b.PerStream.validate(errs, "bandwidth.per_stream.")
+}
@@ -0,0 +1,180 @@
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Defaults for [bans].
+const (
+	DefaultBanFindTime = 10 * time.Minute
+	DefaultBanTime     = 10 * time.Minute
+	DefaultBanMaxTime  = 24 * time.Hour
+
+	// DefaultBanIPv6Prefix is the usual size of the network one IPv6
+	// subscriber gets, all of whose addresses are theirs to rotate through.
+	DefaultBanIPv6Prefix = 64
+)
+
+// ServerBans blocks client IPs that repeatedly fail authentication. Each
+// further ban of the same address lasts twice as long as the previous one,
+// up to max_ban_time. Banned clients get the same response as any failed
+// or non-Phoenix request: the decoy site, or a plain 404.
+//
+//	[bans]
+//	max_failures = 5
+//	find_time = "10m"
+//	ban_time = "10m"
+//	max_ban_time = "24h"
+//	ipv6_prefix = 64
+//	allowlist = ["10.0.0.0/8", "203.0.113.7"]
+//	state_file = "bans.json"
+type ServerBans struct {
+	// MaxFailures failed attempts within FindTime ban the address.
+	// Banning is enabled when it is set.
+	MaxFailures int `toml:"max_failures,omitempty"`
+
+	// FindTime is the window failures are counted in (default 10m).
+	FindTime string `toml:"find_time,omitempty"`
+
+	// BanTime is the length of the first ban (default 10m).
+	BanTime string `toml:"ban_time,omitempty"`
+
+	// MaxBanTime caps escalating bans (default 24h). An address that stays
+	// unbanned this long after its last ban starts over at BanTime.
+	MaxBanTime string `toml:"max_ban_time,omitempty"`
+
+	// IPv6Prefix is the prefix length IPv6 addresses are grouped by, so
+	// that a client cannot dodge a ban by moving to another address of its
+	// network (default 64; 128 counts each address on its own).
+	IPv6Prefix int `toml:"ipv6_prefix,omitempty"`
+
+	// Allowlist holds addresses and CIDR prefixes that are never banned.
+	Allowlist []string `toml:"allowlist,omitempty"`
+
+	// StateFile keeps bans across restarts (optional).
+	StateFile string `toml:"state_file,omitempty"`
+}
+
+// Enabled reports whether failing clients are banned.
+func (b *ServerBans) Enabled() bool {
+	return b.MaxFailures > 0
+}
+
+// Durations returns find_time, ban_time and max_ban_time with defaults applied.
+func (b *ServerBans) Durations() (find, ban, max time.Duration, err error) {
+	find, ban, max = DefaultBanFindTime, DefaultBanTime, DefaultBanMaxTime
+	for _, f := range []struct {
+		key string
+		s   string
+		d   *time.Duration
+	}{
+		{"find_time", b.FindTime, &find},
+		{"ban_time", b.BanTime, &ban},
+		{"max_ban_time", b.MaxBanTime, &max},
+	} {
+		if f.s == "" {
+			continue
+		}
+		d, perr := time.ParseDuration(f.s)
+		if perr != nil || d <= 0 {
+			return 0, 0, 0, fmt.Errorf("%s: invalid duration %q", f.key, f.s)
+		}
+		*f.d = d
+	}
+	return find, ban, max, nil
+}
+
+// IPv6PrefixLen returns ipv6_prefix with the default applied.
+func (b *ServerBans) IPv6PrefixLen() int {
+	if b.IPv6Prefix == 0 {
+		return DefaultBanIPv6Prefix
+	}
+	return b.IPv6Prefix
+}
+
+// AllowedPrefixes parses the allowlist.
+func (b *ServerBans) AllowedPrefixes() ([]netip.Prefix, error) {
+	return parsePrefixes(b.Allowlist)
+}
+
+// ServerClientIP says how to find the real client address when the server
+// runs behind a load balancer or CDN. It is used for bans and logging.
+//
+//	[client_ip]
+//	proxy_protocol = true
+//	header = "CF-Connecting-IP"
+//	trusted_proxies = ["173.245.48.0/20"]
+type ServerClientIP struct {
+	// ProxyProtocol expects a PROXY protocol (v1 or v2) header on every
+	// connection to listen_addr from a trusted proxy.
+	ProxyProtocol bool `toml:"proxy_protocol,omitempty"`
+
+	// Header names a request header holding the client address, such as
+	// "X-Forwarded-For" (the last entry is used) or "CF-Connecting-IP".
+	Header string `toml:"header,omitempty"`
+
+	// TrustedProxies lists the peers that may set the address through the
+	// PROXY protocol or Header. Required with either, since otherwise any
+	// client could claim an address to dodge a ban or get another banned.
+	TrustedProxies []string `toml:"trusted_proxies,omitempty"`
+}
+
+// TrustedPrefixes parses trusted_proxies.
+func (c *ServerClientIP) TrustedPrefixes() ([]netip.Prefix, error) {
+	return parsePrefixes(c.TrustedProxies)
+}
+
+// parsePrefixes parses addresses and CIDR prefixes.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if strings.Contains(s, "/") {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR prefix %q", s)
+			}
+			out = append(out, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		a = a.Unmap()
+		out = append(out, netip.PrefixFrom(a, a.BitLen()))
+	}
+	return out, nil
+}
+
+func (b *ServerBans) validate(errs *ValidationErrors) {
+	if b.MaxFailures < 0 {
+		errs.add("bans.max_failures", "must not be negative (use 0 to disable bans)")
+	}
+	if _, ban, max, err := b.Durations(); err != nil {
+		errs.add("bans", "%v", err)
+	} else if max < ban {
+		errs.add("bans.max_ban_time", "is shorter than ban_time")
+	}
+	if b.IPv6Prefix < 0 || b.IPv6Prefix > 128 {
+		errs.add("bans.ipv6_prefix", "must be between 1 and 128")
+	}
+	if _, err := b.AllowedPrefixes(); err != nil {
+		errs.add("bans.allowlist", "%v", err)
+	}
+}
+
+func (c *ServerClientIP) validate(errs *ValidationErrors) {
+	if _, err := c.TrustedPrefixes(); err != nil {
+		errs.add("client_ip.trusted_proxies", "%v", err)
+	}
+	if strings.ContainsAny(c.Header, " :\t") {
+		errs.add("client_ip.header", "%q is not a valid header name", c.Header)
+	}
+	if (c.ProxyProtocol || c.Header != "") && len(c.TrustedProxies) == 0 {
+		errs.add("client_ip.trusted_proxies", "is required with proxy_protocol or header; list the addresses of your proxies or CDN")
+	}
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// Camouflage controls what tunnel requests look like on the wire. Client and
+// server must use the same settings. The server treats requests that do not
+// match as decoy traffic (see ServerDecoy).
+//
+//	[camouflage]
+//	path = "/api/v2/sync"
+//	method = "PUT"
+//	carrier = "cookie"
+//
+//	[camouflage.keys]
+//	token = "session"
+//
+// Behind a reverse proxy the server matches the path it receives, so mount it
+// under a sub-path by passing the request URI through unchanged
+// (nginx: "location /api/ { proxy_pass http://127.0.0.1:8080; }").
+type Camouflage struct {
+	// Path is the request path of tunnel streams (default "/").
+	// With the default, the server accepts streams on any path.
+	Path string `toml:"path,omitempty"`
+
+	// Method is the HTTP method of tunnel streams: "POST" (default), "PUT" or "PATCH".
+	Method string `toml:"method,omitempty"`
+
+	// Carrier is where stream metadata (protocol, target, credentials) goes:
+	//   "header" (default): one request header per value.
+	//   "cookie": one cookie per value.
+	//   "query": one query parameter per value.
+	//   "path": a single opaque path segment appended to Path.
+	//   "body": an encrypted preamble at the start of the request body that
+	//           only the server can read, so a CDN terminating TLS does not
+	//           see where streams go. Needs the server's Ed25519 key: the
+	//           client's metadata_key (or server_public_key) and the
+	//           server's security.metadata_key (or private_key).
+	Carrier string `toml:"carrier,omitempty"`
+
+	// Keys renames the metadata fields. Unset names default to the
+	// X-Nerve-* headers with carrier "header", and to "protocol", "target",
+	// "token", "auth", "code", "label", "inner", "sid" and "seq"
+	// otherwise.
+	Keys CamouflageKeys `toml:"keys,omitempty"`
+}
+
+// CamouflageKeys are the names under which stream metadata is sent.
+type CamouflageKeys struct {
+	Protocol    string `toml:"protocol,omitempty"`
+	Target      string `toml:"target,omitempty"`
+	Token       string `toml:"token,omitempty"`
+	Auth        string `toml:"auth,omitempty"`
+	EnrollCode  string `toml:"enroll_code,omitempty"`
+	EnrollLabel string `toml:"enroll_label,omitempty"`
+
+	// Inner carries the inner channel handshake of WebSocket and split
+	// streams, which have no request body to send it in.
+	Inner string `toml:"inner,omitempty"`
+
+	// Session and Seq tie the requests of a split stream together.
+	Session string `toml:"session,omitempty"`
+	Seq     string `toml:"seq,omitempty"`
+}
+
+// Valid values for enum-like camouflage options.
+var (
+	validCamouflageMethods  = []string{"", http.MethodPost, http.MethodPut, http.MethodPatch}
+	validCamouflageCarriers = []string{"", "header", "cookie", "query", "path", "body"}
+)
+
+// Resolved returns c with defaults filled in.
+func (c Camouflage) Resolved() Camouflage {
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	c.Method = strings.ToUpper(c.Method)
+	if c.Method == "" {
+		c.Method = http.MethodPost
+	}
+	if c.Carrier == "" {
+		c.Carrier = "header"
+	}
+	defaults := CamouflageKeys{"protocol", "target", "token", "auth", "code", "label", "inner", "sid", "seq"}
+	if c.Carrier == "header" {
+		defaults = CamouflageKeys{"X-Nerve-Protocol", "X-Nerve-Target", "X-Nerve-Token", "X-Nerve-Auth", "X-Nerve-Enroll-Code", "X-Nerve-Enroll-Label", "X-Nerve-Inner", "X-Nerve-Session", "X-Nerve-Seq"}
+	}
+	k := &c.Keys
+	for _, f := range []struct {
+		v   *string
+		def string
+	}{
+		{&k.Protocol, defaults.Protocol},
+		{&k.Target, defaults.Target},
+		{&k.Token, defaults.Token},
+		{&k.Auth, defaults.Auth},
+		{&k.EnrollCode, defaults.EnrollCode},
+		{&k.EnrollLabel, defaults.EnrollLabel},
+		{&k.Inner, defaults.Inner},
+		{&k.Session, defaults.Session},
+		{&k.Seq, defaults.Seq},
+	} {
+		if *f.v == "" {
+			*f.v = f.def
+		}
+	}
+	return c
+}
+
+// List returns the key names in a fixed order.
+func (k CamouflageKeys) List() []string {
+	return []string{k.Protocol, k.Target, k.Token, k.Auth, k.EnrollCode, k.EnrollLabel, k.Inner, k.Session, k.Seq}
+}
+
+func (c *Camouflage) validate(errs *ValidationErrors) {
+	if !slices.Contains(validCamouflageMethods, strings.ToUpper(c.Method)) {
+		errs.add("camouflage.method", "invalid value %q (expected one of %s)", c.Method, quoteList(validCamouflageMethods))
+	}
+	if !slices.Contains(validCamouflageCarriers, c.Carrier) {
+		errs.add("camouflage.carrier", "invalid value %q (expected one of %s)", c.Carrier, quoteList(validCamouflageCarriers))
+		return
+	}
+	if c.Path != "" && (!strings.HasPrefix(c.Path, "/") || strings.ContainsAny(c.Path, "?#")) {
+		errs.add("camouflage.path", "must be an absolute path without query, e.g. \"/api/v2/sync\"")
+	}
+
+	r := c.Resolved()
+	seen := make(map[string]bool)
+	for _, k := range r.Keys.List() {
+		name := k
+		if r.Carrier == "header" {
+			name = http.CanonicalHeaderKey(k)
+		}
+		if seen[name] {
+			errs.add("camouflage.keys", "%q is used for more than one field", k)
+		}
+		seen[name] = true
+		if r.Carrier == "header" && !httpguts.ValidHeaderFieldName(k) || strings.ContainsAny(k, " ;=&,\"") {
+			errs.add("camouflage.keys", "%q is not a valid %s name", k, r.Carrier)
+		}
+	}
+}
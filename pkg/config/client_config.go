@@ -1,7 +1,9 @@
 package config
 
 import (
+	"phoenix/pkg/crypto"
 	"phoenix/pkg/protocol"
+	"time"
 )
 
 // ClientInbound defines a single inbound protocol binding on the client side.
@@ -21,12 +23,43 @@ type ClientInbound struct {
 	// Encryption and authentication parameters for the protocol (if applicable).
 	// For Shadowsocks, this might be "aes-256-gcm:password".
 	// For SSH, this might be a key file path or simple forwarding.
-	Auth string `toml:"auth,omitempty"`
+	// May be a secret reference ("file:..." or "env:...").
+	Auth string `toml:"auth,omitempty" secret:"true"`
+}
+
+// ServerKey is an accepted server key pin with an optional validity window.
+// Listing several keys lets the server rotate its key without cutting off
+// clients: ship the new key with a not_before ahead of the switch-over, and
+// keep the old one until its not_after.
+type ServerKey struct {
+	// Key is a Base64 Ed25519 public key or a "sha256/..." SPKI pin.
+	Key string `toml:"key"`
+
+	// NotBefore is when the key starts being accepted (optional).
+	NotBefore time.Time `toml:"not_before,omitempty"`
+
+	// NotAfter is when the key stops being accepted (optional).
+	NotAfter time.Time `toml:"not_after,omitempty"`
+}
+
+// ValidAt reports whether the key is accepted at time t.
+func (k ServerKey) ValidAt(t time.Time) bool {
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return false
+	}
+	if !k.NotAfter.IsZero() && t.After(k.NotAfter) {
+		return false
+	}
+	return true
 }
 
 // ClientConfig defines the full structure of the client configuration.
 // It allows for multiple simultaneous inbound listeners on different ports.
 type ClientConfig struct {
+	// ConfigVersion is the schema version of this file (see ClientConfigVersion).
+	// Older files are upgraded in memory on load.
+	ConfigVersion int `toml:"config_version"`
+
 	// RemoteAddr is the address of the Phoenix server (e.g., "example.com:8080").
 	// Used for the HTTP Host header and TLS SNI — must be the domain, not a resolved IP.
 	RemoteAddr string `toml:"remote_addr"`
@@ -39,7 +72,14 @@ type ClientConfig struct {
 
 	// AuthToken is sent to the server for authentication.
 	// Must match the server's auth_token.
-	AuthToken string `toml:"auth_token"`
+	// May be a secret reference ("file:..." or "env:...").
+	AuthToken string `toml:"auth_token" secret:"true"`
+
+	// AuthMode selects how AuthToken is presented:
+	//   "static" (default): the token itself is sent in X-Nerve-Token.
+	//   "hmac": each stream carries a timestamped, single-use HMAC derived from
+	//           the token, so a captured request cannot be replayed.
+	AuthMode string `toml:"auth_mode,omitempty"`
 
 	// Inbounds is a list of local listeners that the client will open.
 	// Each inbound corresponds to a specific protocol and local port.
@@ -49,16 +89,33 @@ type ClientConfig struct {
 	ClientID string `toml:"client_id,omitempty"`
 
 	// PrivateKeyPath is the path to the client's private key file (PEM).
-	PrivateKeyPath string `toml:"private_key"`
+	// May be a secret reference that resolves to the path.
+	PrivateKeyPath string `toml:"private_key" secret:"true"`
+
+	// PrivateKeyPassphrase unlocks an encrypted private_key file.
+	// Should be a secret reference ("file:..." or "env:..."); if empty and the
+	// key is encrypted, the passphrase is prompted for on the terminal.
+	PrivateKeyPassphrase string `toml:"private_key_passphrase,omitempty" secret:"true"`
 
-	// ServerPublicKey is the detailed public key of the server (Base64).
+	// ServerPublicKey is the pinned public key of the server: a Base64 Ed25519
+	// key or a "sha256/..." SPKI pin. Always accepted when set.
 	ServerPublicKey string `toml:"server_public_key"`
 
+	// ServerPublicKeys lists additional accepted server keys with optional
+	// validity windows, for zero-downtime key rotation.
+	ServerPublicKeys []ServerKey `toml:"server_public_keys,omitempty"`
+
 	// TLSMode controls the TLS verification strategy.
 	// "system" = use system CA store (for CDN/Cloudflare setups)
-	// "" (empty) = use Phoenix Ed25519 pinning or h2c based on other fields
+	// "insecure" = TLS without certificate verification
+	// "tofu" = trust the server key seen on first connection and pin it in known_hosts
+	// "" (empty) = use key pinning or h2c based on other fields
 	TLSMode string `toml:"tls_mode"`
 
+	// KnownHostsPath is the trust-on-first-use store used by tls_mode = "tofu".
+	// Defaults to "known_hosts" in the client's files directory.
+	KnownHostsPath string `toml:"known_hosts,omitempty"`
+
 	// Fingerprint controls TLS ClientHello fingerprint spoofing.
 	// Mimics a browser to bypass DPI-based filtering on some ISPs.
 	// ""        → Go default TLS (no spoofing)
@@ -67,12 +124,74 @@ type ClientConfig struct {
 	// "safari"  → Mimic Safari
 	// "random"  → Random browser fingerprint per connection
 	Fingerprint string `toml:"fingerprint"`
+
+	// Transport selects how streams are carried to the server:
+	//   "" (default): one full-duplex HTTP/2 request per stream.
+	//   "websocket": one WebSocket per stream, each on its own HTTP/1.1
+	//                connection, for CDNs and proxies that buffer request
+	//                bodies but relay WebSockets.
+	//   "websocket-h2": WebSockets over HTTP/2 (RFC 8441), sharing one
+	//                connection. The server must run with
+	//                GODEBUG=http2xconnect=1 to accept them.
+	//   "split": one long-lived GET per stream for download, and numbered
+	//                requests (with the camouflage method) for upload, for
+	//                CDNs that neither stream request bodies nor relay
+	//                WebSockets.
+	// The server accepts every transport without configuration.
+	Transport string `toml:"transport,omitempty"`
+
+	// Camouflage sets the request path, method and metadata encoding.
+	// Must match the server.
+	Camouflage Camouflage `toml:"camouflage,omitempty"`
+
+	// MetadataKey is the server's Base64 Ed25519 public key used to encrypt
+	// stream metadata (camouflage carrier "body"). Defaults to
+	// server_public_key when that is a Base64 key rather than a "sha256/" pin.
+	// Also authenticates the server for inner_encryption.
+	MetadataKey string `toml:"metadata_key,omitempty"`
+
+	// InnerEncryption runs an encrypted Noise channel inside every stream,
+	// authenticated with metadata_key and private_key, so that whoever
+	// terminates the outer TLS (e.g. a CDN) cannot read tunneled data.
+	// Must match the server.
+	InnerEncryption bool `toml:"inner_encryption,omitempty"`
+}
+
+// HasServerKeys reports whether any server key pin is configured.
+func (c *ClientConfig) HasServerKeys() bool {
+	return c.ServerPublicKey != "" || len(c.ServerPublicKeys) > 0
+}
+
+// AcceptedServerKeys returns the server key pins accepted at time t.
+func (c *ClientConfig) AcceptedServerKeys(t time.Time) []string {
+	var keys []string
+	if c.ServerPublicKey != "" {
+		keys = append(keys, c.ServerPublicKey)
+	}
+	for _, k := range c.ServerPublicKeys {
+		if k.ValidAt(t) {
+			keys = append(keys, k.Key)
+		}
+	}
+	return keys
+}
+
+// MetadataPublicKey returns the key stream metadata is encrypted to, or "".
+func (c *ClientConfig) MetadataPublicKey() string {
+	if c.MetadataKey != "" {
+		return c.MetadataKey
+	}
+	if _, err := crypto.ParsePublicKey(c.ServerPublicKey); err == nil {
+		return c.ServerPublicKey
+	}
+	return ""
 }
 
 // DefaultClientConfig returns a basic client configuration with a single SOCKS5 inbound.
 func DefaultClientConfig() *ClientConfig {
 	return &ClientConfig{
-		RemoteAddr: "127.0.0.1:8080",
+		ConfigVersion: ClientConfigVersion,
+		RemoteAddr:    "127.0.0.1:8080",
 		Inbounds: []ClientInbound{
 			{
 				Protocol:  protocol.ProtocolSOCKS5,
@@ -1,8 +1,14 @@
 package config
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"phoenix/pkg/crypto"
 	"phoenix/pkg/protocol"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/pelletier/go-toml"
 )
@@ -63,3 +69,387 @@ auth = "/key"
 		t.Errorf("Expected inbound 1 to be ssh, got %s", config.Inbounds[1].Protocol)
 	}
 }
+
+func TestClientConfigValidation(t *testing.T) {
+	tomlData := `remote_addr = "example.com:443"
+tls_mod = "system"
+fingerprint = "edge"
+
+[[inbounds]]
+protocol = "socks"
+local_addr = "127.0.0.1:1080"
+`
+	_, err := parseClientConfig([]byte(tomlData), true)
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+
+	want := map[string]int{
+		"tls_mod":              2,
+		"fingerprint":          3,
+		"inbounds[0].protocol": 6,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("Expected %d errors, got %d: %v", len(want), len(errs), errs)
+	}
+	for _, e := range errs {
+		line, ok := want[e.Key]
+		if !ok {
+			t.Errorf("Unexpected error: %v", e)
+		} else if e.Line != line {
+			t.Errorf("Expected %s on line %d, got %d", e.Key, line, e.Line)
+		}
+	}
+}
+
+func TestClientConfigTransport(t *testing.T) {
+	for _, tc := range []struct {
+		transport, carrier string
+		ok                 bool
+	}{
+		{"", "body", true},
+		{"websocket", "", true},
+		{"websocket-h2", "", true},
+		{"split", "header", true},
+		{"grpc", "", false},
+		{"split", "body", false},
+	} {
+		_, pub, _ := crypto.GenerateKeypair()
+		config := DefaultClientConfig()
+		config.MetadataKey = pub
+		config.RemoteAddr = "example.com:443"
+		config.Transport = tc.transport
+		config.Camouflage.Carrier = tc.carrier
+		if err := config.Validate(); (err == nil) != tc.ok {
+			t.Errorf("transport %q with carrier %q: got %v", tc.transport, tc.carrier, err)
+		}
+	}
+}
+
+func TestClientConfigContradictoryTLS(t *testing.T) {
+	config := DefaultClientConfig()
+	config.TLSMode = "insecure"
+	_, pub, _ := crypto.GenerateKeypair()
+	config.ServerPublicKey = pub
+
+	if err := config.Validate(); err == nil {
+		t.Errorf("Expected error for tls_mode = insecure combined with server_public_key")
+	}
+}
+
+func TestClientConfigMigration(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "client.toml")
+	legacy := "remote_addr = \"example.com:443\"\n\n[[inbounds]]\nprotocol = \"socks5\"\nlocal_addr = \"127.0.0.1:1080\"\n"
+	if err := os.WriteFile(path, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadClientConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load legacy config: %v", err)
+	}
+	if config.ConfigVersion != ClientConfigVersion {
+		t.Errorf("Expected in-memory config_version %d, got %d", ClientConfigVersion, config.ConfigVersion)
+	}
+
+	// Version 0 files only lack config_version, which is not worth a rewrite.
+	if migrated, err := MigrateClientConfigFile(path); err != nil || migrated {
+		t.Errorf("Expected migration to leave the file alone, got migrated=%v err=%v", migrated, err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != legacy {
+		t.Errorf("File changed by a migration that changes nothing")
+	}
+
+	future := fmt.Sprintf("config_version = %d\nremote_addr = \"example.com:443\"\n", ClientConfigVersion+1)
+	if _, err := parseClientConfig([]byte(future), true); err == nil {
+		t.Errorf("Expected error for config from a newer build")
+	}
+}
+
+func TestMigrateFileKeepsComments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.toml")
+	legacy := `# Phoenix client
+
+# Where to connect
+remote_addr = "example.com:443" # the CDN edge
+old_name = "x#y"
+
+# Local listeners
+[[inbounds]]
+protocol = "socks5"
+local_addr = "127.0.0.1:1080"
+
+[[inbounds]]
+# SSH for git
+protocol = "ssh"
+local_addr = "127.0.0.1:2222"
+# end
+`
+	if err := os.WriteFile(path, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rename := []migration{{From: 0, Description: "rename old_name", Apply: func(tree *toml.Tree) error {
+		tree.Set("new_name", tree.Get("old_name"))
+		return tree.Delete("old_name")
+	}}}
+
+	migrated, err := migrateFile(path, rename, 1)
+	if err != nil || !migrated {
+		t.Fatalf("Expected file migration, got migrated=%v err=%v", migrated, err)
+	}
+	if backup, _ := os.ReadFile(path + ".bak"); string(backup) != legacy {
+		t.Errorf("Backup does not match the original file")
+	}
+	data, _ := os.ReadFile(path)
+	out := string(data)
+	for _, want := range []string{"# Phoenix client\n\n", "# Where to connect\n# the CDN edge\nremote_addr", "# Local listeners\n[[inbounds]]", "# SSH for git\n  protocol = \"ssh\"", "# end", `new_name = "x#y"`, "config_version = 1"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Migrated file lacks %q:\n%s", want, out)
+		}
+	}
+	if !strings.HasPrefix(out, "# Phoenix client\n\n") {
+		t.Errorf("File header comment moved:\n%s", out)
+	}
+	if strings.Contains(out, "old_name") {
+		t.Errorf("Migrated file still has old_name:\n%s", out)
+	}
+
+	if migrated, err := migrateFile(path, rename, 1); err != nil || migrated {
+		t.Errorf("Expected second migration to be a no-op, got migrated=%v err=%v", migrated, err)
+	}
+}
+
+func TestSecretReferences(t *testing.T) {
+	dir := t.TempDir()
+	tokenPath := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenPath, []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PHOENIX_TEST_SS_AUTH", "aes-256-gcm:env-password")
+
+	tomlData := fmt.Sprintf(`remote_addr = "example.com:443"
+auth_token = "file:%s"
+
+[[inbounds]]
+protocol = "shadowsocks"
+local_addr = "127.0.0.1:8388"
+auth = "env:PHOENIX_TEST_SS_AUTH"
+`, tokenPath)
+
+	config, err := parseClientConfig([]byte(tomlData), true)
+	if err != nil {
+		t.Fatalf("Failed to load config with secret references: %v", err)
+	}
+	if config.AuthToken != "file-token" {
+		t.Errorf("Expected auth_token from file, got %q", config.AuthToken)
+	}
+	if config.Inbounds[0].Auth != "aes-256-gcm:env-password" {
+		t.Errorf("Expected auth from environment, got %q", config.Inbounds[0].Auth)
+	}
+
+	_, err = parseClientConfig([]byte(`remote_addr = "example.com:443"
+auth_token = "env:PHOENIX_TEST_UNSET_TOKEN"
+`), true)
+	if err == nil {
+		t.Fatalf("Expected error for unset environment variable")
+	}
+
+	// Share links must never carry references that would resolve on the receiving device.
+	link, _ := EncodeShareLink(&ClientConfig{RemoteAddr: "example.com:443", AuthToken: "file:/etc/hostname"}, nil)
+	if _, _, err := DecodeShareLink(link, nil); err == nil {
+		t.Errorf("Expected share link with a secret reference to be rejected")
+	}
+}
+
+func TestServerKeyRotationWindows(t *testing.T) {
+	_, oldKey, _ := crypto.GenerateKeypair()
+	_, newKey, _ := crypto.GenerateKeypair()
+	tomlData := fmt.Sprintf(`remote_addr = "example.com:443"
+
+[[server_public_keys]]
+key = "%s"
+not_after = 2026-06-01T00:00:00Z
+
+[[server_public_keys]]
+key = "%s"
+not_before = 2026-05-01T00:00:00Z
+`, oldKey, newKey)
+
+	config, err := parseClientConfig([]byte(tomlData), true)
+	if err != nil {
+		t.Fatalf("Failed to parse rotation config: %v", err)
+	}
+
+	at := func(s string) []string {
+		ts, _ := time.Parse(time.RFC3339, s)
+		return config.AcceptedServerKeys(ts)
+	}
+	if got := at("2026-04-01T00:00:00Z"); len(got) != 1 || got[0] != oldKey {
+		t.Errorf("Before rollover: expected only the old key, got %v", got)
+	}
+	if got := at("2026-05-15T00:00:00Z"); len(got) != 2 {
+		t.Errorf("During overlap: expected both keys, got %v", got)
+	}
+	if got := at("2026-07-01T00:00:00Z"); len(got) != 1 || got[0] != newKey {
+		t.Errorf("After rollover: expected only the new key, got %v", got)
+	}
+
+	// The windows must survive a share link round trip.
+	link, err := EncodeShareLink(config, nil)
+	if err != nil {
+		t.Fatalf("EncodeShareLink failed: %v", err)
+	}
+	decoded, _, err := DecodeShareLink(link, nil)
+	if err != nil {
+		t.Fatalf("DecodeShareLink failed: %v", err)
+	}
+	if len(decoded.ServerPublicKeys) != 2 || !decoded.ServerPublicKeys[0].NotAfter.Equal(config.ServerPublicKeys[0].NotAfter) {
+		t.Errorf("Rotation keys lost in share link: %+v", decoded.ServerPublicKeys)
+	}
+}
+
+func TestServerNextKeys(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "server.key")
+	os.WriteFile(keyFile, []byte("key"), 0600)
+	config := DefaultServerConfig()
+	config.ListenAddr = ":443"
+	config.Security.PrivateKeyPath = keyFile
+	config.Security.NextKeys = []ServerNextKey{
+		{PrivateKeyPath: keyFile, NotBefore: time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC), AllFrom: time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{PrivateKeyPath: keyFile, NotBefore: time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC), ServerNames: []string{"new.example.com"}, AllFrom: time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	err := config.Validate()
+	for _, key := range []string{"security.next_keys[0].all_from", "security.next_keys[1].all_from"} {
+		if err == nil || !strings.Contains(err.Error(), key) {
+			t.Errorf("Expected an error for %s, got %v", key, err)
+		}
+	}
+
+	k := ServerNextKey{ServerNames: []string{"new.example.com"}, AllFrom: time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)}
+	may := time.Date(2026, 5, 15, 0, 0, 0, 0, time.UTC)
+	if !k.PresentedTo("NEW.example.com", may) || k.PresentedTo("example.com", may) {
+		t.Error("Before all_from, the key must go only to its server names")
+	}
+	if !k.PresentedTo("example.com", k.AllFrom) {
+		t.Error("From all_from on, the key must go to every client")
+	}
+}
+
+func TestAuthorizedClientsFile(t *testing.T) {
+	dir := t.TempDir()
+	_, pub, _ := crypto.GenerateKeypair()
+	path := filepath.Join(dir, "authorized_clients.toml")
+
+	good := fmt.Sprintf(`[[client]]
+key = "%s"
+label = "alice-phone"
+expires = 2027-01-01T00:00:00Z
+protocols = ["socks5"]
+`, pub)
+	if err := os.WriteFile(path, []byte(good), 0600); err != nil {
+		t.Fatal(err)
+	}
+	clients, err := LoadAuthorizedClients(path)
+	if err != nil {
+		t.Fatalf("LoadAuthorizedClients failed: %v", err)
+	}
+	if len(clients.Clients) != 1 || clients.Clients[0].Label != "alice-phone" || clients.Clients[0].Expires.IsZero() {
+		t.Errorf("Unexpected clients: %+v", clients.Clients)
+	}
+
+	bad := good + `
+[[client]]
+key = "not-a-key"
+label = "alice-phone"
+protocols = ["telnet"]
+`
+	if err := os.WriteFile(path, []byte(bad), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadAuthorizedClients(path)
+	for _, want := range []string{"client[1].key", "duplicate label", `unknown protocol "telnet"`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error mentioning %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestUsersFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.toml")
+	data := `[[user]]
+name = "alice"
+tokens = ["alice-token-0123456789"]
+protocols = ["socks5"]
+targets = ["*.example.com:443", "10.0.0.0/8", "[2001:db8::/32]:22", "*:8000-8100"]
+
+[[user]]
+name = "bob"
+enabled = false
+`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := LoadUsers(path)
+	if err != nil {
+		t.Fatalf("LoadUsers failed: %v", err)
+	}
+	alice, bob := &db.Users[0], &db.Users[1]
+	if !alice.Enabled || bob.Enabled {
+		t.Errorf("Expected enabled to default to true: alice=%v bob=%v", alice.Enabled, bob.Enabled)
+	}
+
+	for target, want := range map[string]bool{
+		"www.example.com:443": true,
+		"example.com:443":     false,
+		"www.example.com:80":  false,
+		"10.1.2.3:25":         true,
+		"11.1.2.3:25":         false,
+		"[2001:db8::1]:22":    true,
+		"[2001:db8::1]:23":    false,
+		"anything.test:8050":  true,
+		"internal.example:22": false,
+	} {
+		if got := alice.AllowsTarget(target); got != want {
+			t.Errorf("AllowsTarget(%q) = %v, want %v", target, got, want)
+		}
+	}
+	if !bob.AllowsTarget("anywhere.test:1") {
+		t.Error("Expected a user without targets to reach any target")
+	}
+
+	bad := `[[user]]
+name = "carol"
+tokens = ["short"]
+targets = ["foo.*.com"]
+`
+	if err := os.WriteFile(path, []byte(bad), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadUsers(path)
+	for _, want := range []string{"user[0].tokens[0]", "user[0].targets[0]"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error mentioning %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for in, want := range map[string]int64{
+		"1024":   1024,
+		"500MB":  500e6,
+		"20GiB":  20 << 30,
+		"1.5 kb": 1500,
+	} {
+		if got, err := ParseByteSize(in); err != nil || got != want {
+			t.Errorf("ParseByteSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"lots", "-1", "inf", "NaN", "+Inf GB", "0x1p70", "1e3", "8EB", "9223372036854775807", "10000000TiB"} {
+		if _, err := ParseByteSize(in); err == nil {
+			t.Errorf("Expected an error for %q", in)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"net/url"
+	"os"
+)
+
+// ServerDecoy serves a real website to every request that is not an
+// authenticated Phoenix stream, including banned and unauthenticated
+// clients, so the server looks like an ordinary web server to probers.
+// The one exception: clients that authenticated (by token or client key)
+// are told why a stream was refused, e.g. a disabled protocol or an
+// exhausted quota. Set one of static_dir or upstream.
+//
+//	[decoy]
+//	upstream = "https://example.org"
+type ServerDecoy struct {
+	// StaticDir is a directory of files to serve.
+	StaticDir string `toml:"static_dir,omitempty"`
+
+	// Upstream is an http:// or https:// site to reverse-proxy to.
+	Upstream string `toml:"upstream,omitempty"`
+}
+
+// Enabled reports whether a decoy site is configured.
+func (d *ServerDecoy) Enabled() bool {
+	return d.StaticDir != "" || d.Upstream != ""
+}
+
+func (d *ServerDecoy) validate(errs *ValidationErrors) {
+	if d.StaticDir != "" && d.Upstream != "" {
+		errs.add("decoy", "set only one of static_dir and upstream")
+	}
+	if d.StaticDir != "" {
+		if fi, err := os.Stat(d.StaticDir); err != nil {
+			errs.add("decoy.static_dir", "%v", err)
+		} else if !fi.IsDir() {
+			errs.add("decoy.static_dir", "%s is not a directory", d.StaticDir)
+		}
+	}
+	if d.Upstream != "" {
+		u, err := url.Parse(d.Upstream)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add("decoy.upstream", "must be an http:// or https:// URL")
+		}
+	}
+}
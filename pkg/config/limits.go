@@ -0,0 +1,77 @@
+package config
+
+// DefaultMaxStreamsPerConnection is the HTTP/2 concurrent stream limit per
+// client connection when limits.max_streams_per_connection is unset.
+const DefaultMaxStreamsPerConnection = 500
+
+// ServerLimits caps the resources clients can hold open. Zero means
+// unlimited. Streams over a global limit are refused with 503 Service
+// Unavailable, streams over a per-user limit with 429 Too Many Requests,
+// both with a Retry-After header.
+//
+//	[limits]
+//	max_streams = 4000
+//	max_streams_per_user = 200
+//	max_udp_sessions = 500
+//	max_outbound_per_user = 150
+//	memory_budget = "512MiB"
+type ServerLimits struct {
+	// MaxStreamsPerConnection is the HTTP/2 concurrent stream limit of each
+	// client connection (default DefaultMaxStreamsPerConnection).
+	MaxStreamsPerConnection int `toml:"max_streams_per_connection,omitempty"`
+
+	// MaxStreams and MaxStreamsPerUser cap open streams of every protocol.
+	MaxStreams        int `toml:"max_streams,omitempty"`
+	MaxStreamsPerUser int `toml:"max_streams_per_user,omitempty"`
+
+	// MaxUDPSessions and MaxUDPSessionsPerUser cap UDP tunnels, each of
+	// which holds a UDP socket on the server.
+	MaxUDPSessions        int `toml:"max_udp_sessions,omitempty"`
+	MaxUDPSessionsPerUser int `toml:"max_udp_sessions_per_user,omitempty"`
+
+	// MaxOutbound and MaxOutboundPerUser cap TCP streams (SOCKS5, SSH,
+	// Shadowsocks), each of which holds an outbound TCP connection.
+	MaxOutbound        int `toml:"max_outbound,omitempty"`
+	MaxOutboundPerUser int `toml:"max_outbound_per_user,omitempty"`
+
+	// MemoryBudget refuses new streams while the process uses more memory
+	// than this (e.g. "512MiB"), and makes the garbage collector aim below it.
+	MemoryBudget string `toml:"memory_budget,omitempty"`
+}
+
+// StreamsPerConnection returns the effective per-connection stream limit.
+func (l *ServerLimits) StreamsPerConnection() uint32 {
+	if l.MaxStreamsPerConnection > 0 {
+		return uint32(l.MaxStreamsPerConnection)
+	}
+	return DefaultMaxStreamsPerConnection
+}
+
+func (l *ServerLimits) validate(errs *ValidationErrors) {
+	for _, f := range []struct {
+		key string
+		v   int
+	}{
+		{"max_streams_per_connection", l.MaxStreamsPerConnection},
+		{"max_streams", l.MaxStreams},
+		{"max_streams_per_user", l.MaxStreamsPerUser},
+		{"max_udp_sessions", l.MaxUDPSessions},
+		{"max_udp_sessions_per_user", l.MaxUDPSessionsPerUser},
+		{"max_outbound", l.MaxOutbound},
+		{"max_outbound_per_user", l.MaxOutboundPerUser},
+	} {
+		if f.v < 0 {
+			errs.add("limits."+f.key, "must not be negative (use 0 for no limit)")
+		}
+	}
+	if l.MemoryBudget != "" {
+		if n, err := ParseByteSize(l.MemoryBudget); err != nil {
+			errs.add("limits.memory_budget", "%v", err)
+		} else if n < 64<<20 {
+			errs.add("limits.memory_budget", "%s is too small to run the server (at least 64MiB)", l.MemoryBudget)
+		}
+	}
+	if l.MaxStreamsPerUser > 0 && l.MaxStreams > 0 && l.MaxStreamsPerUser > l.MaxStreams {
+		errs.add("limits.max_streams_per_user", "is larger than limits.max_streams (%d)", l.MaxStreams)
+	}
+}
@@ -1,14 +1,18 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"sort"
 
 	"github.com/pelletier/go-toml"
 )
 
-// LoadServerConfig reads and parses a server configuration file.
+// LoadServerConfig reads, parses and validates a server configuration file.
+// Files written for an older schema are migrated in memory first.
 func LoadServerConfig(filePath string) (*ServerConfig, error) {
 	data, err := ioutil.ReadFile(filePath)
 	if err != nil {
@@ -18,15 +22,24 @@ func LoadServerConfig(filePath string) (*ServerConfig, error) {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
-	config := DefaultServerConfig()
-	if err := toml.Unmarshal(data, config); err != nil {
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
 		return nil, fmt.Errorf("failed to parse TOML configuration: %w", err)
 	}
+	if _, err := migrateTree(tree, serverMigrations, ServerConfigVersion); err != nil {
+		return nil, err
+	}
+
+	config := DefaultServerConfig()
+	if err := decodeAndValidate(tree, config, true); err != nil {
+		return nil, fmt.Errorf("invalid configuration %s: %w", filePath, err)
+	}
 
 	return config, nil
 }
 
-// LoadClientConfig reads and parses a client configuration file.
+// LoadClientConfig reads, parses and validates a client configuration file.
+// Files written for an older schema are migrated in memory first.
 func LoadClientConfig(filePath string) (*ClientConfig, error) {
 	data, err := ioutil.ReadFile(filePath)
 	if err != nil {
@@ -36,10 +49,63 @@ func LoadClientConfig(filePath string) (*ClientConfig, error) {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
-	config := DefaultClientConfig()
-	if err := toml.Unmarshal(data, config); err != nil {
+	config, err := parseClientConfig(data, true)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration %s: %w", filePath, err)
+	}
+
+	return config, nil
+}
+
+// parseClientConfig migrates, decodes and validates client TOML on top of the defaults.
+// It is shared by LoadClientConfig and DecodeShareLink. Secret references are
+// only resolved when resolve is set, so untrusted input cannot read local files.
+func parseClientConfig(data []byte, resolve bool) (*ClientConfig, error) {
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
 		return nil, fmt.Errorf("failed to parse TOML configuration: %w", err)
 	}
+	if _, err := migrateTree(tree, clientMigrations, ClientConfigVersion); err != nil {
+		return nil, err
+	}
+
+	config := DefaultClientConfig()
+	if err := decodeAndValidate(tree, config, resolve); err != nil {
+		return nil, err
+	}
 
 	return config, nil
 }
+
+// validatable is implemented by ClientConfig and ServerConfig.
+type validatable interface {
+	Validate() error
+}
+
+// decodeAndValidate unmarshals tree into config, rejecting unknown keys,
+// optionally resolving secret references, and running config.Validate.
+// All problems are reported together with the line they occur on.
+func decodeAndValidate(tree *toml.Tree, config validatable, resolve bool) error {
+	errs := checkUnknownKeys(tree, reflect.TypeOf(config).Elem(), "")
+
+	if err := tree.Unmarshal(config); err != nil {
+		return fmt.Errorf("failed to parse TOML configuration: %w", err)
+	}
+
+	if resolve {
+		errs = append(errs, resolveSecrets(config)...)
+	}
+
+	if err := config.Validate(); err != nil {
+		var verrs ValidationErrors
+		if errors.As(err, &verrs) {
+			errs = append(errs, verrs...)
+		} else {
+			errs.add("config", "%v", err)
+		}
+	}
+
+	attachLines(errs, tree)
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
+	return errs.orNil()
+}
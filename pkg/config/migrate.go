@@ -0,0 +1,307 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// ClientConfigVersion is the client config schema version written by this build.
+// Files without config_version are treated as version 0.
+const ClientConfigVersion = 1
+
+// ServerConfigVersion is the server config schema version written by this build.
+// Files without config_version are treated as version 0.
+const ServerConfigVersion = 1
+
+// migration upgrades a raw configuration tree from version From to From+1.
+// Migrations operate on the TOML tree rather than the Go struct so that
+// renamed or restructured keys can still be read after the struct changes.
+type migration struct {
+	From        int
+	Description string
+	Apply       func(tree *toml.Tree) error
+}
+
+// clientMigrations lists every client schema upgrade, in order.
+var clientMigrations = []migration{
+	{
+		// Configs written before versioning (including those from older
+		// Android builds) already match the version 1 layout.
+		From:        0,
+		Description: "add config_version",
+		Apply:       func(*toml.Tree) error { return nil },
+	},
+}
+
+// serverMigrations lists every server schema upgrade, in order.
+var serverMigrations = []migration{
+	{
+		From:        0,
+		Description: "add config_version",
+		Apply:       func(*toml.Tree) error { return nil },
+	},
+}
+
+// migrateTree upgrades tree in place to target using migrations.
+// It reports whether any migration was applied.
+func migrateTree(tree *toml.Tree, migrations []migration, target int) (bool, error) {
+	version := 0
+	if v := tree.Get("config_version"); v != nil {
+		n, ok := v.(int64)
+		if !ok {
+			return false, fmt.Errorf("config_version must be an integer, got %v", v)
+		}
+		version = int(n)
+	}
+
+	if version > target {
+		return false, fmt.Errorf("config_version %d is newer than this build supports (%d); please update Phoenix", version, target)
+	}
+	if version < 0 {
+		return false, fmt.Errorf("invalid config_version %d", version)
+	}
+
+	migrated := false
+	for version < target {
+		m := findMigration(migrations, version)
+		if m == nil {
+			return false, fmt.Errorf("no migration from config_version %d", version)
+		}
+		if err := m.Apply(tree); err != nil {
+			return false, fmt.Errorf("migrating config_version %d (%s): %w", version, m.Description, err)
+		}
+		version++
+		tree.Set("config_version", int64(version))
+		migrated = true
+	}
+
+	return migrated, nil
+}
+
+func findMigration(migrations []migration, from int) *migration {
+	for i := range migrations {
+		if migrations[i].From == from {
+			return &migrations[i]
+		}
+	}
+	return nil
+}
+
+// MigrateClientConfigFile upgrades a client configuration file on disk to
+// ClientConfigVersion. The original file is kept as filePath + ".bak".
+// It reports whether the file was rewritten.
+func MigrateClientConfigFile(filePath string) (bool, error) {
+	return migrateFile(filePath, clientMigrations, ClientConfigVersion)
+}
+
+// migrateFile rewrites filePath if migrating it changes anything besides
+// config_version; files that only lack the version are upgraded in memory
+// on every load instead. Comments are carried over to the keys they
+// annotated.
+func migrateFile(filePath string, migrations []migration, target int) (bool, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read config file: %w", err)
+	}
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse TOML configuration: %w", err)
+	}
+
+	comments, trailing := fileComments(data, keyLines(tree, "", map[int]string{}))
+	before := tree.ToMap()
+	migrated, err := migrateTree(tree, migrations, target)
+	if err != nil || !migrated {
+		return false, err
+	}
+	after := tree.ToMap()
+	delete(before, "config_version")
+	delete(after, "config_version")
+	if reflect.DeepEqual(before, after) {
+		return false, nil
+	}
+
+	out, err := encodeWithComments(tree, comments, trailing)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode migrated configuration: %w", err)
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return false, err
+	}
+	if err := ioutil.WriteFile(filePath+".bak", data, info.Mode().Perm()); err != nil {
+		return false, fmt.Errorf("failed to write backup: %w", err)
+	}
+
+	// Write to a temp file and rename so a crash never leaves a truncated config.
+	tmp, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+".tmp*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(out); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// keyLines maps the line of every key and table header in tree to its path,
+// with array tables indexed: "inbounds[0].protocol".
+func keyLines(tree *toml.Tree, prefix string, lines map[int]string) map[int]string {
+	for _, k := range tree.Keys() {
+		path := prefix + k
+		switch v := tree.GetPath([]string{k}).(type) {
+		case *toml.Tree:
+			lines[v.Position().Line] = path
+			keyLines(v, path+".", lines)
+		case []*toml.Tree:
+			for i, sub := range v {
+				p := fmt.Sprintf("%s[%d]", path, i)
+				lines[sub.Position().Line] = p
+				keyLines(sub, p+".", lines)
+			}
+		default:
+			lines[tree.GetPositionPath([]string{k}).Line] = path
+		}
+	}
+	return lines
+}
+
+// fileComments collects the comments of a TOML file by the path of the key
+// they belong to: the comment lines above a key and any comment after its
+// value. A block at the top of the file that is set apart by a blank line is
+// returned under "", and comments after the last key separately.
+func fileComments(data []byte, lines map[int]string) (map[string][]string, []string) {
+	comments := make(map[string][]string)
+	var pending []string
+	seenKey := false
+	for i, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "#") {
+			pending = append(pending, trimmed)
+			continue
+		}
+		path, ok := lines[i+1]
+		if !ok {
+			if trimmed == "" && !seenKey && len(pending) > 0 {
+				comments[""] = append(comments[""], pending...)
+				pending = nil
+			}
+			continue
+		}
+		seenKey = true
+		if c := inlineComment(trimmed); c != "" {
+			pending = append(pending, c)
+		}
+		if len(pending) > 0 {
+			comments[path] = pending
+			pending = nil
+		}
+	}
+	return comments, pending
+}
+
+// inlineComment returns the comment after the key or header on line, if any.
+func inlineComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == 0 && (strings.HasPrefix(line[i:], `"""`) || strings.HasPrefix(line[i:], "'''")):
+			// The rest of the line is inside a multi-line string.
+			return ""
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && c == '#':
+			return line[i:]
+		}
+	}
+	return ""
+}
+
+// encodeWithComments encodes tree and puts each comment back above the key
+// it belonged to. Comments of keys that no longer exist are kept at the end.
+func encodeWithComments(tree *toml.Tree, comments map[string][]string, trailing []string) (string, error) {
+	// Keys come out sorted: go-toml's OrderPreserve misplaces keys added by
+	// a migration, which can move a top-level key into a table.
+	encoded, err := tree.ToTomlString()
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	if header := comments[""]; len(header) > 0 {
+		out.WriteString(strings.Join(header, "\n") + "\n\n")
+		delete(comments, "")
+	}
+	table := ""
+	arrays := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimRight(encoded, "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		var path string
+		switch {
+		case strings.HasPrefix(trimmed, "[["):
+			name := strings.TrimSuffix(strings.TrimPrefix(trimmed, "[["), "]]")
+			table = fmt.Sprintf("%s[%d]", name, arrays[name])
+			arrays[name]++
+			path = table
+		case strings.HasPrefix(trimmed, "["):
+			table = strings.TrimSuffix(strings.TrimPrefix(trimmed, "["), "]")
+			path = table
+		case strings.Contains(trimmed, " = "):
+			key := trimmed[:strings.Index(trimmed, " = ")]
+			if unquoted, err := strconv.Unquote(key); err == nil {
+				key = unquoted
+			}
+			path = key
+			if table != "" {
+				path = table + "." + key
+			}
+		}
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		for _, c := range comments[path] {
+			out.WriteString(indent + c + "\n")
+		}
+		delete(comments, path)
+		out.WriteString(line + "\n")
+	}
+
+	paths := make([]string, 0, len(comments))
+	for path := range comments {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var orphans []string
+	for _, path := range paths {
+		orphans = append(orphans, comments[path]...)
+	}
+	if trailing = append(orphans, trailing...); len(trailing) > 0 {
+		out.WriteString("\n" + strings.Join(trailing, "\n") + "\n")
+	}
+	return out.String(), nil
+}
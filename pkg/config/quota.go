@@ -0,0 +1,121 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultQuotaStateFile is where quota usage is persisted if state_file is unset.
+const DefaultQuotaStateFile = "quota-state.json"
+
+// ServerQuotas configures per-user traffic quotas. Traffic of a user account
+// (see UserAccount) or access token subject is counted in both directions
+// against its quota class.
+//
+//	[quotas]
+//	default_class = "basic"
+//	cut_active = true
+//
+//	[quotas.classes.basic]
+//	limit = "20GiB"
+//	period = "monthly"
+type ServerQuotas struct {
+	// Classes maps a class name to its limit.
+	Classes map[string]QuotaClass `toml:"classes,omitempty"`
+
+	// DefaultClass applies to users and tokens that name no class (optional).
+	DefaultClass string `toml:"default_class,omitempty"`
+
+	// StateFile persists usage across restarts (default DefaultQuotaStateFile).
+	StateFile string `toml:"state_file,omitempty"`
+
+	// CutActive ends open streams as soon as the quota runs out instead of
+	// only refusing new ones.
+	CutActive bool `toml:"cut_active,omitempty"`
+}
+
+// QuotaClass is a byte limit per period.
+type QuotaClass struct {
+	// Limit is a byte count with an optional unit, e.g. "500MB" or "20GiB".
+	Limit string `toml:"limit"`
+
+	// Period is "daily" or "monthly"; periods start at midnight UTC.
+	Period string `toml:"period"`
+}
+
+var validQuotaPeriods = []string{"daily", "monthly"}
+
+// Enabled reports whether any quota class is configured.
+func (q *ServerQuotas) Enabled() bool {
+	return len(q.Classes) > 0
+}
+
+// StatePath returns the quota state file path.
+func (q *ServerQuotas) StatePath() string {
+	if q.StateFile != "" {
+		return q.StateFile
+	}
+	return DefaultQuotaStateFile
+}
+
+// PeriodStart returns the start of the period containing t.
+func (c QuotaClass) PeriodStart(t time.Time) time.Time {
+	t = t.UTC()
+	if c.Period == "daily" {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// byteUnits are the suffixes accepted by ParseByteSize, longest first.
+var byteUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+	{"TB", 1e12}, {"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3},
+	{"B", 1},
+}
+
+// ParseByteSize parses a byte count such as "1024", "500MB" or "20GiB".
+func ParseByteSize(orig string) (int64, error) {
+	s := strings.TrimSpace(orig)
+	factor := int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(strings.ToUpper(s), strings.ToUpper(u.suffix)) {
+			s, factor = strings.TrimSpace(s[:len(s)-len(u.suffix)]), u.factor
+			break
+		}
+	}
+	// Plain decimals only: ParseFloat would also take "inf", "NaN" and hex
+	// floats such as "0x1p70".
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || !isDecimal(s) {
+		return 0, fmt.Errorf("invalid byte size %q (expected e.g. \"500MB\" or \"20GiB\")", orig)
+	}
+	// float64(math.MaxInt64) rounds up to 2^63, so it is itself too large.
+	v := n * float64(factor)
+	if v >= math.MaxInt64 {
+		return 0, fmt.Errorf("byte size %q is too large", orig)
+	}
+	return int64(v), nil
+}
+
+// isDecimal reports whether s is digits with at most one decimal point.
+func isDecimal(s string) bool {
+	digits, points := 0, 0
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case c == '.':
+			points++
+		default:
+			return false
+		}
+	}
+	return digits > 0 && points <= 1
+}
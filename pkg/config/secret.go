@@ -0,0 +1,114 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Secret reference prefixes accepted by fields tagged `secret:"true"`.
+//
+//	auth_token = "file:/run/secrets/phoenix_token"  → contents of the file
+//	auth_token = "env:PHOENIX_TOKEN"                 → value of the environment variable
+//
+// Any other value is used literally. For path fields such as private_key the
+// reference resolves to the path itself, not to the key material.
+const (
+	secretFilePrefix = "file:"
+	secretEnvPrefix  = "env:"
+)
+
+// IsSecretRef reports whether s is a file: or env: secret reference.
+func IsSecretRef(s string) bool {
+	return strings.HasPrefix(s, secretFilePrefix) || strings.HasPrefix(s, secretEnvPrefix)
+}
+
+// ResolveSecret returns the value s refers to, or s itself if it is not a
+// secret reference. Trailing newlines are trimmed from file contents.
+// Errors name the reference but never include the secret value.
+func ResolveSecret(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, secretFilePrefix):
+		path := strings.TrimPrefix(s, secretFilePrefix)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return "", fmt.Errorf("secret file not found: %s", path)
+			}
+			return "", fmt.Errorf("failed to read secret file %s: %v", path, err)
+		}
+		value := strings.TrimRight(string(data), "\r\n")
+		if value == "" {
+			return "", fmt.Errorf("secret file %s is empty", path)
+		}
+		return value, nil
+
+	case strings.HasPrefix(s, secretEnvPrefix):
+		name := strings.TrimPrefix(s, secretEnvPrefix)
+		value, ok := os.LookupEnv(name)
+		if !ok || value == "" {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+
+	default:
+		return s, nil
+	}
+}
+
+// resolveSecrets replaces every secret reference in the string fields of v
+// tagged `secret:"true"`, recursing into nested structs and slices of structs.
+func resolveSecrets(v interface{}) ValidationErrors {
+	var errs ValidationErrors
+	walkSecrets(reflect.ValueOf(v).Elem(), "", func(key string, field reflect.Value) {
+		resolved, err := ResolveSecret(field.String())
+		if err != nil {
+			errs.add(key, "%v", err)
+			return
+		}
+		field.SetString(resolved)
+	})
+	return errs
+}
+
+// findSecretRefs returns the keys of every tagged field in v that still holds
+// a secret reference.
+func findSecretRefs(v interface{}) []string {
+	var keys []string
+	walkSecrets(reflect.ValueOf(v).Elem(), "", func(key string, field reflect.Value) {
+		if IsSecretRef(field.String()) {
+			keys = append(keys, key)
+		}
+	})
+	return keys
+}
+
+func walkSecrets(v reflect.Value, prefix string, fn func(key string, field reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("toml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		key := prefix + name
+		field := v.Field(i)
+
+		switch field.Kind() {
+		case reflect.String:
+			if f.Tag.Get("secret") == "true" {
+				fn(key, field)
+			}
+		case reflect.Struct:
+			walkSecrets(field, key+".", fn)
+		case reflect.Slice:
+			if field.Type().Elem().Kind() == reflect.Struct {
+				for j := 0; j < field.Len(); j++ {
+					walkSecrets(field.Index(j), fmt.Sprintf("%s[%d].", key, j), fn)
+				}
+			}
+		}
+	}
+}
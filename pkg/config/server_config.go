@@ -1,12 +1,35 @@
 package config
 
+import (
+	"phoenix/pkg/protocol"
+	"strings"
+	"time"
+)
+
 // ServerSecurity defines the security configuration for the server.
 // It controls which protocols are allowed to be tunneled.
 type ServerSecurity struct {
 	// AuthToken is a shared secret for application-level authentication.
 	// If set, clients must provide this exact token to connect.
 	// Works with all TLS modes (h2c, system, mTLS).
-	AuthToken string `toml:"auth_token"`
+	// May be a secret reference ("file:..." or "env:...").
+	AuthToken string `toml:"auth_token" secret:"true"`
+
+	// AuthMode controls which forms of AuthToken are accepted:
+	//   "" (default): both the static X-Nerve-Token header and HMAC auth.
+	//   "hmac": only HMAC auth; static tokens are rejected.
+	AuthMode string `toml:"auth_mode,omitempty"`
+
+	// TokenIssuerKeys are Base64 Ed25519 public keys trusted to sign access
+	// tokens ("pht1...."). Clients send a token as their auth_token; it carries
+	// the user, expiry, allowed protocols and quota class.
+	// List several keys to rotate the issuer key.
+	TokenIssuerKeys []string `toml:"token_issuer_keys,omitempty"`
+
+	// UsersFile maps auth tokens and client keys to user accounts, each with
+	// its own allowed protocols and targets (see UserDatabase). It is reloaded
+	// when it changes. Streams that match no user keep the global settings.
+	UsersFile string `toml:"users_file,omitempty"`
 
 	// EnableSOCKS5 enables or disables the SOCKS5 proxy protocol (TCP).
 	EnableSOCKS5 bool `toml:"enable_socks5"`
@@ -21,10 +44,88 @@ type ServerSecurity struct {
 	EnableSSH bool `toml:"enable_ssh"`
 
 	// PrivateKeyPath is the path to the server's private key file (PEM).
-	PrivateKeyPath string `toml:"private_key"`
+	// May be a secret reference that resolves to the path.
+	PrivateKeyPath string `toml:"private_key" secret:"true"`
+
+	// PrivateKeyPassphrase unlocks an encrypted private_key file.
+	// Should be a secret reference ("file:..." or "env:..."); if empty and the
+	// key is encrypted, the passphrase is prompted for on the terminal.
+	PrivateKeyPassphrase string `toml:"private_key_passphrase,omitempty" secret:"true"`
+
+	// NextKeys schedules replacement keys for private_key. From its not_before
+	// on, the newest scheduled key is presented instead of private_key, so
+	// clients can be given the new pin (server_public_keys) weeks in advance.
+	// A key with server_names goes only to clients that ask for it by name
+	// until its all_from, so clients that do not pin it yet keep the old key.
+	NextKeys []ServerNextKey `toml:"next_keys,omitempty"`
+
+	// CertFile is a PEM certificate chain (e.g. from Let's Encrypt) served
+	// instead of a self-signed certificate. Requires KeyFile. Both files are
+	// reloaded automatically when they change on disk.
+	CertFile string `toml:"cert_file,omitempty"`
 
-	// AuthorizedClientKeys is a list of authorized client public keys (Base64).
+	// KeyFile is the PEM private key matching CertFile.
+	// May be a secret reference that resolves to the path.
+	KeyFile string `toml:"key_file,omitempty" secret:"true"`
+
+	// MetadataKeyPath is an Ed25519 private key (PEM) that decrypts stream
+	// metadata sent with camouflage carrier "body". Defaults to private_key
+	// and next_keys. May be a secret reference that resolves to the path.
+	MetadataKeyPath string `toml:"metadata_key,omitempty" secret:"true"`
+
+	// InnerEncryption requires an encrypted, mutually authenticated Noise
+	// channel inside every stream, keyed with metadata_key (or private_key)
+	// and the client's private_key. Use it when TLS ends at a CDN. Client
+	// keys (authorized_clients) are then checked in the inner handshake
+	// instead of the TLS handshake. Clients must set inner_encryption too.
+	InnerEncryption bool `toml:"inner_encryption,omitempty"`
+
+	// AuthorizedClientKeys is a list of authorized client public keys
+	// (Base64 Ed25519 or "sha256/..." SPKI pins).
 	AuthorizedClientKeys []string `toml:"authorized_clients"`
+
+	// AuthorizedClientsFile lists authorized client keys with a label, optional
+	// expiry and allowed protocols (see AuthorizedClients). It is reloaded when
+	// it changes; revoked keys are disconnected immediately.
+	AuthorizedClientsFile string `toml:"authorized_clients_file,omitempty"`
+}
+
+// ServerNextKey is a scheduled server key used for key rotation.
+type ServerNextKey struct {
+	// PrivateKeyPath is the path to the key file (PEM).
+	// May be a secret reference that resolves to the path.
+	PrivateKeyPath string `toml:"private_key" secret:"true"`
+
+	// PrivateKeyPassphrase unlocks an encrypted private_key file.
+	PrivateKeyPassphrase string `toml:"private_key_passphrase,omitempty" secret:"true"`
+
+	// NotBefore is when the server switches to presenting this key.
+	NotBefore time.Time `toml:"not_before"`
+
+	// ServerNames limits the key to clients connecting with one of these TLS
+	// server names (SNI), such as a second DNS name of the server that
+	// updated clients are given together with the new pin. Other clients
+	// keep getting the previous key.
+	ServerNames []string `toml:"server_names,omitempty"`
+
+	// AllFrom is when every client gets the key, whatever its server name
+	// (optional, requires server_names). Without it, the key reaches other
+	// clients only once it replaces private_key.
+	AllFrom time.Time `toml:"all_from,omitempty"`
+}
+
+// PresentedTo reports whether the key is presented at t to a client that
+// connected with serverName, once not_before has passed.
+func (k ServerNextKey) PresentedTo(serverName string, t time.Time) bool {
+	if len(k.ServerNames) == 0 || !k.AllFrom.IsZero() && !t.Before(k.AllFrom) {
+		return true
+	}
+	for _, name := range k.ServerNames {
+		if strings.EqualFold(name, serverName) {
+			return true
+		}
+	}
+	return false
 }
 
 // DefaultServerSecurity returns the default security configuration (all disabled by default).
@@ -36,20 +137,124 @@ func DefaultServerSecurity() ServerSecurity {
 	}
 }
 
+// DefaultACMECacheDir is where issued certificates and the ACME account key
+// are stored when acme.cache_dir is not set.
+const DefaultACMECacheDir = "acme-cache"
+
+// ServerACME configures automatic certificate issuance and renewal via ACME
+// (Let's Encrypt, or a local Pebble instance for testing).
+type ServerACME struct {
+	// Domains to obtain certificates for. ACME is enabled when non-empty.
+	Domains []string `toml:"domains"`
+
+	// Email is the contact address registered with the CA (optional).
+	Email string `toml:"email,omitempty"`
+
+	// CacheDir stores certificates and the account key across restarts.
+	CacheDir string `toml:"cache_dir,omitempty"`
+
+	// DirectoryURL is the ACME directory endpoint. Defaults to Let's Encrypt
+	// production; use e.g. "https://localhost:14000/dir" for Pebble.
+	DirectoryURL string `toml:"directory_url,omitempty"`
+
+	// CAFile is a PEM bundle trusted for the ACME API connection itself
+	// (needed for Pebble, whose API certificate is self-signed).
+	CAFile string `toml:"ca_file,omitempty"`
+
+	// HTTPAddr enables the HTTP-01 challenge on this address (e.g. ":80").
+	// TLS-ALPN-01 is always answered on listen_addr.
+	HTTPAddr string `toml:"http_addr,omitempty"`
+}
+
+// ServerEnrollment lets new clients register their key with a one-time
+// enrollment code instead of being added to authorized_clients by hand.
+// Enrolled keys are appended to security.authorized_clients_file.
+type ServerEnrollment struct {
+	// Secret signs enrollment codes. Enrollment is enabled when it is set.
+	// Anyone holding it can mint codes, so keep it out of the config file
+	// with a file: or env: reference.
+	Secret string `toml:"secret" secret:"true"`
+
+	// UsedCodesFile records redeemed codes so each code works only once,
+	// across restarts. Defaults to authorized_clients_file + ".used".
+	UsedCodesFile string `toml:"used_codes_file,omitempty"`
+
+	// Protocols restricts which protocols enrolled clients may use (optional).
+	Protocols []protocol.ProtocolType `toml:"protocols,omitempty"`
+}
+
 // ServerConfig defines the full structure of the server configuration file.
 type ServerConfig struct {
+	// ConfigVersion is the schema version of this file (see ServerConfigVersion).
+	// Older files are upgraded in memory on load.
+	ConfigVersion int `toml:"config_version"`
+
 	// ListenAddr is the address and port the server will bind to (e.g., ":8080").
 	// This uses the underlying h2c protocol.
 	ListenAddr string `toml:"listen_addr"`
 
 	// Security defines the protocol access controls.
 	Security ServerSecurity `toml:"security"`
+
+	// ACME enables automatic certificates instead of cert_file or self-signing.
+	ACME ServerACME `toml:"acme"`
+
+	// Enrollment enables one-time enrollment codes for new client keys.
+	Enrollment ServerEnrollment `toml:"enrollment"`
+
+	// Quotas limits the traffic of each user.
+	Quotas ServerQuotas `toml:"quotas"`
+
+	// Bandwidth shapes relayed traffic globally, per user and per stream.
+	Bandwidth ServerBandwidth `toml:"bandwidth"`
+
+	// Limits caps open streams, sockets and memory.
+	Limits ServerLimits `toml:"limits"`
+
+	// Bans blocks clients that repeatedly fail authentication.
+	Bans ServerBans `toml:"bans"`
+
+	// ClientIP finds the real client address behind a proxy or CDN.
+	ClientIP ServerClientIP `toml:"client_ip"`
+
+	// Decoy is the website shown to everything but Phoenix clients.
+	Decoy ServerDecoy `toml:"decoy"`
+
+	// Camouflage sets the request path, method and metadata encoding
+	// expected from clients.
+	Camouflage Camouflage `toml:"camouflage"`
+}
+
+// UsedEnrollmentCodesFile returns where redeemed enrollment codes are recorded.
+func (c *ServerConfig) UsedEnrollmentCodesFile() string {
+	if c.Enrollment.UsedCodesFile != "" {
+		return c.Enrollment.UsedCodesFile
+	}
+	return c.Security.AuthorizedClientsFile + ".used"
+}
+
+// ClientKeyAuth reports whether clients must present an authorized key,
+// either in the TLS handshake or, with inner_encryption, in the inner one.
+func (s *ServerSecurity) ClientKeyAuth() bool {
+	return len(s.AuthorizedClientKeys) > 0 || s.AuthorizedClientsFile != ""
+}
+
+// MutualTLS reports whether clients must present an authorized key in the
+// TLS handshake.
+func (s *ServerSecurity) MutualTLS() bool {
+	return s.ClientKeyAuth() && !s.InnerEncryption
+}
+
+// TLSEnabled reports whether the server listens with TLS rather than h2c.
+func (c *ServerConfig) TLSEnabled() bool {
+	return c.Security.CertFile != "" || c.Security.PrivateKeyPath != "" || len(c.ACME.Domains) > 0
 }
 
 // DefaultServerConfig returns a server configuration with safe defaults.
 func DefaultServerConfig() *ServerConfig {
 	return &ServerConfig{
-		ListenAddr: ":8080",
-		Security:   DefaultServerSecurity(),
+		ConfigVersion: ServerConfigVersion,
+		ListenAddr:    ":8080",
+		Security:      DefaultServerSecurity(),
 	}
 }
@@ -0,0 +1,244 @@
+package config
+
+import (
+	"bytes"
+	"compress/flate"
+	stdcrypto "crypto"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"phoenix/pkg/crypto"
+	"slices"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// ShareLinkScheme is the URI scheme used for client profile share links.
+const ShareLinkScheme = "phoenix"
+
+// ShareLinkVersion is the current share link format version.
+//
+// Format: phoenix://v1/<payload>[?sig=<signature>]
+//
+//	payload   = base64url(deflate(client TOML)), without padding
+//	signature = base64url(Ed25519 signature over the payload string), without padding
+const ShareLinkVersion = 1
+
+// maxShareLinkPayload bounds the decompressed profile size to keep
+// a hostile link from inflating into an arbitrarily large buffer.
+const maxShareLinkPayload = 64 * 1024
+
+// EncodeShareLink serializes a client profile into a phoenix:// URI.
+// Device-local fields (private_key, private_key_passphrase, dial_addr, known_hosts)
+// are not included.
+// If signer is non-nil, the link is signed with it; this must be the private
+// key of one of the server keys the profile pins (server_public_key or
+// server_public_keys), and an Ed25519 key, so receivers can verify it.
+func EncodeShareLink(cfg *ClientConfig, signer stdcrypto.PrivateKey) (string, error) {
+	profile := *cfg
+	profile.PrivateKeyPath = ""
+	profile.PrivateKeyPassphrase = ""
+	profile.DialAddr = ""
+	profile.KnownHostsPath = ""
+
+	data, err := toml.Marshal(profile)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode profile: %w", err)
+	}
+
+	var buf bytes.Buffer
+	zw, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(buf.Bytes())
+	link := fmt.Sprintf("%s://v%d/%s", ShareLinkScheme, ShareLinkVersion, payload)
+
+	if signer != nil {
+		sig, err := crypto.Sign(signer, []byte(payload))
+		if err != nil {
+			return "", err
+		}
+		link += "?sig=" + base64.RawURLEncoding.EncodeToString(sig)
+	}
+
+	return link, nil
+}
+
+// DecodeShareLink parses a phoenix:// URI back into a client profile.
+// The returned bool reports whether the link is signed by one of the server
+// keys the profile pins and that key matches one of trusted (Base64 Ed25519
+// keys or "sha256/..." pins the caller already trusts, e.g. from a config
+// obtained out of band). A key inside the link proves nothing by itself,
+// since whoever forges a link can also swap in their own key. A signature
+// that does not verify with any trusted key is an error when trusted is
+// non-empty; without trusted keys, signed links are returned unverified.
+func DecodeShareLink(link string, trusted []string) (*ClientConfig, bool, error) {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid share link: %w", err)
+	}
+	if u.Scheme != ShareLinkScheme {
+		return nil, false, fmt.Errorf("invalid share link: expected %s:// scheme, got %q", ShareLinkScheme, u.Scheme)
+	}
+	if u.Host != fmt.Sprintf("v%d", ShareLinkVersion) {
+		return nil, false, fmt.Errorf("unsupported share link version %q", u.Host)
+	}
+
+	payload := strings.TrimPrefix(u.Path, "/")
+	compressed, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid share link payload: %w", err)
+	}
+
+	zr := flate.NewReader(bytes.NewReader(compressed))
+	defer zr.Close()
+	data, err := io.ReadAll(io.LimitReader(zr, maxShareLinkPayload+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid share link payload: %w", err)
+	}
+	if len(data) > maxShareLinkPayload {
+		return nil, false, fmt.Errorf("share link payload too large")
+	}
+
+	cfg, err := parseClientConfig(data, false)
+	if err != nil {
+		return nil, false, err
+	}
+	// A reference would be resolved against this device once the profile is saved.
+	if refs := findSecretRefs(cfg); len(refs) > 0 {
+		return nil, false, fmt.Errorf("share link must not contain secret references (%s)", strings.Join(refs, ", "))
+	}
+	// Never trust a path to a local file coming from someone else's device.
+	cfg.PrivateKeyPath = ""
+	cfg.PrivateKeyPassphrase = ""
+	cfg.DialAddr = ""
+	cfg.KnownHostsPath = ""
+
+	sigStr := u.Query().Get("sig")
+	if sigStr == "" || len(trusted) == 0 {
+		return cfg, false, nil
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(sigStr)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid share link signature: %w", err)
+	}
+	if !signedByTrustedKey(cfg, []byte(payload), sig, trusted) {
+		return nil, false, fmt.Errorf("share link signature: not signed by a trusted server key")
+	}
+
+	return cfg, true, nil
+}
+
+// signedByTrustedKey reports whether sig over payload verifies with one of
+// the Ed25519 server keys cfg pins that also matches a key in trusted.
+func signedByTrustedKey(cfg *ClientConfig, payload, sig []byte, trusted []string) bool {
+	keys := []string{cfg.ServerPublicKey}
+	for _, k := range cfg.ServerPublicKeys {
+		keys = append(keys, k.Key)
+	}
+	for _, k := range keys {
+		pub, err := crypto.ParsePublicKey(k)
+		if err != nil {
+			continue // a "sha256/" pin cannot verify a signature
+		}
+		if !slices.ContainsFunc(trusted, func(t string) bool { return crypto.MatchPin(t, pub) }) {
+			continue
+		}
+		if crypto.VerifySignature(k, payload, sig) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceLocalKeys are the client settings that never travel in a share link
+// and are kept from the existing profile on import.
+var deviceLocalKeys = []string{"private_key", "private_key_passphrase", "dial_addr", "known_hosts"}
+
+// ImportShareLink decodes link and saves the profile to filePath. If a
+// profile already exists there, its device-local settings are kept, and
+// when it pins server keys the link must be signed by one of them, so that
+// a forged link cannot redirect a configured client. The link must also be
+// signed by one of trusted when that is non-empty. It reports whether the
+// signature was verified.
+func ImportShareLink(filePath, link string, trusted []string) (bool, error) {
+	// The existing profile is read as written, not loaded: it need not be
+	// valid on this device (a key file may have moved), and loading would
+	// resolve secret references that must stay references.
+	var local *toml.Tree
+	if data, err := ioutil.ReadFile(filePath); err == nil {
+		if local, err = toml.LoadBytes(data); err != nil {
+			return false, fmt.Errorf("failed to parse %s: %w", filePath, err)
+		}
+		if k, ok := local.Get("server_public_key").(string); ok && k != "" {
+			trusted = append(trusted, k)
+		}
+		if keys, ok := local.Get("server_public_keys").([]*toml.Tree); ok {
+			for _, sk := range keys {
+				if k, ok := sk.Get("key").(string); ok && k != "" {
+					trusted = append(trusted, k)
+				}
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return false, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	cfg, verified, err := DecodeShareLink(link, trusted)
+	if err != nil {
+		return false, err
+	}
+	if len(trusted) > 0 && !verified {
+		return false, errors.New("share link is not signed by a trusted server key")
+	}
+
+	data, err := toml.Marshal(*cfg)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode profile: %w", err)
+	}
+	if local != nil {
+		tree, err := toml.LoadBytes(data)
+		if err != nil {
+			return false, err
+		}
+		for _, k := range deviceLocalKeys {
+			if v := local.Get(k); v != nil {
+				tree.Set(k, v)
+			}
+		}
+		out, err := tree.ToTomlString()
+		if err != nil {
+			return false, err
+		}
+		data = []byte(out)
+	}
+
+	// Write to a temp file and rename so a crash never leaves a truncated config.
+	tmp, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+".tmp*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	return verified, os.Rename(tmp.Name(), filePath)
+}
@@ -0,0 +1,139 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"phoenix/pkg/crypto"
+	"phoenix/pkg/protocol"
+	"strings"
+	"testing"
+)
+
+func TestShareLinkRoundTrip(t *testing.T) {
+	cfg := &ClientConfig{
+		RemoteAddr:     "example.com:443",
+		DialAddr:       "203.0.113.1:443",
+		AuthToken:      "secret-token",
+		PrivateKeyPath: "/data/client.private.key",
+		TLSMode:        "system",
+		Fingerprint:    "chrome",
+		Inbounds: []ClientInbound{
+			{Protocol: protocol.ProtocolSOCKS5, LocalAddr: "127.0.0.1:1080", EnableUDP: true},
+		},
+	}
+
+	link, err := EncodeShareLink(cfg, nil)
+	if err != nil {
+		t.Fatalf("EncodeShareLink failed: %v", err)
+	}
+	if !strings.HasPrefix(link, "phoenix://v1/") {
+		t.Fatalf("Unexpected link prefix: %s", link)
+	}
+
+	got, signed, err := DecodeShareLink(link, nil)
+	if err != nil {
+		t.Fatalf("DecodeShareLink failed: %v", err)
+	}
+	if signed {
+		t.Errorf("Expected unsigned link")
+	}
+	if got.RemoteAddr != cfg.RemoteAddr || got.AuthToken != cfg.AuthToken || got.TLSMode != cfg.TLSMode || got.Fingerprint != cfg.Fingerprint {
+		t.Errorf("Profile mismatch after round trip: %+v", got)
+	}
+	if got.PrivateKeyPath != "" || got.DialAddr != "" {
+		t.Errorf("Device-local fields leaked into link: %+v", got)
+	}
+	if len(got.Inbounds) != 1 || !got.Inbounds[0].EnableUDP {
+		t.Errorf("Inbounds mismatch after round trip: %+v", got.Inbounds)
+	}
+}
+
+func TestShareLinkSignature(t *testing.T) {
+	privPEM, pub, err := crypto.GenerateKeypair()
+	if err != nil {
+		t.Fatalf("GenerateKeypair failed: %v", err)
+	}
+	priv, err := crypto.ParsePrivateKeyPEM(privPEM)
+	if err != nil {
+		t.Fatalf("ParsePrivateKeyPEM failed: %v", err)
+	}
+
+	cfg := DefaultClientConfig()
+	cfg.ServerPublicKey = pub
+
+	link, err := EncodeShareLink(cfg, priv)
+	if err != nil {
+		t.Fatalf("EncodeShareLink failed: %v", err)
+	}
+	if _, signed, err := DecodeShareLink(link, []string{pub}); err != nil || !signed {
+		t.Fatalf("Expected verified signature, got signed=%v err=%v", signed, err)
+	}
+	if _, signed, err := DecodeShareLink(link, nil); err != nil || signed {
+		t.Errorf("Expected an unverified link without trusted keys, got signed=%v err=%v", signed, err)
+	}
+
+	// A forger swaps in their own key and re-signs: the link must not verify
+	// against the key the receiver trusts.
+	otherPEM, otherPub, _ := crypto.GenerateKeypair()
+	other, _ := crypto.ParsePrivateKeyPEM(otherPEM)
+	cfg.ServerPublicKey = otherPub
+	forged, _ := EncodeShareLink(cfg, other)
+	if _, _, err := DecodeShareLink(forged, []string{pub}); err == nil {
+		t.Errorf("Expected signature verification failure for forged link")
+	}
+
+	// A signature from a rotation key in server_public_keys is accepted.
+	cfg.ServerPublicKey = ""
+	cfg.ServerPublicKeys = []ServerKey{{Key: otherPub}, {Key: pub}}
+	rotated, _ := EncodeShareLink(cfg, priv)
+	if _, signed, err := DecodeShareLink(rotated, []string{pub}); err != nil || !signed {
+		t.Errorf("Expected a signature from server_public_keys to verify, got signed=%v err=%v", signed, err)
+	}
+}
+
+func TestImportShareLink(t *testing.T) {
+	privPEM, pub, _ := crypto.GenerateKeypair()
+	priv, _ := crypto.ParsePrivateKeyPEM(privPEM)
+	otherPEM, otherPub, _ := crypto.GenerateKeypair()
+	other, _ := crypto.ParsePrivateKeyPEM(otherPEM)
+
+	cfg := DefaultClientConfig()
+	cfg.RemoteAddr = "example.com:443"
+	cfg.ServerPublicKey = pub
+	signed, _ := EncodeShareLink(cfg, priv)
+	unsigned, _ := EncodeShareLink(cfg, nil)
+	cfg.ServerPublicKey = otherPub
+	forged, _ := EncodeShareLink(cfg, other)
+
+	path := filepath.Join(t.TempDir(), "client.toml")
+	if verified, err := ImportShareLink(path, signed, []string{pub}); err != nil || !verified {
+		t.Fatalf("Import into a new profile: verified=%v err=%v", verified, err)
+	}
+	data, _ := os.ReadFile(path)
+	keyPath := filepath.Join(t.TempDir(), "client.pem")
+	os.WriteFile(keyPath, otherPEM, 0600)
+	local := strings.Replace(string(data), `private_key = ""`, fmt.Sprintf("private_key = %q\ndial_addr = \"203.0.113.1:443\"", keyPath), 1)
+	os.WriteFile(path, []byte(local), 0600)
+
+	// The existing profile's pin decides which links may replace it.
+	for name, link := range map[string]string{"unsigned": unsigned, "forged": forged} {
+		if _, err := ImportShareLink(path, link, nil); err == nil {
+			t.Errorf("Expected %s link to be refused over a pinned profile", name)
+		}
+	}
+	if verified, err := ImportShareLink(path, signed, nil); err != nil || !verified {
+		t.Fatalf("Re-import: verified=%v err=%v", verified, err)
+	}
+	data, _ = os.ReadFile(path)
+	got, err := LoadClientConfig(path)
+	if err != nil {
+		t.Fatalf("Imported profile does not load: %v", err)
+	}
+	if got.PrivateKeyPath != keyPath || got.DialAddr != "203.0.113.1:443" {
+		t.Errorf("Device-local settings not kept: %+v", got)
+	}
+	if got.RemoteAddr != "example.com:443" || got.ServerPublicKey != pub {
+		t.Errorf("Imported profile mismatch: %+v", got)
+	}
+}
@@ -0,0 +1,243 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"phoenix/pkg/crypto"
+	"phoenix/pkg/protocol"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// UserAccount is one entry of the users file.
+//
+//	[[user]]
+//	name = "alice"
+//	enabled = true                          # optional, defaults to true
+//	tokens = ["..."]                        # auth tokens (static or HMAC)
+//	client_keys = ["sha256/..."]            # mTLS keys, also listed in authorized_clients
+//	protocols = ["socks5", "socks5-udp"]    # optional, defaults to all enabled
+//	targets = ["*.example.com:443", "10.0.0.0/8", "*:80"]  # optional, defaults to any
+//	quota_class = "basic"                   # optional, see ServerQuotas
+//	bandwidth = { download = "2MB" }        # optional, see ServerBandwidth
+type UserAccount struct {
+	// Name identifies the user in logs. Access tokens whose subject matches
+	// the name are subject to this account as well.
+	Name string `toml:"name"`
+
+	// Enabled allows the account to open streams.
+	Enabled bool `toml:"enabled" default:"true"`
+
+	// Tokens are auth tokens belonging to this user, used like auth_token.
+	Tokens []string `toml:"tokens,omitempty"`
+
+	// ClientKeys are client key pins belonging to this user. The keys must
+	// also be authorized (authorized_clients or authorized_clients_file).
+	ClientKeys []string `toml:"client_keys,omitempty"`
+
+	// Protocols restricts which protocols the user may use (optional).
+	// Protocols disabled server-wide stay disabled.
+	Protocols []protocol.ProtocolType `toml:"protocols,omitempty"`
+
+	// Targets restricts the destinations the user may reach (optional).
+	// Each pattern is "host", "host:port" or "host:low-high", where host is
+	// a name, "*.domain", "*", an IP address or a CIDR range. Names only match
+	// names and addresses only match addresses; targets are not resolved.
+	Targets []string `toml:"targets,omitempty"`
+
+	// QuotaClass names the quotas class the user's traffic counts against
+	// (optional; see ServerQuotas).
+	QuotaClass string `toml:"quota_class,omitempty"`
+
+	// Bandwidth overrides bandwidth.per_user for this user (optional).
+	Bandwidth BandwidthLimit `toml:"bandwidth"`
+}
+
+// UserDatabase is the structure of the users file.
+type UserDatabase struct {
+	Users []UserAccount `toml:"user"`
+}
+
+// AllowsProtocol reports whether the user may use protocol p.
+func (u *UserAccount) AllowsProtocol(p protocol.ProtocolType) bool {
+	return len(u.Protocols) == 0 || slices.Contains(u.Protocols, p)
+}
+
+// AllowsTarget reports whether the user may connect to target ("host:port").
+func (u *UserAccount) AllowsTarget(target string) bool {
+	if len(u.Targets) == 0 {
+		return true
+	}
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+	for _, t := range u.Targets {
+		p, err := parseTargetPattern(t)
+		if err == nil && p.matches(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// targetPattern is a parsed entry of UserAccount.Targets.
+type targetPattern struct {
+	host    string // lower-case name, "*" or "*.domain"; empty if network is set
+	network *net.IPNet
+	low     int
+	high    int
+}
+
+func parseTargetPattern(s string) (*targetPattern, error) {
+	p := &targetPattern{high: 65535}
+	host := s
+	// A bare IPv6 address or range has several colons and no port;
+	// with a port it must be bracketed.
+	if strings.HasPrefix(s, "[") || strings.Count(s, ":") == 1 {
+		h, ports, err := net.SplitHostPort(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target pattern %q: %v", s, err)
+		}
+		host = h
+		if ports != "*" {
+			lo, hi, found := strings.Cut(ports, "-")
+			if !found {
+				hi = lo
+			}
+			if p.low, err = strconv.Atoi(lo); err != nil || p.low < 0 || p.low > 65535 {
+				return nil, fmt.Errorf("invalid port in target pattern %q", s)
+			}
+			if p.high, err = strconv.Atoi(hi); err != nil || p.high < p.low || p.high > 65535 {
+				return nil, fmt.Errorf("invalid port range in target pattern %q", s)
+			}
+		}
+	}
+
+	switch {
+	case host == "":
+		return nil, fmt.Errorf("invalid target pattern %q: empty host", s)
+	case strings.Contains(host, "/"):
+		_, network, err := net.ParseCIDR(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR in target pattern %q", s)
+		}
+		p.network = network
+	case net.ParseIP(host) != nil:
+		ip := net.ParseIP(host)
+		bits := 8 * len(ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		p.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	default:
+		if host != "*" && strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			return nil, fmt.Errorf("invalid target pattern %q: \"*\" is only allowed as the whole host or a leading \"*.\"", s)
+		}
+		p.host = strings.ToLower(host)
+	}
+	return p, nil
+}
+
+func (p *targetPattern) matches(host string, port int) bool {
+	if port < p.low || port > p.high {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.host == "*" || (p.network != nil && p.network.Contains(ip))
+	}
+	if p.network != nil {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	switch {
+	case p.host == "*":
+		return true
+	case strings.HasPrefix(p.host, "*."):
+		return strings.HasSuffix(host, p.host[1:])
+	default:
+		return host == p.host
+	}
+}
+
+// Validate checks every account of the users file.
+func (d *UserDatabase) Validate() error {
+	var errs ValidationErrors
+	names := make(map[string]bool)
+	tokens := make(map[string]string)
+	keys := make(map[string]string)
+	for i, u := range d.Users {
+		prefix := fmt.Sprintf("user[%d].", i)
+		if u.Name == "" {
+			errs.add(prefix+"name", "required")
+		} else if names[u.Name] {
+			errs.add(prefix+"name", "duplicate user %q", u.Name)
+		}
+		names[u.Name] = true
+
+		for j, t := range u.Tokens {
+			key := fmt.Sprintf("%stokens[%d]", prefix, j)
+			switch {
+			case len(t) < minUserTokenLen:
+				errs.add(key, "too short (at least %d characters)", minUserTokenLen)
+			case crypto.IsAccessToken(t):
+				errs.add(key, "signed access tokens are verified with token_issuer_keys; match them to this user by name instead")
+			case tokens[t] != "":
+				errs.add(key, "already used by user %q", tokens[t])
+			}
+			tokens[t] = u.Name
+		}
+		for j, k := range u.ClientKeys {
+			key := fmt.Sprintf("%sclient_keys[%d]", prefix, j)
+			pin, err := crypto.NormalizePin(k)
+			if err != nil {
+				errs.add(key, "%v", err)
+			} else if keys[pin] != "" {
+				errs.add(key, "already used by user %q", keys[pin])
+			}
+			keys[pin] = u.Name
+		}
+		for j, p := range u.Protocols {
+			if !slices.Contains(tunnelProtocols, p) {
+				errs.add(fmt.Sprintf("%sprotocols[%d]", prefix, j), "unknown protocol %q (expected one of %s)", p, quoteProtocols(tunnelProtocols))
+			}
+		}
+		u.Bandwidth.validate(&errs, prefix+"bandwidth.")
+		for j, t := range u.Targets {
+			if _, err := parseTargetPattern(t); err != nil {
+				errs.add(fmt.Sprintf("%stargets[%d]", prefix, j), "%v", err)
+			}
+		}
+	}
+	return errs.orNil()
+}
+
+// minUserTokenLen is the shortest accepted user token.
+const minUserTokenLen = 16
+
+// LoadUsers reads and validates a users file.
+func LoadUsers(filePath string) (*UserDatabase, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read users file: %w", err)
+	}
+
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse users file: %w", err)
+	}
+
+	db := &UserDatabase{}
+	if err := decodeAndValidate(tree, db, false); err != nil {
+		return nil, fmt.Errorf("invalid users file %s: %w", filePath, err)
+	}
+	return db, nil
+}
@@ -0,0 +1,504 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"phoenix/pkg/crypto"
+	"phoenix/pkg/protocol"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+)
+
+// ValidationError describes a single problem found in a configuration.
+type ValidationError struct {
+	// Key is the TOML key the problem refers to (e.g. "inbounds[1].protocol").
+	Key string
+	// Line is the 1-based line of Key in the source file, or 0 if unknown.
+	Line int
+	// Msg explains what is wrong and, where possible, how to fix it.
+	Msg string
+}
+
+func (e ValidationError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s", e.Line, e.Key, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", e.Key, e.Msg)
+}
+
+// ValidationErrors is the list of every problem found in a configuration.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = "  " + err.Error()
+	}
+	return fmt.Sprintf("%d configuration error(s):\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+func (e *ValidationErrors) add(key, format string, args ...interface{}) {
+	*e = append(*e, ValidationError{Key: key, Msg: fmt.Sprintf(format, args...)})
+}
+
+// orNil returns nil for an empty list so callers can return it as an error.
+func (e ValidationErrors) orNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Valid values for enum-like client options.
+var (
+	validTLSModes     = []string{"", "system", "insecure", "tofu"}
+	validAuthModes    = []string{"", "static", "hmac"}
+	validFingerprints = []string{"", "chrome", "firefox", "safari", "random"}
+	validTransports   = []string{"", "websocket", "websocket-h2", "split"}
+	validInbounds     = []protocol.ProtocolType{protocol.ProtocolSOCKS5, protocol.ProtocolShadowsocks, protocol.ProtocolSSH}
+)
+
+// Validate checks the client configuration for invalid values and
+// contradictory settings. It returns ValidationErrors on failure.
+func (c *ClientConfig) Validate() error {
+	var errs ValidationErrors
+
+	if c.RemoteAddr == "" {
+		errs.add("remote_addr", "required (e.g. \"example.com:443\")")
+	} else {
+		checkHostPort(&errs, "remote_addr", c.RemoteAddr)
+	}
+	if c.DialAddr != "" {
+		checkHostPort(&errs, "dial_addr", c.DialAddr)
+	}
+
+	if !slices.Contains(validTLSModes, c.TLSMode) {
+		errs.add("tls_mode", "invalid value %q (expected one of %s)", c.TLSMode, quoteList(validTLSModes))
+	}
+	if !slices.Contains(validFingerprints, c.Fingerprint) {
+		errs.add("fingerprint", "invalid value %q (expected one of %s)", c.Fingerprint, quoteList(validFingerprints))
+	}
+	if !slices.Contains(validTransports, c.Transport) {
+		errs.add("transport", "invalid value %q (expected one of %s)", c.Transport, quoteList(validTransports))
+	}
+	if !slices.Contains(validAuthModes, c.AuthMode) {
+		errs.add("auth_mode", "invalid value %q (expected one of %s)", c.AuthMode, quoteList(validAuthModes))
+	} else if c.AuthMode == "hmac" && c.AuthToken == "" {
+		errs.add("auth_mode", "\"hmac\" requires auth_token")
+	} else if c.AuthMode == "hmac" && crypto.IsAccessToken(c.AuthToken) {
+		errs.add("auth_mode", "\"hmac\" needs the shared auth_token; signed access tokens are sent as-is (use auth_mode = \"static\")")
+	}
+
+	c.Camouflage.validate(&errs)
+	if c.Transport != "" && c.Camouflage.Carrier == "body" {
+		errs.add("camouflage.carrier", "\"body\" cannot be used with transport = %q (its stream requests have no body to carry it)", c.Transport)
+	}
+	if c.MetadataKey != "" {
+		if _, err := crypto.ParsePublicKey(c.MetadataKey); err != nil {
+			errs.add("metadata_key", "must be the server's Base64 Ed25519 public key: %v", err)
+		}
+	} else if c.MetadataPublicKey() == "" {
+		if c.Camouflage.Carrier == "body" {
+			errs.add("camouflage.carrier", "\"body\" requires metadata_key (or server_public_key as a Base64 key)")
+		}
+		if c.InnerEncryption {
+			errs.add("inner_encryption", "requires metadata_key (or server_public_key as a Base64 key)")
+		}
+	}
+
+	if c.ServerPublicKey != "" {
+		if _, err := crypto.NormalizePin(c.ServerPublicKey); err != nil {
+			errs.add("server_public_key", "%v", err)
+		}
+	}
+	for i, k := range c.ServerPublicKeys {
+		prefix := fmt.Sprintf("server_public_keys[%d].", i)
+		if _, err := crypto.NormalizePin(k.Key); err != nil {
+			errs.add(prefix+"key", "%v", err)
+		}
+		if !k.NotBefore.IsZero() && !k.NotAfter.IsZero() && !k.NotAfter.After(k.NotBefore) {
+			errs.add(prefix+"not_after", "must be later than not_before")
+		}
+	}
+	if c.PrivateKeyPath != "" {
+		checkFileExists(&errs, "private_key", c.PrivateKeyPath)
+	} else if c.PrivateKeyPassphrase != "" {
+		errs.add("private_key_passphrase", "set without private_key")
+	}
+
+	// tls_mode takes precedence over key pinning in the transport,
+	// so combining them silently drops the keys.
+	if c.TLSMode == "system" || c.TLSMode == "insecure" {
+		if c.PrivateKeyPath != "" {
+			errs.add("private_key", "cannot be combined with tls_mode = %q (the key would be ignored); remove one of them", c.TLSMode)
+		}
+		if c.ServerPublicKey != "" {
+			errs.add("server_public_key", "cannot be combined with tls_mode = %q (the pin would be ignored); remove one of them", c.TLSMode)
+		}
+		if len(c.ServerPublicKeys) > 0 {
+			errs.add("server_public_keys", "cannot be combined with tls_mode = %q (the pins would be ignored); remove one of them", c.TLSMode)
+		}
+	}
+
+	if c.TLSMode == "tofu" && c.HasServerKeys() {
+		errs.add("tls_mode", "\"tofu\" cannot be combined with server_public_key(s); with a known key, pin it instead")
+	}
+	if c.KnownHostsPath != "" && c.TLSMode != "tofu" {
+		errs.add("known_hosts", "only used with tls_mode = \"tofu\"")
+	}
+
+	for i, in := range c.Inbounds {
+		prefix := fmt.Sprintf("inbounds[%d].", i)
+		if !slices.Contains(validInbounds, in.Protocol) {
+			errs.add(prefix+"protocol", "unknown protocol %q (expected one of %s)", in.Protocol, quoteProtocols(validInbounds))
+		}
+		if in.LocalAddr == "" {
+			errs.add(prefix+"local_addr", "required (e.g. \"127.0.0.1:1080\")")
+		} else {
+			checkHostPort(&errs, prefix+"local_addr", in.LocalAddr)
+		}
+		if in.TargetAddr != "" {
+			checkHostPort(&errs, prefix+"target_addr", in.TargetAddr)
+		}
+		if in.Protocol == protocol.ProtocolShadowsocks {
+			if parts := strings.SplitN(in.Auth, ":", 2); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				errs.add(prefix+"auth", "shadowsocks requires auth = \"method:password\"")
+			}
+		}
+	}
+
+	return errs.orNil()
+}
+
+// Validate checks the server configuration for invalid values and
+// contradictory settings. It returns ValidationErrors on failure.
+func (c *ServerConfig) Validate() error {
+	var errs ValidationErrors
+
+	if c.ListenAddr == "" {
+		errs.add("listen_addr", "required (e.g. \":443\")")
+	} else {
+		checkHostPort(&errs, "listen_addr", c.ListenAddr)
+	}
+
+	sec := c.Security
+	if sec.AuthMode != "" && sec.AuthMode != "hmac" {
+		errs.add("security.auth_mode", "invalid value %q (expected \"\" or \"hmac\")", sec.AuthMode)
+	} else if sec.AuthMode == "hmac" && sec.AuthToken == "" {
+		errs.add("security.auth_mode", "\"hmac\" requires security.auth_token")
+	}
+	for i, k := range sec.TokenIssuerKeys {
+		if _, err := crypto.ParsePublicKey(k); err != nil {
+			errs.add(fmt.Sprintf("security.token_issuer_keys[%d]", i), "invalid Ed25519 public key: %v", err)
+		}
+	}
+	if sec.PrivateKeyPath != "" {
+		checkFileExists(&errs, "security.private_key", sec.PrivateKeyPath)
+	} else if sec.PrivateKeyPassphrase != "" {
+		errs.add("security.private_key_passphrase", "set without security.private_key")
+	}
+	for i, k := range sec.NextKeys {
+		prefix := fmt.Sprintf("security.next_keys[%d].", i)
+		if k.PrivateKeyPath == "" {
+			errs.add(prefix+"private_key", "required")
+		} else {
+			checkFileExists(&errs, prefix+"private_key", k.PrivateKeyPath)
+		}
+		if k.NotBefore.IsZero() {
+			errs.add(prefix+"not_before", "required (when the server switches to this key)")
+		}
+		for j, name := range k.ServerNames {
+			if name == "" || strings.ContainsAny(name, " /:") {
+				errs.add(fmt.Sprintf("%sserver_names[%d]", prefix, j), "%q is not a host name", name)
+			}
+		}
+		switch {
+		case k.AllFrom.IsZero():
+		case len(k.ServerNames) == 0:
+			errs.add(prefix+"all_from", "only applies with server_names")
+		case !k.AllFrom.After(k.NotBefore):
+			errs.add(prefix+"all_from", "must be later than not_before")
+		}
+	}
+	if len(sec.NextKeys) > 0 && (sec.PrivateKeyPath == "" || sec.CertFile != "" || len(c.ACME.Domains) > 0) {
+		errs.add("security.next_keys", "only applies to self-signed keys: requires security.private_key without cert_file or acme")
+	}
+
+	switch {
+	case sec.CertFile != "" && sec.KeyFile == "":
+		errs.add("security.cert_file", "requires security.key_file")
+	case sec.KeyFile != "" && sec.CertFile == "":
+		errs.add("security.key_file", "requires security.cert_file")
+	case sec.CertFile != "":
+		checkFileExists(&errs, "security.cert_file", sec.CertFile)
+		checkFileExists(&errs, "security.key_file", sec.KeyFile)
+	}
+	for i, k := range sec.AuthorizedClientKeys {
+		if _, err := crypto.NormalizePin(k); err != nil {
+			errs.add(fmt.Sprintf("security.authorized_clients[%d]", i), "%v", err)
+		}
+	}
+	if sec.UsersFile != "" {
+		users, err := LoadUsers(sec.UsersFile)
+		if err != nil {
+			errs.add("security.users_file", "%v", err)
+		} else {
+			for _, u := range users.Users {
+				if _, ok := c.Quotas.Classes[u.QuotaClass]; u.QuotaClass != "" && !ok {
+					errs.add("security.users_file", "user %q has unknown quota_class %q (not in [quotas.classes])", u.Name, u.QuotaClass)
+				}
+			}
+		}
+	}
+	if sec.AuthorizedClientsFile != "" {
+		if _, err := LoadAuthorizedClients(sec.AuthorizedClientsFile); err != nil {
+			errs.add("security.authorized_clients_file", "%v", err)
+		}
+	}
+	if sec.MutualTLS() && !c.TLSEnabled() {
+		errs.add("security.authorized_clients", "requires TLS (security.private_key, security.cert_file or acme.domains); client keys are only checked over TLS")
+	}
+
+	if len(c.ACME.Domains) > 0 {
+		if sec.CertFile != "" {
+			errs.add("acme.domains", "cannot be combined with security.cert_file; remove one of them")
+		}
+		for i, d := range c.ACME.Domains {
+			if d == "" || strings.ContainsAny(d, ":/ ") {
+				errs.add(fmt.Sprintf("acme.domains[%d]", i), "invalid domain %q (expected a bare hostname)", d)
+			}
+		}
+		if c.ACME.DirectoryURL != "" && !strings.HasPrefix(c.ACME.DirectoryURL, "https://") {
+			errs.add("acme.directory_url", "must be an https:// URL")
+		}
+		if c.ACME.CAFile != "" {
+			checkFileExists(&errs, "acme.ca_file", c.ACME.CAFile)
+		}
+		if c.ACME.HTTPAddr != "" {
+			checkHostPort(&errs, "acme.http_addr", c.ACME.HTTPAddr)
+		}
+	}
+
+	c.Bandwidth.validate(&errs)
+	c.Limits.validate(&errs)
+	c.Bans.validate(&errs)
+	c.ClientIP.validate(&errs)
+	c.Decoy.validate(&errs)
+	c.Camouflage.validate(&errs)
+	if c.Security.MetadataKeyPath == "" && c.Security.PrivateKeyPath == "" {
+		if c.Camouflage.Carrier == "body" {
+			errs.add("camouflage.carrier", "\"body\" requires security.metadata_key or security.private_key")
+		}
+		if c.Security.InnerEncryption {
+			errs.add("security.inner_encryption", "requires security.metadata_key or security.private_key")
+		}
+	}
+
+	for name, class := range c.Quotas.Classes {
+		prefix := fmt.Sprintf("quotas.classes.%s.", name)
+		if _, err := ParseByteSize(class.Limit); err != nil {
+			errs.add(prefix+"limit", "%v", err)
+		}
+		if !slices.Contains(validQuotaPeriods, class.Period) {
+			errs.add(prefix+"period", "invalid value %q (expected one of %s)", class.Period, quoteList(validQuotaPeriods))
+		}
+	}
+	if _, ok := c.Quotas.Classes[c.Quotas.DefaultClass]; c.Quotas.DefaultClass != "" && !ok {
+		errs.add("quotas.default_class", "unknown class %q (not in [quotas.classes])", c.Quotas.DefaultClass)
+	}
+
+	if c.Enrollment.Secret != "" {
+		if len(c.Enrollment.Secret) < minEnrollmentSecretLen {
+			errs.add("enrollment.secret", "too short (at least %d characters; generate one with -gen-token)", minEnrollmentSecretLen)
+		}
+		if sec.AuthorizedClientsFile == "" {
+			errs.add("enrollment.secret", "requires security.authorized_clients_file, where enrolled keys are recorded")
+		}
+		if !c.TLSEnabled() || sec.InnerEncryption {
+			errs.add("enrollment.secret", "requires TLS without inner_encryption; clients prove ownership of their key in the TLS handshake")
+		}
+		for i, p := range c.Enrollment.Protocols {
+			if !slices.Contains(tunnelProtocols, p) {
+				errs.add(fmt.Sprintf("enrollment.protocols[%d]", i), "unknown protocol %q (expected one of %s)", p, quoteProtocols(tunnelProtocols))
+			}
+		}
+	}
+
+	return errs.orNil()
+}
+
+// minEnrollmentSecretLen is the shortest accepted enrollment secret.
+const minEnrollmentSecretLen = 16
+
+// checkHostPort reports addr if it is not a valid "host:port".
+func checkHostPort(errs *ValidationErrors, key, addr string) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		errs.add(key, "invalid address %q: expected \"host:port\"", addr)
+		return
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		errs.add(key, "invalid port %q in address %q", port, addr)
+	}
+}
+
+// checkFileExists reports path if it cannot be accessed.
+func checkFileExists(errs *ValidationErrors, key, path string) {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			errs.add(key, "file not found: %s", path)
+		} else {
+			errs.add(key, "cannot access %s: %v", path, err)
+		}
+	}
+}
+
+// checkUnknownKeys reports every key in tree that has no matching `toml`
+// struct tag in t, recursing into tables and arrays of tables.
+func checkUnknownKeys(tree *toml.Tree, t reflect.Type, prefix string) ValidationErrors {
+	var errs ValidationErrors
+
+	known := make(map[string]reflect.Type)
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("toml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		known[name] = f.Type
+		names = append(names, name)
+	}
+
+	for _, k := range tree.Keys() {
+		key := prefix + k
+		ft, ok := known[k]
+		if !ok {
+			msg := "unknown key"
+			if s := closestKey(k, names); s != "" {
+				msg += fmt.Sprintf(" (did you mean %q?)", s)
+			}
+			errs = append(errs, ValidationError{Key: key, Line: tree.GetPositionPath([]string{k}).Line, Msg: msg})
+			continue
+		}
+
+		switch v := tree.GetPath([]string{k}).(type) {
+		case *toml.Tree:
+			switch {
+			case ft.Kind() == reflect.Struct:
+				errs = append(errs, checkUnknownKeys(v, ft, key+".")...)
+			case ft.Kind() == reflect.Map && ft.Elem().Kind() == reflect.Struct:
+				// Tables keyed by a user-chosen name, e.g. [quotas.classes.basic]
+				for _, name := range v.Keys() {
+					if sub, ok := v.GetPath([]string{name}).(*toml.Tree); ok {
+						errs = append(errs, checkUnknownKeys(sub, ft.Elem(), key+"."+name+".")...)
+					}
+				}
+			}
+		case []*toml.Tree:
+			if ft.Kind() == reflect.Slice && ft.Elem().Kind() == reflect.Struct {
+				for i, sub := range v {
+					errs = append(errs, checkUnknownKeys(sub, ft.Elem(), fmt.Sprintf("%s[%d].", key, i))...)
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+// keySegment matches one segment of a ValidationError key, e.g. "inbounds[1]".
+var keySegment = regexp.MustCompile(`^([^\[\]]+)(?:\[(\d+)\])?$`)
+
+// attachLines fills in the source line of every error whose key is present in tree.
+// Keys that are missing from the file (e.g. required values) fall back to the
+// line of the nearest enclosing table, if any.
+func attachLines(errs ValidationErrors, tree *toml.Tree) {
+	for i := range errs {
+		if errs[i].Line == 0 {
+			errs[i].Line = lineOf(tree, errs[i].Key)
+		}
+	}
+}
+
+func lineOf(tree *toml.Tree, key string) int {
+	line := 0
+	cur := tree
+	for _, seg := range strings.Split(key, ".") {
+		m := keySegment.FindStringSubmatch(seg)
+		if m == nil || cur == nil || !cur.HasPath([]string{m[1]}) {
+			return line
+		}
+		line = cur.GetPositionPath([]string{m[1]}).Line
+
+		switch v := cur.GetPath([]string{m[1]}).(type) {
+		case *toml.Tree:
+			cur = v
+		case []*toml.Tree:
+			cur = nil
+			if m[2] != "" {
+				if idx, _ := strconv.Atoi(m[2]); idx < len(v) {
+					cur = v[idx]
+					line = v[idx].Position().Line
+				}
+			}
+		default:
+			cur = nil
+		}
+	}
+	return line
+}
+
+// closestKey returns the candidate within edit distance 2 of key, if any.
+func closestKey(key string, candidates []string) string {
+	best, bestDist := "", 3
+	for _, c := range candidates {
+		if d := editDistance(key, c); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+// editDistance computes the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func quoteList(list []string) string {
+	quoted := make([]string, len(list))
+	for i, v := range list {
+		quoted[i] = strconv.Quote(v)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func quoteProtocols(list []protocol.ProtocolType) string {
+	strs := make([]string, len(list))
+	for i, v := range list {
+		strs[i] = string(v)
+	}
+	return quoteList(strs)
+}
@@ -0,0 +1,270 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncryptedPrivateKey(t *testing.T) {
+	privPEM, pub, err := GenerateKeypair()
+	if err != nil {
+		t.Fatalf("GenerateKeypair failed: %v", err)
+	}
+	encPEM, err := EncryptPrivateKeyPEM(privPEM, []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("EncryptPrivateKeyPEM failed: %v", err)
+	}
+	if !IsEncryptedPrivateKey(encPEM) {
+		t.Fatalf("Expected encrypted PEM block")
+	}
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, encPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadPrivateKey(path); err == nil {
+		t.Errorf("Expected LoadPrivateKey to refuse an encrypted key")
+	}
+	if _, err := LoadPrivateKeyWithPassphrase(path, PassphraseSource("wrong", path)); err == nil {
+		t.Errorf("Expected wrong passphrase to fail")
+	}
+
+	priv, err := LoadPrivateKeyWithPassphrase(path, PassphraseSource("correct horse", path))
+	if err != nil {
+		t.Fatalf("LoadPrivateKeyWithPassphrase failed: %v", err)
+	}
+	want, _ := ParsePublicKey(pub)
+	if !priv.(ed25519.PrivateKey).Public().(ed25519.PublicKey).Equal(want) {
+		t.Errorf("Decrypted key does not match the original")
+	}
+
+	// A crafted file must not be able to demand unbounded scrypt work.
+	for _, h := range []map[string]string{{"R": "1048576"}, {"P": "1000000"}, {"R": "32", "P": "16"}} {
+		block, _ := pem.Decode(encPEM)
+		for k, v := range h {
+			block.Headers[k] = v
+		}
+		if _, err := ParseEncryptedPrivateKeyPEM(pem.EncodeToMemory(block), []byte("correct horse")); err == nil || !strings.Contains(err.Error(), "exceed") {
+			t.Errorf("Expected scrypt parameters %v to be refused, got %v", h, err)
+		}
+	}
+}
+
+func TestPinMatching(t *testing.T) {
+	edPEM, edRaw, _ := GenerateKeypair()
+	edPriv, _ := ParsePrivateKeyPEM(edPEM)
+	edPub := edPriv.(ed25519.PrivateKey).Public()
+
+	ecPEM, err := GenerateECDSAKey()
+	if err != nil {
+		t.Fatalf("GenerateECDSAKey failed: %v", err)
+	}
+	ecPriv, _ := ParsePrivateKeyPEM(ecPEM)
+	ecPin, err := PublicKeyPin(ecPriv)
+	if err != nil {
+		t.Fatalf("PublicKeyPin failed: %v", err)
+	}
+	ecPub := ecPriv.(*ecdsa.PrivateKey).Public()
+
+	edSPKI, _ := SPKIPin(edPub)
+	cases := []struct {
+		name string
+		pin  string
+		pub  interface{}
+		want bool
+	}{
+		{"legacy ed25519", edRaw, edPub, true},
+		{"spki ed25519", edSPKI, edPub, true},
+		{"spki ecdsa", ecPin, ecPub, true},
+		{"ecdsa pin vs ed25519 key", ecPin, edPub, false},
+		{"garbage", "not-a-pin", edPub, false},
+	}
+	for _, c := range cases {
+		if got := MatchPin(c.pin, c.pub); got != c.want {
+			t.Errorf("%s: MatchPin = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestKnownHosts(t *testing.T) {
+	pubOf := func() crypto.PublicKey {
+		pub, _, _ := ed25519.GenerateKey(nil)
+		return pub
+	}
+	oldKey, newKey := pubOf(), pubOf()
+	path := filepath.Join(t.TempDir(), "sub", "known_hosts")
+	k := NewKnownHosts(path)
+
+	if first, err := k.Verify("example.com:443", oldKey); err != nil || !first {
+		t.Fatalf("First Verify = %v, %v; want the key pinned", first, err)
+	}
+	if first, err := k.Verify("example.com:443", oldKey); err != nil || first {
+		t.Errorf("Second Verify = %v, %v; want the pin to match", first, err)
+	}
+	if _, err := k.Verify("other.example:443", newKey); err != nil {
+		t.Fatalf("Verify of a second host failed: %v", err)
+	}
+
+	// The pin survives a new store on the same file.
+	_, err := NewKnownHosts(path).Verify("example.com:443", newKey)
+	var changed *HostKeyChangedError
+	if !errors.As(err, &changed) || changed.Host != "example.com:443" {
+		t.Fatalf("Expected HostKeyChangedError for a changed key, got %v", err)
+	}
+
+	if removed, err := k.Remove("example.com:443"); err != nil || !removed {
+		t.Fatalf("Remove = %v, %v", removed, err)
+	}
+	if removed, _ := k.Remove("example.com:443"); removed {
+		t.Error("Remove reported an entry that was already gone")
+	}
+	if first, err := k.Verify("example.com:443", newKey); err != nil || !first {
+		t.Errorf("Verify after Remove = %v, %v; want the new key pinned", first, err)
+	}
+	if first, err := k.Verify("other.example:443", newKey); err != nil || first {
+		t.Errorf("Remove affected another host: %v, %v", first, err)
+	}
+}
+
+func TestEnrollmentCode(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Now()
+	code, err := MintEnrollmentCode(secret, now.Add(10*time.Minute))
+	if err != nil {
+		t.Fatalf("MintEnrollmentCode failed: %v", err)
+	}
+
+	id, _, err := ParseEnrollmentCode(secret, strings.ToLower(code), now)
+	if err != nil {
+		t.Fatalf("ParseEnrollmentCode rejected a fresh code: %v", err)
+	}
+	if id2, _, _ := ParseEnrollmentCode(secret, code, now); id2 != id {
+		t.Errorf("Code ID is not stable: %s vs %s", id, id2)
+	}
+
+	if _, _, err := ParseEnrollmentCode(secret, code, now.Add(time.Hour)); err == nil {
+		t.Error("Expected expired code to be rejected")
+	}
+	if _, _, err := ParseEnrollmentCode([]byte("another secret"), code, now); err == nil {
+		t.Error("Expected code minted with another secret to be rejected")
+	}
+}
+
+func TestAccessToken(t *testing.T) {
+	privPEM, pub, _ := GenerateKeypair()
+	priv, _ := ParsePrivateKeyPEM(privPEM)
+	_, otherPub, _ := GenerateKeypair()
+	now := time.Now()
+
+	token, err := SignAccessToken(priv, AccessClaims{
+		Subject:   "alice",
+		Expires:   now.Add(time.Hour).Unix(),
+		Protocols: []string{"socks5"},
+	})
+	if err != nil {
+		t.Fatalf("SignAccessToken failed: %v", err)
+	}
+
+	claims, err := VerifyAccessToken(token, []string{otherPub, pub}, now)
+	if err != nil {
+		t.Fatalf("VerifyAccessToken failed: %v", err)
+	}
+	if claims.Subject != "alice" || !claims.AllowsProtocol("socks5") || claims.AllowsProtocol("ssh") {
+		t.Errorf("Unexpected claims: %+v", claims)
+	}
+
+	if _, err := VerifyAccessToken(token, []string{otherPub}, now); err == nil {
+		t.Error("Expected token from an untrusted issuer to be rejected")
+	}
+	if _, err := VerifyAccessToken(token, []string{pub}, now.Add(2*time.Hour)); err == nil {
+		t.Error("Expected expired token to be rejected")
+	}
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(AccessClaims{Subject: "mallory", Expires: now.Add(time.Hour).Unix()})
+	parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+	if _, err := VerifyAccessToken(strings.Join(parts, "."), []string{pub}, now); err == nil {
+		t.Error("Expected token with modified claims to be rejected")
+	}
+}
+
+func TestMetadataPreamble(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	_, other, _ := ed25519.GenerateKey(nil)
+
+	msg := []byte("protocol=socks5&target=example.org%3A443")
+	sealed, err := SealMetadata(pub, msg)
+	if err != nil {
+		t.Fatalf("SealMetadata failed: %v", err)
+	}
+
+	r := bytes.NewReader(append(sealed, "payload"...))
+	got, err := OpenMetadata([]crypto.PrivateKey{other, priv}, r)
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("OpenMetadata returned %q, %v", got, err)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+		t.Errorf("OpenMetadata read past the preamble: %q left", rest)
+	}
+
+	if _, err := OpenMetadata([]crypto.PrivateKey{other}, bytes.NewReader(sealed)); err == nil {
+		t.Error("Expected preamble for another key to be rejected")
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := OpenMetadata([]crypto.PrivateKey{priv}, bytes.NewReader(sealed)); err == nil {
+		t.Error("Expected tampered preamble to be rejected")
+	}
+}
+
+func TestInnerHandshake(t *testing.T) {
+	serverPub, serverPriv, _ := ed25519.GenerateKey(nil)
+	clientPub, clientPriv, _ := ed25519.GenerateKey(nil)
+	_, otherPriv, _ := ed25519.GenerateKey(nil)
+
+	for _, key := range []crypto.PrivateKey{clientPriv, nil} {
+		client, msg1, err := NewInnerClient(serverPub, key)
+		if err != nil {
+			t.Fatalf("NewInnerClient failed: %v", err)
+		}
+		msg2, srv, gotKey, err := AcceptInner([]crypto.PrivateKey{otherPriv, serverPriv}, msg1)
+		if err != nil {
+			t.Fatalf("AcceptInner failed: %v", err)
+		}
+		if key != nil && !clientPub.Equal(gotKey) || key == nil && gotKey != nil {
+			t.Errorf("Server saw client key %x", gotKey)
+		}
+		cli, err := client.Finish(msg2)
+		if err != nil {
+			t.Fatalf("Finish failed: %v", err)
+		}
+
+		ct, _ := cli.Send.Encrypt(nil, nil, []byte("ping"))
+		if pt, err := srv.Recv.Decrypt(nil, nil, ct); err != nil || string(pt) != "ping" {
+			t.Errorf("Client to server: %q, %v", pt, err)
+		}
+		ct, _ = srv.Send.Encrypt(nil, nil, []byte("pong"))
+		if pt, err := cli.Recv.Decrypt(nil, nil, ct); err != nil || string(pt) != "pong" {
+			t.Errorf("Server to client: %q, %v", pt, err)
+		}
+		if !bytes.Equal(cli.ExportKey("x"), srv.ExportKey("x")) || bytes.Equal(cli.ExportKey("x"), cli.ExportKey("y")) {
+			t.Error("Exported keys do not match between the ends or ignore the label")
+		}
+	}
+
+	_, msg1, _ := NewInnerClient(serverPub, nil)
+	if _, _, _, err := AcceptInner([]crypto.PrivateKey{otherPriv}, msg1); err == nil {
+		t.Error("Expected handshake for another server key to fail")
+	}
+}
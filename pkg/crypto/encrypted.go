@@ -0,0 +1,183 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// encryptedKeyPEMType is the PEM block type of passphrase-protected private keys.
+// The block body is the XChaCha20-Poly1305 ciphertext of the PKCS#8 DER key;
+// the KDF parameters, salt and nonce are stored in the PEM headers.
+const encryptedKeyPEMType = "PHOENIX ENCRYPTED PRIVATE KEY"
+
+// scrypt parameters for newly encrypted keys (N=2^15 takes ~100ms and 32 MiB).
+const (
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptSaltLen = 16
+
+	// Bounds on the cost accepted when decrypting, so a crafted key file
+	// cannot make the loader allocate unbounded memory (128*r*N bytes) or
+	// burn unbounded CPU (proportional to N*r*p).
+	maxScryptN      = 1 << 20
+	maxScryptR      = 32
+	maxScryptP      = 16
+	maxScryptRP     = 64
+	maxScryptMemory = 1 << 30
+)
+
+// encryptedKeyAAD binds the ciphertext to this file format.
+var encryptedKeyAAD = []byte(encryptedKeyPEMType)
+
+// EncryptPrivateKeyPEM re-encodes an unencrypted PKCS#8 PEM private key as a
+// passphrase-protected PEM block using scrypt and XChaCha20-Poly1305.
+func EncryptPrivateKeyPEM(privPEM []byte, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("passphrase must not be empty")
+	}
+
+	block, _ := pem.Decode(privPEM)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("failed to decode PEM block containing private key")
+	}
+
+	salt := make([]byte, scryptSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	aead, err := deriveKeyCipher(passphrase, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type: encryptedKeyPEMType,
+		Headers: map[string]string{
+			"KDF":    "scrypt",
+			"N":      strconv.Itoa(scryptN),
+			"R":      strconv.Itoa(scryptR),
+			"P":      strconv.Itoa(scryptP),
+			"Salt":   base64.StdEncoding.EncodeToString(salt),
+			"Cipher": "xchacha20-poly1305",
+			"Nonce":  base64.StdEncoding.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, block.Bytes, encryptedKeyAAD),
+	}), nil
+}
+
+// IsEncryptedPrivateKey reports whether data is a passphrase-protected key.
+func IsEncryptedPrivateKey(data []byte) bool {
+	block, _ := pem.Decode(data)
+	return block != nil && block.Type == encryptedKeyPEMType
+}
+
+// ParseEncryptedPrivateKeyPEM decrypts a passphrase-protected private key.
+func ParseEncryptedPrivateKeyPEM(data []byte, passphrase []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != encryptedKeyPEMType {
+		return nil, fmt.Errorf("failed to decode PEM block containing encrypted private key")
+	}
+	if block.Headers["KDF"] != "scrypt" || block.Headers["Cipher"] != "xchacha20-poly1305" {
+		return nil, fmt.Errorf("unsupported key encryption (KDF %q, cipher %q)", block.Headers["KDF"], block.Headers["Cipher"])
+	}
+
+	n, errN := strconv.Atoi(block.Headers["N"])
+	r, errR := strconv.Atoi(block.Headers["R"])
+	p, errP := strconv.Atoi(block.Headers["P"])
+	if errN != nil || errR != nil || errP != nil {
+		return nil, fmt.Errorf("invalid scrypt parameters in encrypted private key")
+	}
+	if n <= 1 || n > maxScryptN || r < 1 || r > maxScryptR || p < 1 || p > maxScryptP ||
+		r*p > maxScryptRP || 128*r*n > maxScryptMemory {
+		return nil, fmt.Errorf("scrypt parameters in encrypted private key exceed the accepted cost (N=%d, r=%d, p=%d)", n, r, p)
+	}
+	salt, err := base64.StdEncoding.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt in encrypted private key")
+	}
+	nonce, err := base64.StdEncoding.DecodeString(block.Headers["Nonce"])
+	if err != nil || len(nonce) != chacha20poly1305.NonceSizeX {
+		return nil, fmt.Errorf("invalid nonce in encrypted private key")
+	}
+
+	aead, err := deriveKeyCipher(passphrase, salt, n, r, p)
+	if err != nil {
+		return nil, err
+	}
+	der, err := aead.Open(nil, nonce, block.Bytes, encryptedKeyAAD)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key: wrong passphrase or corrupted file")
+	}
+
+	return ParsePrivateKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// LoadPrivateKeyWithPassphrase loads a private key from a PEM file that may be
+// passphrase-protected. passphrase is only called if the file is encrypted.
+func LoadPrivateKeyWithPassphrase(path string, passphrase func() ([]byte, error)) (crypto.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !IsEncryptedPrivateKey(data) {
+		return ParsePrivateKeyPEM(data)
+	}
+
+	pass, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+	return ParseEncryptedPrivateKeyPEM(data, pass)
+}
+
+// PassphraseSource returns a passphrase callback for LoadPrivateKeyWithPassphrase.
+// A configured passphrase is used as-is; otherwise the user is prompted on the
+// terminal, and loading fails when no terminal is attached.
+func PassphraseSource(configured string, path string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		if configured != "" {
+			return []byte(configured), nil
+		}
+		return ReadPassphrase(fmt.Sprintf("Passphrase for %s: ", path))
+	}
+}
+
+// ReadPassphrase prompts for a passphrase on the terminal without echoing it.
+func ReadPassphrase(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("cannot prompt for passphrase: stdin is not a terminal")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	pass, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %v", err)
+	}
+	return pass, nil
+}
+
+// deriveKeyCipher derives the key-wrapping AEAD from a passphrase.
+func deriveKeyCipher(passphrase, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, n, r, p, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("key derivation failed: %v", err)
+	}
+	return chacha20poly1305.NewX(key)
+}
@@ -0,0 +1,82 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Enrollment codes are minted offline from a shared secret, so the server
+// needs no list of outstanding codes:
+//
+//	code = base32(expiry[4] || nonce[4] || HMAC-SHA256(secret, "phoenix-enroll-v1" || expiry || nonce)[:8])
+//
+// The code is printed in dash-separated groups of four characters. Single use
+// is enforced by the server remembering redeemed codes until they expire.
+const (
+	enrollExpiryLen = 4
+	enrollNonceLen  = 4
+	enrollMACLen    = 8
+	enrollCodeLen   = enrollExpiryLen + enrollNonceLen + enrollMACLen
+)
+
+var (
+	enrollEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+	enrollMACLabel = []byte("phoenix-enroll-v1")
+)
+
+// MintEnrollmentCode returns a new enrollment code valid until expires.
+func MintEnrollmentCode(secret []byte, expires time.Time) (string, error) {
+	if len(secret) == 0 {
+		return "", fmt.Errorf("enrollment secret must not be empty")
+	}
+
+	raw := make([]byte, enrollCodeLen)
+	binary.BigEndian.PutUint32(raw, uint32(expires.Unix()))
+	if _, err := rand.Read(raw[enrollExpiryLen : enrollExpiryLen+enrollNonceLen]); err != nil {
+		return "", err
+	}
+	copy(raw[enrollExpiryLen+enrollNonceLen:], enrollmentMAC(secret, raw[:enrollExpiryLen+enrollNonceLen]))
+
+	enc := enrollEncoding.EncodeToString(raw)
+	var groups []string
+	for len(enc) > 4 {
+		groups = append(groups, enc[:4])
+		enc = enc[4:]
+	}
+	return strings.Join(append(groups, enc), "-"), nil
+}
+
+// ParseEnrollmentCode verifies an enrollment code and returns its unique ID
+// (for single-use tracking) and expiry. Dashes, spaces and case are ignored.
+func ParseEnrollmentCode(secret []byte, code string, now time.Time) (string, time.Time, error) {
+	clean := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	raw, err := enrollEncoding.DecodeString(clean)
+	if err != nil || len(raw) != enrollCodeLen {
+		return "", time.Time{}, fmt.Errorf("malformed enrollment code")
+	}
+
+	body := raw[:enrollExpiryLen+enrollNonceLen]
+	if !hmac.Equal(raw[len(body):], enrollmentMAC(secret, body)) {
+		return "", time.Time{}, fmt.Errorf("invalid enrollment code")
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint32(body)), 0)
+	if now.After(expires) {
+		return "", time.Time{}, fmt.Errorf("enrollment code expired at %s", expires.Format(time.RFC3339))
+	}
+
+	return hex.EncodeToString(body), expires, nil
+}
+
+func enrollmentMAC(secret, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(enrollMACLabel)
+	mac.Write(body)
+	return mac.Sum(nil)[:enrollMACLen]
+}
@@ -0,0 +1,148 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/flynn/noise"
+)
+
+// Inner channel: a Noise_IK_25519_ChaChaPoly_BLAKE2s session inside each
+// stream, so tunneled data stays confidential and both ends are
+// authenticated even when someone else terminates the outer TLS.
+//
+// Both static keys are the X25519 forms of Ed25519 keys (see metadata.go):
+// the client already knows the server's Ed25519 public key, and the server
+// learns the client's from the first handshake message. The payload of that
+// message is the client's Ed25519 public key, or empty for a client without
+// a key; the server checks that it matches the static key the client proved.
+const innerPrologue = "phoenix-inner-v1"
+
+var innerSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+
+// InnerMaxMessage is the largest Noise message, so the largest frame payload.
+const InnerMaxMessage = noise.MaxMsgLen
+
+// InnerCiphers encrypt one direction of an inner channel each.
+type InnerCiphers struct {
+	Send *noise.CipherState
+	Recv *noise.CipherState
+
+	upKey [32]byte // the client-to-server key, which ExportKey derives from
+}
+
+// ExportKey derives a secret for label from the channel keys, the same at
+// both ends, for authenticating data the client sends beside the channel.
+func (c *InnerCiphers) ExportKey(label string) []byte {
+	m := hmac.New(sha256.New, c.upKey[:])
+	m.Write([]byte(label))
+	return m.Sum(nil)
+}
+
+// InnerClient is the client side of an inner channel handshake.
+type InnerClient struct {
+	hs *noise.HandshakeState
+}
+
+// NewInnerClient starts a handshake with the server whose Ed25519 public key
+// is serverKey, and returns the first message to send. clientKey is the
+// client's Ed25519 private key, or nil to stay anonymous.
+func NewInnerClient(serverKey crypto.PublicKey, clientKey crypto.PrivateKey) (*InnerClient, []byte, error) {
+	edPub, ok := serverKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("inner encryption requires an Ed25519 server key")
+	}
+	serverPub, err := x25519PublicKey(edPub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var static *ecdh.PrivateKey
+	var payload []byte
+	if k, ok := clientKey.(ed25519.PrivateKey); ok {
+		if static, err = x25519PrivateKey(k); err != nil {
+			return nil, nil, err
+		}
+		payload = k.Public().(ed25519.PublicKey)
+	} else if static, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+		return nil, nil, err
+	}
+
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   innerSuite,
+		Pattern:       noise.HandshakeIK,
+		Initiator:     true,
+		Prologue:      []byte(innerPrologue),
+		StaticKeypair: noise.DHKey{Private: static.Bytes(), Public: static.PublicKey().Bytes()},
+		PeerStatic:    serverPub.Bytes(),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, _, _, err := hs.WriteMessage(nil, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &InnerClient{hs: hs}, msg, nil
+}
+
+// Finish completes the handshake with the server's reply.
+func (c *InnerClient) Finish(msg []byte) (*InnerCiphers, error) {
+	_, send, recv, err := c.hs.ReadMessage(nil, msg)
+	if err != nil {
+		return nil, fmt.Errorf("inner channel handshake failed: %v", err)
+	}
+	return &InnerCiphers{Send: send, Recv: recv, upKey: send.UnsafeKey()}, nil
+}
+
+// AcceptInner answers a client's first handshake message with the first of
+// keys (Ed25519 private keys) it was made for. It returns the reply to send,
+// the channel ciphers and the client's Ed25519 public key (nil if the client
+// is anonymous).
+func AcceptInner(keys []crypto.PrivateKey, msg []byte) ([]byte, *InnerCiphers, ed25519.PublicKey, error) {
+	for _, k := range keys {
+		static, err := x25519PrivateKey(k)
+		if err != nil {
+			continue
+		}
+		hs, err := noise.NewHandshakeState(noise.Config{
+			CipherSuite:   innerSuite,
+			Pattern:       noise.HandshakeIK,
+			Prologue:      []byte(innerPrologue),
+			StaticKeypair: noise.DHKey{Private: static.Bytes(), Public: static.PublicKey().Bytes()},
+		})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		payload, _, _, err := hs.ReadMessage(nil, msg)
+		if err != nil {
+			continue
+		}
+
+		var clientKey ed25519.PublicKey
+		if len(payload) > 0 {
+			if len(payload) != ed25519.PublicKeySize {
+				return nil, nil, nil, errors.New("malformed client key in inner handshake")
+			}
+			clientKey = ed25519.PublicKey(payload)
+			proved, err := x25519PublicKey(clientKey)
+			if err != nil || !bytes.Equal(proved.Bytes(), hs.PeerStatic()) {
+				return nil, nil, nil, errors.New("inner handshake client key does not match its static key")
+			}
+		}
+
+		reply, recv, send, err := hs.WriteMessage(nil, nil)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return reply, &InnerCiphers{Send: send, Recv: recv, upKey: recv.UnsafeKey()}, clientKey, nil
+	}
+	return nil, nil, nil, errors.New("inner handshake not made for this server")
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
@@ -74,11 +75,18 @@ func LoadPrivateKey(path string) (crypto.PrivateKey, error) {
 	if err != nil {
 		return nil, err
 	}
+	return ParsePrivateKeyPEM(data)
+}
 
+// ParsePrivateKeyPEM parses a PEM encoded PKCS#8 private key.
+func ParsePrivateKeyPEM(data []byte) (crypto.PrivateKey, error) {
 	block, _ := pem.Decode(data)
 	if block == nil {
 		return nil, fmt.Errorf("failed to decode PEM block containing private key")
 	}
+	if block.Type == encryptedKeyPEMType {
+		return nil, fmt.Errorf("private key is encrypted; a passphrase is required")
+	}
 
 	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
 	if err != nil {
@@ -89,7 +97,7 @@ func LoadPrivateKey(path string) (crypto.PrivateKey, error) {
 }
 
 // GenerateTLSCertificate creates a self-signed TLS certificate using the given private key.
-// Supports both Ed25519 and ECDSA P256 keys.
+// Supports Ed25519, ECDSA and RSA keys.
 func GenerateTLSCertificate(priv crypto.PrivateKey) (tls.Certificate, error) {
 	// Determine public key
 	var pub crypto.PublicKey
@@ -98,6 +106,8 @@ func GenerateTLSCertificate(priv crypto.PrivateKey) (tls.Certificate, error) {
 		pub = k.Public()
 	case *ecdsa.PrivateKey:
 		pub = k.Public()
+	case *rsa.PrivateKey:
+		pub = k.Public()
 	default:
 		return tls.Certificate{}, fmt.Errorf("unsupported key type")
 	}
@@ -146,3 +156,24 @@ func ParsePublicKey(pubKeyStr string) (crypto.PublicKey, error) {
 	}
 	return ed25519.PublicKey(pubBytes), nil
 }
+
+// Sign signs msg with an Ed25519 private key.
+func Sign(priv crypto.PrivateKey, msg []byte) ([]byte, error) {
+	k, ok := priv.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing requires an Ed25519 private key")
+	}
+	return ed25519.Sign(k, msg), nil
+}
+
+// VerifySignature checks an Ed25519 signature against a Base64 encoded public key.
+func VerifySignature(pubKeyStr string, msg, sig []byte) error {
+	pub, err := ParsePublicKey(pubKeyStr)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+	if !ed25519.Verify(pub.(ed25519.PublicKey), msg, sig) {
+		return fmt.Errorf("signature verification failed")
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package crypto
+
+import (
+	"bufio"
+	"crypto"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// KnownHosts is a trust-on-first-use store of server key pins.
+// The file holds one "host:port sha256/<base64>" entry per line;
+// blank lines and lines starting with '#' are ignored.
+type KnownHosts struct {
+	path string
+	mu   sync.Mutex
+}
+
+// HostKeyChangedError is returned when a server presents a key that differs
+// from the one recorded on first use.
+type HostKeyChangedError struct {
+	Host      string
+	Known     string
+	Presented string
+	Path      string
+}
+
+func (e *HostKeyChangedError) Error() string {
+	return fmt.Sprintf("SERVER KEY CHANGED for %s: known %s, presented %s. "+
+		"This may be a man-in-the-middle attack. If the server key was rotated on purpose, "+
+		"remove the entry from %s to trust the new key", e.Host, e.Known, e.Presented, e.Path)
+}
+
+// NewKnownHosts returns the store backed by the file at path.
+// The file is created on the first Verify of an unknown host.
+func NewKnownHosts(path string) *KnownHosts {
+	return &KnownHosts{path: path}
+}
+
+// Path returns the file backing the store.
+func (k *KnownHosts) Path() string {
+	return k.path
+}
+
+// Verify checks pub against the pin recorded for host. An unknown host is
+// trusted and recorded; firstUse reports whether that happened.
+func (k *KnownHosts) Verify(host string, pub crypto.PublicKey) (firstUse bool, err error) {
+	pin, err := SPKIPin(pub)
+	if err != nil {
+		return false, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	entries, err := k.load()
+	if err != nil {
+		return false, err
+	}
+	if known, ok := entries[host]; ok {
+		if known != pin {
+			return false, &HostKeyChangedError{Host: host, Known: known, Presented: pin, Path: k.path}
+		}
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return false, err
+	}
+	f, err := os.OpenFile(k.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return false, fmt.Errorf("failed to record host key: %v", err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s %s\n", host, pin); err != nil {
+		return false, fmt.Errorf("failed to record host key: %v", err)
+	}
+	return true, nil
+}
+
+// Remove deletes the entry for host so its next key is trusted again.
+// It reports whether an entry existed.
+func (k *KnownHosts) Remove(host string) (bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	var kept []string
+	removed := false
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == host {
+			removed = true
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if !removed {
+		return false, nil
+	}
+
+	out := strings.Join(kept, "\n")
+	if out != "" {
+		out += "\n"
+	}
+	return true, os.WriteFile(k.path, []byte(out), 0600)
+}
+
+// load reads all entries. A missing file is an empty store.
+func (k *KnownHosts) load() (map[string]string, error) {
+	entries := make(map[string]string)
+	f, err := os.Open(k.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"host:port pin\"", k.path, lineNo)
+		}
+		entries[fields[0]] = fields[1]
+	}
+	return entries, scanner.Err()
+}
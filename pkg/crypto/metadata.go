@@ -0,0 +1,168 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/edwards25519"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Encrypted stream metadata.
+//
+//	preamble = ephemeral X25519 public key (32)
+//	           || AEAD(length, nonce 0) (2 + 16)
+//	           || AEAD(metadata, nonce 1) (length + 16)
+//
+// The server's X25519 key is derived from its Ed25519 key, so clients only
+// need the Ed25519 public key they already pin. The AEAD key is
+// HKDF-SHA256(X25519(ephemeral, server), salt = ephemeral || server,
+// info = metadataKDFInfo). Every preamble uses a fresh ephemeral key, so
+// fixed nonces are safe. Nothing in a preamble is distinguishable from
+// random bytes except its length.
+const (
+	metadataKDFInfo = "phoenix-metadata-v1"
+	metadataLenSize = 2
+
+	// MaxMetadataSize bounds the plaintext of a preamble.
+	MaxMetadataSize = 4096
+)
+
+// SealMetadata encrypts plaintext so that only the holder of the Ed25519
+// private key for serverKey can read it.
+func SealMetadata(serverKey crypto.PublicKey, plaintext []byte) ([]byte, error) {
+	if len(plaintext) > MaxMetadataSize {
+		return nil, fmt.Errorf("metadata too large (%d bytes)", len(plaintext))
+	}
+	edPub, ok := serverKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("metadata encryption requires an Ed25519 server key")
+	}
+	serverPub, err := x25519PublicKey(edPub)
+	if err != nil {
+		return nil, err
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(serverPub)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := metadataCipher(shared, eph.PublicKey().Bytes(), serverPub.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	out := append([]byte{}, eph.PublicKey().Bytes()...)
+	var n [metadataLenSize]byte
+	binary.BigEndian.PutUint16(n[:], uint16(len(plaintext)))
+	out = aead.Seal(out, metadataNonce(0), n[:], nil)
+	return aead.Seal(out, metadataNonce(1), plaintext, nil), nil
+}
+
+// OpenMetadata reads and decrypts a preamble from r with the first of keys
+// (Ed25519 private keys) it was sealed to. It reads no further than the end
+// of the preamble.
+func OpenMetadata(keys []crypto.PrivateKey, r io.Reader) ([]byte, error) {
+	head := make([]byte, 32+metadataLenSize+chacha20poly1305.Overhead)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	ephPub, err := ecdh.X25519().NewPublicKey(head[:32])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range keys {
+		priv, err := x25519PrivateKey(k)
+		if err != nil {
+			continue
+		}
+		shared, err := priv.ECDH(ephPub)
+		if err != nil {
+			continue
+		}
+		aead, err := metadataCipher(shared, head[:32], priv.PublicKey().Bytes())
+		if err != nil {
+			return nil, err
+		}
+		n, err := aead.Open(nil, metadataNonce(0), head[32:], nil)
+		if err != nil {
+			continue
+		}
+		size := binary.BigEndian.Uint16(n)
+		if size > MaxMetadataSize {
+			return nil, fmt.Errorf("metadata too large (%d bytes)", size)
+		}
+		body := make([]byte, int(size)+chacha20poly1305.Overhead)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, err
+		}
+		return aead.Open(nil, metadataNonce(1), body, nil)
+	}
+	return nil, errors.New("metadata not sealed to this server")
+}
+
+// MetadataKeySupported reports whether priv can decrypt metadata.
+func MetadataKeySupported(priv crypto.PrivateKey) bool {
+	_, ok := priv.(ed25519.PrivateKey)
+	return ok
+}
+
+// MetadataPublicKey returns the Base64 public key clients seal metadata to
+// (their metadata_key) for a supported private key.
+func MetadataPublicKey(priv crypto.PrivateKey) (string, error) {
+	k, ok := priv.(ed25519.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("encrypted metadata requires an Ed25519 key")
+	}
+	return base64.StdEncoding.EncodeToString(k.Public().(ed25519.PublicKey)), nil
+}
+
+func metadataCipher(shared, ephPub, serverPub []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephPub...), serverPub...)
+	key, err := hkdf.Key(sha256.New, shared, salt, metadataKDFInfo, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+func metadataNonce(i byte) []byte {
+	n := make([]byte, chacha20poly1305.NonceSize)
+	n[len(n)-1] = i
+	return n
+}
+
+// x25519PublicKey converts an Ed25519 public key to its X25519 (Montgomery) form.
+func x25519PublicKey(pub ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	p, err := new(edwards25519.Point).SetBytes(pub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Ed25519 public key: %v", err)
+	}
+	return ecdh.X25519().NewPublicKey(p.BytesMontgomery())
+}
+
+// x25519PrivateKey converts an Ed25519 private key to the matching X25519
+// key: the clamped scalar is the first half of SHA-512(seed), as in Ed25519.
+func x25519PrivateKey(k crypto.PrivateKey) (*ecdh.PrivateKey, error) {
+	priv, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an Ed25519 key")
+	}
+	h := sha512.Sum512(priv.Seed())
+	return ecdh.X25519().NewPrivateKey(h[:32])
+}
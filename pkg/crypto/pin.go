@@ -0,0 +1,73 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// SPKIPinPrefix marks a SHA-256 hash of a DER SubjectPublicKeyInfo, the same
+// "sha256/<base64>" form used by HPKP and curl's --pinnedpubkey.
+const SPKIPinPrefix = "sha256/"
+
+// SPKIPin returns the "sha256/<base64>" pin of a public key of any type
+// supported by x509 (Ed25519, ECDSA, RSA).
+func SPKIPin(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("unsupported public key type %T: %v", pub, err)
+	}
+	sum := sha256.Sum256(der)
+	return SPKIPinPrefix + base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// NormalizePin converts a pin to its SPKI form. Accepted inputs are a
+// "sha256/<base64>" SPKI pin, or a raw Base64 Ed25519 public key as written
+// by -gen-keys and older configs.
+func NormalizePin(pin string) (string, error) {
+	if strings.HasPrefix(pin, SPKIPinPrefix) {
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, SPKIPinPrefix))
+		if err != nil || len(sum) != sha256.Size {
+			return "", fmt.Errorf("invalid SPKI pin: expected %s<base64 SHA-256>", SPKIPinPrefix)
+		}
+		return pin, nil
+	}
+
+	pub, err := ParsePublicKey(pin)
+	if err != nil {
+		return "", fmt.Errorf("expected a Base64 Ed25519 public key or a %s SPKI pin: %v", SPKIPinPrefix, err)
+	}
+	return SPKIPin(pub)
+}
+
+// MatchPin reports whether pub matches pin (in either accepted form).
+func MatchPin(pin string, pub crypto.PublicKey) bool {
+	want, err := NormalizePin(pin)
+	if err != nil {
+		return false
+	}
+	got, err := SPKIPin(pub)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(got)) == 1
+}
+
+// PublicKeyPin returns the pin that identifies priv's public key: the raw
+// Base64 key for Ed25519 (compatible with older builds), or the SPKI pin
+// for any other key type.
+func PublicKeyPin(priv crypto.PrivateKey) (string, error) {
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return "", fmt.Errorf("unsupported key type %T", priv)
+	}
+	if pub, ok := signer.Public().(ed25519.PublicKey); ok {
+		return base64.StdEncoding.EncodeToString(pub), nil
+	}
+	return SPKIPin(signer.Public())
+}
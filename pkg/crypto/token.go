@@ -0,0 +1,118 @@
+package crypto
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AccessTokenPrefix marks a signed access token.
+//
+// Format: pht1.<payload>.<signature>
+//
+//	payload   = base64url(JSON AccessClaims), without padding
+//	signature = base64url(Ed25519 signature over "pht1.<payload>"), without padding
+const AccessTokenPrefix = "pht1."
+
+// maxAccessTokenLen bounds the token size accepted from the network.
+const maxAccessTokenLen = 4096
+
+// AccessClaims are the claims carried by a signed access token.
+type AccessClaims struct {
+	// Subject identifies the user the token was issued to.
+	Subject string `json:"sub"`
+	// IssuedAt and Expires are Unix timestamps.
+	IssuedAt int64 `json:"iat"`
+	Expires  int64 `json:"exp"`
+	// Protocols limits the protocols the token may open streams for.
+	// Empty allows every protocol the server has enabled.
+	Protocols []string `json:"proto,omitempty"`
+	// QuotaClass names the quota the user is accounted against (optional).
+	QuotaClass string `json:"quota,omitempty"`
+}
+
+// AllowsProtocol reports whether the claims permit proto.
+func (c *AccessClaims) AllowsProtocol(proto string) bool {
+	if len(c.Protocols) == 0 {
+		return true
+	}
+	for _, p := range c.Protocols {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAccessToken reports whether s looks like a signed access token.
+func IsAccessToken(s string) bool {
+	return strings.HasPrefix(s, AccessTokenPrefix)
+}
+
+// SignAccessToken issues a token for claims, signed with an Ed25519 issuer key.
+func SignAccessToken(priv crypto.PrivateKey, claims AccessClaims) (string, error) {
+	if claims.Subject == "" {
+		return "", fmt.Errorf("access token subject must not be empty")
+	}
+	if claims.Expires == 0 {
+		return "", fmt.Errorf("access token must have an expiry")
+	}
+
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := AccessTokenPrefix + base64.RawURLEncoding.EncodeToString(data)
+	sig, err := Sign(priv, []byte(signed))
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// VerifyAccessToken checks token against the issuer public keys (Base64
+// Ed25519, as printed by -gen-keys) and returns its claims if it is valid at now.
+func VerifyAccessToken(token string, issuerKeys []string, now time.Time) (*AccessClaims, error) {
+	if len(token) > maxAccessTokenLen || !IsAccessToken(token) {
+		return nil, fmt.Errorf("malformed access token")
+	}
+	dot := strings.LastIndexByte(token, '.')
+	if dot < len(AccessTokenPrefix) {
+		return nil, fmt.Errorf("malformed access token")
+	}
+	signed, sigStr := token[:dot], token[dot+1:]
+
+	sig, err := base64.RawURLEncoding.DecodeString(sigStr)
+	if err != nil {
+		return nil, fmt.Errorf("malformed access token signature")
+	}
+	verified := false
+	for _, k := range issuerKeys {
+		if VerifySignature(k, []byte(signed), sig) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("access token signature is not from a trusted issuer")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(signed, AccessTokenPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("malformed access token payload")
+	}
+	var claims AccessClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, fmt.Errorf("malformed access token payload: %v", err)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("access token has no subject")
+	}
+	if exp := time.Unix(claims.Expires, 0); now.After(exp) {
+		return nil, fmt.Errorf("access token for %s expired at %s", claims.Subject, exp.Format(time.RFC3339))
+	}
+	return &claims, nil
+}
@@ -12,6 +12,9 @@ const (
 	ProtocolShadowsocks ProtocolType = "shadowsocks"
 	// ProtocolSSH represents SSH tunneling.
 	ProtocolSSH ProtocolType = "ssh"
+	// ProtocolEnroll registers the client's key with a one-time enrollment code.
+	// It is the only request accepted from a key that is not yet authorized.
+	ProtocolEnroll ProtocolType = "enroll"
 	// ProtocolHTTP represents HTTP proxying (for future use).
 	ProtocolHTTP ProtocolType = "http"
 )
@@ -0,0 +1,83 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"phoenix/pkg/config"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager creates the certificate manager that obtains and renews
+// certificates for the configured domains. TLS-ALPN-01 is answered on the
+// main TLS listener; HTTP-01 additionally needs http_addr (see serveACMEHTTP).
+func newACMEManager(cfg config.ServerACME) (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+
+	// A custom CA bundle lets the ACME API itself be served by a test CA
+	// such as Pebble, whose HTTPS certificate is not publicly trusted.
+	if cfg.CAFile != "" {
+		pemData, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read acme.ca_file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in acme.ca_file %s", cfg.CAFile)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+			Timeout:   30 * time.Second,
+		}
+	}
+
+	cacheDir := cfg.CacheDir
+	if cacheDir == "" {
+		cacheDir = config.DefaultACMECacheDir
+	}
+
+	log.Printf("ACME enabled for %v (directory: %s, cache: %s)", cfg.Domains, client.DirectoryURL, cacheDir)
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+		Email:      cfg.Email,
+		Client:     client,
+	}, nil
+}
+
+// serveACMEHTTP answers HTTP-01 challenges on addr. Any other request is
+// redirected to HTTPS, as a regular web server would do.
+func serveACMEHTTP(m *autocert.Manager, addr string) {
+	s := &http.Server{
+		Addr:              addr,
+		Handler:           m.HTTPHandler(nil),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		log.Printf("Listening on %s (ACME HTTP-01)", addr)
+		if err := s.ListenAndServe(); err != nil {
+			log.Printf("ACME HTTP-01 listener stopped: %v", err)
+		}
+	}()
+}
+
+// isACMEChallenge reports whether a handshake is a TLS-ALPN-01 validation
+// request. Those come from the CA and never carry a client certificate.
+func isACMEChallenge(hello *tls.ClientHelloInfo) bool {
+	for _, p := range hello.SupportedProtos {
+		if p == acme.ALPNProto {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+package transport
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"phoenix/pkg/config"
+	"phoenix/pkg/crypto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HMAC stream authentication, sent as the "auth" metadata field
+// (X-Nerve-Auth by default, see config.Camouflage).
+//
+//	v2.<key id>.<unix time>.<nonce>.<mac>
+//	key id = SHA-256(auth_token)[:8]
+//	mac = HMAC-SHA256(auth_token, "phoenix-auth-v2\n" + key id + "\n" + time + "\n" +
+//	                  nonce + "\n" + method + "\n" + protocol + "\n" + target)
+//
+// key id, nonce and mac are unpadded base64url. The key id names the token
+// the MAC was made with, so the server checks a single MAC per request no
+// matter how many user tokens it knows. The server accepts timestamps within
+// authMaxSkew of its own clock and remembers nonces for that long, so each
+// header is accepted once and only for the stream metadata it was made for.
+const (
+	authVersion     = "v2"
+	authMACLabel    = "phoenix-auth-v2"
+	authKeyIDLen    = 8
+	authNonceLen    = 16
+	authMaxSkew     = 2 * time.Minute
+	maxAuthReplayed = 1 << 20
+)
+
+// signStream sets m.Auth for a stream request made with method.
+func signStream(m *streamMeta, token, method string, now time.Time) error {
+	nonce := make([]byte, authNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(now.Unix(), 10)
+	n := base64.RawURLEncoding.EncodeToString(nonce)
+	id := authKeyID(token)
+	mac := authMAC(token, id, ts, n, method, m.Protocol, m.Target)
+	m.Auth = strings.Join([]string{authVersion, id, ts, n, mac}, ".")
+	return nil
+}
+
+// authKeyID identifies token in HMAC auth values without revealing it.
+func authKeyID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:authKeyIDLen])
+}
+
+func authMAC(token, id, ts, nonce, method, proto, target string) string {
+	m := hmac.New(sha256.New, []byte(token))
+	m.Write([]byte(strings.Join([]string{authMACLabel, id, ts, nonce, method, proto, target}, "\n")))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// errNoCredentials is returned by requestAuth.check for a request without
+// any token, which is acceptable when its client key identified a user.
+var errNoCredentials = errors.New("no credentials")
+
+// streamIdentity is who a stream authenticated as.
+type streamIdentity struct {
+	claims *crypto.AccessClaims // set for signed access tokens
+	user   *config.UserAccount  // set when the credential belongs to a user account
+	secret string               // the token the client holds, which keys split uploads
+}
+
+// requestAuth checks the credentials of incoming streams: the shared auth
+// token or a user's token (static or HMAC), or a signed access token.
+type requestAuth struct {
+	token      string
+	tokenID    string // authKeyID(token)
+	allowToken bool   // accept static tokens, not only HMAC
+	issuerKeys []string
+	users      *userStore
+
+	mu   sync.Mutex
+	seen map[string]time.Time // nonce → when it can be forgotten
+}
+
+func newRequestAuth(sec config.ServerSecurity, users *userStore) *requestAuth {
+	return &requestAuth{
+		token:      sec.AuthToken,
+		tokenID:    authKeyID(sec.AuthToken),
+		allowToken: sec.AuthMode != "hmac",
+		issuerKeys: sec.TokenIssuerKeys,
+		users:      users,
+		seen:       make(map[string]time.Time),
+	}
+}
+
+// check authenticates a stream request made with method and carrying m.
+// Access tokens are accepted in every auth_mode since they expire on their own.
+func (a *requestAuth) check(method string, m streamMeta) (streamIdentity, error) {
+	if m.Auth != "" {
+		user, token, err := a.checkHMAC(m.Auth, method, m.Protocol, m.Target, time.Now())
+		return streamIdentity{user: user, secret: token}, err
+	}
+
+	token := m.Token
+	if token == "" {
+		return streamIdentity{}, errNoCredentials
+	}
+	if crypto.IsAccessToken(token) && len(a.issuerKeys) > 0 {
+		claims, err := crypto.VerifyAccessToken(token, a.issuerKeys, time.Now())
+		if err != nil {
+			return streamIdentity{}, err
+		}
+		id := streamIdentity{claims: claims, secret: token}
+		if a.users != nil {
+			id.user = a.users.byUserName(claims.Subject)
+		}
+		return id, nil
+	}
+	if !a.allowToken {
+		return streamIdentity{}, fmt.Errorf("static token rejected (auth_mode = \"hmac\")")
+	}
+	if a.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1 {
+		return streamIdentity{secret: token}, nil
+	}
+	if a.users != nil {
+		if user := a.users.byTokenValue(token); user != nil {
+			return streamIdentity{user: user, secret: token}, nil
+		}
+	}
+	return streamIdentity{}, fmt.Errorf("invalid token")
+}
+
+// checkHMAC verifies an HMAC auth value against the shared token or the user
+// token its key id names, returning the token that matched and its user.
+func (a *requestAuth) checkHMAC(header, method, proto, target string, now time.Time) (*config.UserAccount, string, error) {
+	parts := strings.Split(header, ".")
+	if len(parts) != 5 || parts[0] != authVersion {
+		return nil, "", fmt.Errorf("malformed HMAC auth")
+	}
+	id, ts, nonce, mac := parts[1], parts[2], parts[3], parts[4]
+
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("malformed HMAC auth")
+	}
+	if skew := now.Sub(time.Unix(sec, 0)); skew > authMaxSkew || skew < -authMaxSkew {
+		return nil, "", fmt.Errorf("timestamp off by %s (allowed ±%s); check the client clock", skew.Round(time.Second), authMaxSkew)
+	}
+
+	var user *config.UserAccount
+	var token string
+	switch {
+	case a.token != "" && id == a.tokenID:
+		token = a.token
+	case a.users != nil:
+		token, user = a.users.byKeyID(id)
+	}
+	if token == "" || !hmac.Equal([]byte(mac), []byte(authMAC(token, id, ts, nonce, method, proto, target))) {
+		return nil, "", fmt.Errorf("invalid HMAC")
+	}
+
+	// Only remember nonces of requests that authenticated, so unauthenticated
+	// clients cannot fill the cache.
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.seen[nonce]; ok {
+		return nil, "", fmt.Errorf("replayed request (nonce already used)")
+	}
+	if len(a.seen) >= maxAuthReplayed {
+		a.expire(now)
+		if len(a.seen) >= maxAuthReplayed {
+			return nil, "", fmt.Errorf("replay cache full")
+		}
+	}
+	// A nonce only needs remembering until its timestamp leaves the window.
+	a.seen[nonce] = time.Unix(sec, 0).Add(authMaxSkew)
+	if len(a.seen)%1024 == 0 {
+		a.expire(now)
+	}
+	return user, token, nil
+}
+
+// expire forgets nonces whose timestamps are outside the window. Must hold a.mu.
+func (a *requestAuth) expire(now time.Time) {
+	for n, until := range a.seen {
+		if now.After(until) {
+			delete(a.seen, n)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package transport
+
+import (
+	"crypto/sha256"
+	"phoenix/pkg/config"
+	"testing"
+	"time"
+)
+
+func TestHMACAuth(t *testing.T) {
+	auth := newRequestAuth(config.ServerSecurity{AuthToken: "secret-token", AuthMode: "hmac"}, nil)
+	now := time.Now()
+
+	meta := streamMeta{Protocol: "socks5", Target: "example.org:443"}
+	if err := signStream(&meta, "secret-token", "POST", now); err != nil {
+		t.Fatalf("signStream failed: %v", err)
+	}
+	header := meta.Auth
+
+	if _, _, err := auth.checkHMAC(header, "POST", "socks5", "example.org:443", now); err != nil {
+		t.Fatalf("Valid request rejected: %v", err)
+	}
+	if _, _, err := auth.checkHMAC(header, "POST", "socks5", "example.org:443", now); err == nil {
+		t.Error("Expected replayed request to be rejected")
+	}
+
+	signStream(&meta, "secret-token", "POST", now)
+	header = meta.Auth
+	if _, _, err := auth.checkHMAC(header, "POST", "socks5", "evil.example:22", now); err == nil {
+		t.Error("Expected request with a changed target to be rejected")
+	}
+	if _, _, err := auth.checkHMAC(header, "POST", "socks5", "example.org:443", now.Add(authMaxSkew+time.Minute)); err == nil {
+		t.Error("Expected stale request to be rejected")
+	}
+
+	// User tokens are found by the key id in the auth value.
+	alice := &config.UserAccount{Name: "alice", Tokens: []string{"alice-token"}}
+	users := &userStore{
+		byToken:    map[[sha256.Size]byte]*config.UserAccount{sha256.Sum256([]byte("alice-token")): alice},
+		tokensByID: map[string]string{authKeyID("alice-token"): "alice-token"},
+	}
+	userAuth := newRequestAuth(config.ServerSecurity{AuthToken: "secret-token", AuthMode: "hmac"}, users)
+	signStream(&meta, "alice-token", "POST", now)
+	if user, _, err := userAuth.checkHMAC(meta.Auth, "POST", "socks5", "example.org:443", now); err != nil || user != alice {
+		t.Errorf("Expected alice's HMAC to authenticate as alice, got %v, %v", user, err)
+	}
+	signStream(&meta, "unknown-token", "POST", now)
+	if _, _, err := userAuth.checkHMAC(meta.Auth, "POST", "socks5", "example.org:443", now); err == nil {
+		t.Error("Expected HMAC with an unknown key id to be rejected")
+	}
+
+	static := streamMeta{Protocol: "socks5", Token: "secret-token"}
+	if _, err := auth.check("POST", static); err == nil {
+		t.Error("Expected static token to be rejected in hmac mode")
+	}
+	if _, err := newRequestAuth(config.ServerSecurity{AuthToken: "secret-token"}, nil).check("POST", static); err != nil {
+		t.Errorf("Static token rejected in default mode: %v", err)
+	}
+}
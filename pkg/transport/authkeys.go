@@ -0,0 +1,227 @@
+package transport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"phoenix/pkg/config"
+	"phoenix/pkg/crypto"
+	"phoenix/pkg/protocol"
+	"slices"
+	"sync"
+	"time"
+)
+
+// clientExpirySweepInterval is how often open connections are checked
+// against key expiry times.
+const clientExpirySweepInterval = time.Minute
+
+// authorizedClient is an authorized client key and its restrictions.
+type authorizedClient struct {
+	pin       string
+	label     string
+	expires   time.Time
+	protocols []protocol.ProtocolType
+}
+
+// allows reports whether the client may use protocol p.
+// An empty protocol list allows every protocol the server has enabled.
+func (c *authorizedClient) allows(p protocol.ProtocolType) bool {
+	return len(c.protocols) == 0 || slices.Contains(c.protocols, p)
+}
+
+// clientKeyStore holds the authorized client keys from authorized_clients and
+// authorized_clients_file, keyed by SPKI pin. The file is reloaded when it
+// changes, and open connections whose key was removed or has expired are closed.
+type clientKeyStore struct {
+	inline []string
+	file   string
+
+	mu      sync.RWMutex
+	clients map[string]*authorizedClient
+	conns   map[*tls.Conn]trackedConn
+}
+
+// trackedConn is the key an open connection authenticated with.
+type trackedConn struct {
+	pin   string
+	label string
+}
+
+func newClientKeyStore(sec config.ServerSecurity) (*clientKeyStore, error) {
+	s := &clientKeyStore{
+		inline: sec.AuthorizedClientKeys,
+		file:   sec.AuthorizedClientsFile,
+		conns:  make(map[*tls.Conn]trackedConn),
+	}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	if s.file != "" {
+		watchFiles([]string{s.file}, func() {
+			if err := s.reload(); err != nil {
+				log.Printf("Failed to reload authorized clients, keeping previous list: %v", err)
+				return
+			}
+			log.Printf("Reloaded authorized clients from %s (%d keys)", s.file, s.count())
+			s.sweep()
+		})
+	}
+	go func() {
+		ticker := time.NewTicker(clientExpirySweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.sweep()
+		}
+	}()
+
+	return s, nil
+}
+
+// reload rebuilds the key set. Inline keys are labelled by their pin;
+// entries in the file take precedence for the same key.
+func (s *clientKeyStore) reload() error {
+	clients := make(map[string]*authorizedClient)
+	for _, k := range s.inline {
+		pin, err := crypto.NormalizePin(k)
+		if err != nil {
+			return fmt.Errorf("invalid authorized client key %q: %v", k, err)
+		}
+		clients[pin] = &authorizedClient{pin: pin, label: shortPin(pin)}
+	}
+
+	if s.file != "" {
+		list, err := config.LoadAuthorizedClients(s.file)
+		if err != nil {
+			return err
+		}
+		for _, c := range list.Clients {
+			pin, err := crypto.NormalizePin(c.Key)
+			if err != nil {
+				return fmt.Errorf("invalid authorized client key for %s: %v", c.Label, err)
+			}
+			clients[pin] = &authorizedClient{pin: pin, label: c.Label, expires: c.Expires, protocols: c.Protocols}
+		}
+	}
+
+	s.mu.Lock()
+	s.clients = clients
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *clientKeyStore) count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.clients)
+}
+
+// lookup returns the client for pin, or an error if the key is unknown or expired.
+func (s *clientKeyStore) lookup(pin string) (*authorizedClient, error) {
+	s.mu.RLock()
+	c, ok := s.clients[pin]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unauthorized client key: %s", pin)
+	}
+	if !c.expires.IsZero() && time.Now().After(c.expires) {
+		return nil, fmt.Errorf("client key %s (%s) expired at %s", pin, c.label, c.expires.Format(time.RFC3339))
+	}
+	return c, nil
+}
+
+// uniqueLabel returns label, suffixed with a number if another key already uses it.
+func (s *clientKeyStore) uniqueLabel(label string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	taken := make(map[string]bool, len(s.clients))
+	for _, c := range s.clients {
+		taken[c.label] = true
+	}
+	candidate := label
+	for i := 2; taken[candidate]; i++ {
+		candidate = fmt.Sprintf("%s-%d", label, i)
+	}
+	return candidate
+}
+
+// trackConn is an http.Server ConnState hook that records which key each
+// open TLS connection authenticated with.
+func (s *clientKeyStore) trackConn(conn net.Conn, state http.ConnState) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+	switch state {
+	case http.StateActive:
+		pin, err := peerPin(tlsConn.ConnectionState())
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if c, ok := s.clients[pin]; ok {
+			s.conns[tlsConn] = trackedConn{pin: pin, label: c.label}
+		}
+		s.mu.Unlock()
+	case http.StateClosed, http.StateHijacked:
+		s.mu.Lock()
+		delete(s.conns, tlsConn)
+		s.mu.Unlock()
+	}
+}
+
+// sweep closes every open connection whose key is no longer authorized.
+// Closing the connection ends all of its HTTP/2 streams.
+func (s *clientKeyStore) sweep() {
+	s.mu.RLock()
+	conns := make(map[*tls.Conn]trackedConn, len(s.conns))
+	for c, t := range s.conns {
+		conns[c] = t
+	}
+	s.mu.RUnlock()
+
+	for c, t := range conns {
+		if _, err := s.lookup(t.pin); err != nil {
+			log.Printf("Closing connection from %s [%s]: %v", c.RemoteAddr(), t.label, err)
+			c.Close()
+		}
+	}
+}
+
+// clientForRequest returns the authorized client behind r. A request without
+// a client certificate is an error: connections exempt from mTLS, such as
+// ACME TLS-ALPN-01 validation, must not be able to open streams.
+func (s *clientKeyStore) clientForRequest(r *http.Request) (*authorizedClient, error) {
+	if r.TLS == nil {
+		return nil, fmt.Errorf("no client certificate provided")
+	}
+	pin, err := peerPin(*r.TLS)
+	if err != nil {
+		return nil, err
+	}
+	return s.lookup(pin)
+}
+
+// peerPin returns the SPKI pin of the peer's leaf certificate.
+func peerPin(state tls.ConnectionState) (string, error) {
+	if len(state.PeerCertificates) == 0 {
+		return "", fmt.Errorf("no client certificate provided")
+	}
+	pin, err := crypto.SPKIPin(state.PeerCertificates[0].PublicKey)
+	if err != nil {
+		return "", fmt.Errorf("unsupported client key: %v", err)
+	}
+	return pin, nil
+}
+
+// shortPin abbreviates a pin for use as a log label.
+func shortPin(pin string) string {
+	const n = len(crypto.SPKIPinPrefix) + 8
+	if len(pin) <= n {
+		return pin
+	}
+	return pin[:n]
+}
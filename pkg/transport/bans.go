@@ -0,0 +1,248 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"phoenix/pkg/config"
+	"sync"
+	"time"
+)
+
+// banFlushInterval is how often changed bans are written to the state file.
+const banFlushInterval = 30 * time.Second
+
+// maxBanTracked bounds the addresses with recent failures, and the ban
+// records, held in memory, so a flood from many addresses cannot grow either
+// table without limit.
+const maxBanTracked = 100000
+
+// banRecord is the ban history of one address.
+type banRecord struct {
+	// Until is when the current (or last) ban ends.
+	Until time.Time `json:"until"`
+	// Strikes counts consecutive bans; each one doubles the ban time.
+	Strikes int `json:"strikes"`
+}
+
+// banList tracks authentication failures per client address and bans
+// addresses that fail too often. IPv6 addresses count by their network of
+// ipv6Prefix bits, which is what the tables hold for them (see key).
+type banList struct {
+	maxFailures int
+	findTime    time.Duration
+	banTime     time.Duration
+	maxBanTime  time.Duration
+	ipv6Prefix  int
+	allow       []netip.Prefix
+	path        string
+
+	mu       sync.Mutex
+	failures map[netip.Addr][]time.Time
+	bans     map[netip.Addr]*banRecord
+	dirty    bool
+}
+
+func newBanList(cfg config.ServerBans) (*banList, error) {
+	find, ban, max, err := cfg.Durations()
+	if err != nil {
+		return nil, err
+	}
+	allow, err := cfg.AllowedPrefixes()
+	if err != nil {
+		return nil, err
+	}
+	b := &banList{
+		maxFailures: cfg.MaxFailures,
+		findTime:    find,
+		banTime:     ban,
+		maxBanTime:  max,
+		ipv6Prefix:  cfg.IPv6PrefixLen(),
+		allow:       allow,
+		path:        cfg.StateFile,
+		failures:    make(map[netip.Addr][]time.Time),
+		bans:        make(map[netip.Addr]*banRecord),
+	}
+
+	if b.path != "" {
+		data, err := os.ReadFile(b.path)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, fmt.Errorf("failed to read ban state: %w", err)
+		default:
+			var saved map[netip.Addr]*banRecord
+			if err := json.Unmarshal(data, &saved); err != nil {
+				return nil, fmt.Errorf("failed to parse ban state %s: %w", b.path, err)
+			}
+			// Saved with another ipv6_prefix, several records may fall in
+			// one network; the longest ban wins.
+			for addr, r := range saved {
+				k := b.key(addr)
+				if old := b.bans[k]; old == nil || r.Until.After(old.Until) {
+					b.bans[k] = r
+				}
+			}
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(banFlushInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			b.expire(time.Now())
+			if err := b.flush(); err != nil {
+				log.Printf("Failed to save ban state: %v", err)
+			}
+		}
+	}()
+	return b, nil
+}
+
+// key returns the address addr is counted under: addr itself for IPv4, or
+// the first address of its network for IPv6.
+func (b *banList) key(addr netip.Addr) netip.Addr {
+	addr = addr.Unmap()
+	if !addr.Is6() {
+		return addr
+	}
+	p, _ := addr.WithZone("").Prefix(b.ipv6Prefix)
+	return p.Addr()
+}
+
+// scope describes what a ban of addr covers, for logs.
+func (b *banList) scope(addr netip.Addr) string {
+	k := b.key(addr)
+	if k.Is6() && b.ipv6Prefix < 128 {
+		return netip.PrefixFrom(k, b.ipv6Prefix).String()
+	}
+	return k.String()
+}
+
+// allowed reports whether addr is on the allowlist.
+func (b *banList) allowed(addr netip.Addr) bool {
+	for _, p := range b.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// banned reports whether addr is banned at now.
+func (b *banList) banned(addr netip.Addr, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r, ok := b.bans[b.key(addr)]
+	return ok && now.Before(r.Until)
+}
+
+// fail records a failed attempt from addr and bans it once it has failed
+// maxFailures times within findTime. It returns the ban length, or 0.
+func (b *banList) fail(addr netip.Addr, now time.Time) time.Duration {
+	if !addr.IsValid() || b.allowed(addr) {
+		return 0
+	}
+	addr = b.key(addr)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if r, ok := b.bans[addr]; ok && now.Before(r.Until) {
+		return 0
+	}
+	recent := b.failures[addr][:0]
+	for _, t := range b.failures[addr] {
+		if now.Sub(t) < b.findTime {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) < b.maxFailures {
+		if len(b.failures) < maxBanTracked || b.failures[addr] != nil {
+			b.failures[addr] = recent
+		}
+		return 0
+	}
+	delete(b.failures, addr)
+
+	r, ok := b.bans[addr]
+	if !ok || now.Sub(r.Until) > b.maxBanTime {
+		if !ok {
+			b.makeRoom(now)
+		}
+		r = &banRecord{}
+		b.bans[addr] = r
+	}
+	d := b.banTime
+	for i := 0; i < r.Strikes && d < b.maxBanTime; i++ {
+		d *= 2
+	}
+	if d > b.maxBanTime {
+		d = b.maxBanTime
+	}
+	r.Strikes++
+	r.Until = now.Add(d)
+	b.dirty = true
+	return d
+}
+
+// makeRoom makes room for one more ban record when there are maxBanTracked
+// already: records of bans that have ended, kept only so that the next ban
+// escalates, go first, then the ban that ends soonest. b.mu must be held.
+func (b *banList) makeRoom(now time.Time) {
+	if len(b.bans) < maxBanTracked {
+		return
+	}
+	var soonest netip.Addr
+	for addr, r := range b.bans {
+		if !now.Before(r.Until) {
+			delete(b.bans, addr)
+		} else if !soonest.IsValid() || r.Until.Before(b.bans[soonest].Until) {
+			soonest = addr
+		}
+	}
+	if len(b.bans) >= maxBanTracked {
+		delete(b.bans, soonest)
+	}
+	b.dirty = true
+}
+
+// expire forgets stale failures and bans old enough not to escalate again.
+func (b *banList) expire(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for addr, ts := range b.failures {
+		if len(ts) == 0 || now.Sub(ts[len(ts)-1]) >= b.findTime {
+			delete(b.failures, addr)
+		}
+	}
+	for addr, r := range b.bans {
+		if now.Sub(r.Until) > b.maxBanTime {
+			delete(b.bans, addr)
+			b.dirty = true
+		}
+	}
+}
+
+// flush writes the bans to the state file if they changed.
+func (b *banList) flush() error {
+	b.mu.Lock()
+	if b.path == "" || !b.dirty {
+		b.mu.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(b.bans, "", "  ")
+	b.dirty = false
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
@@ -0,0 +1,134 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"phoenix/pkg/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	b, err := newBanList(config.ServerBans{MaxFailures: 3, BanTime: "1m", MaxBanTime: "3m", Allowlist: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatalf("newBanList failed: %v", err)
+	}
+	addr := netip.MustParseAddr("203.0.113.7")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	ban := func() time.Duration {
+		var d time.Duration
+		for i := 0; i < 3; i++ {
+			d = b.fail(addr, now)
+		}
+		return d
+	}
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		if d := ban(); d != want {
+			t.Fatalf("Ban %d lasted %v, want %v", i+1, d, want)
+		}
+		if !b.banned(addr, now) {
+			t.Fatalf("Address not banned after ban %d", i+1)
+		}
+		now = now.Add(want)
+		if b.banned(addr, now) {
+			t.Fatalf("Ban %d did not expire", i+1)
+		}
+	}
+
+	now = now.Add(4 * time.Minute)
+	if d := ban(); d != time.Minute {
+		t.Errorf("Ban after a quiet period lasted %v, want a fresh 1m", d)
+	}
+
+	allowed := netip.MustParseAddr("10.1.2.3")
+	for i := 0; i < 10; i++ {
+		b.fail(allowed, now)
+	}
+	if b.banned(allowed, now) {
+		t.Error("Allowlisted address was banned")
+	}
+}
+
+func TestBanListIPv6(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b, _ := newBanList(config.ServerBans{MaxFailures: 2})
+	b.fail(netip.MustParseAddr("2001:db8:1:2::1"), now)
+	b.fail(netip.MustParseAddr("2001:db8:1:2:ffff::9"), now)
+	if !b.banned(netip.MustParseAddr("2001:db8:1:2::abcd"), now) {
+		t.Error("Failures from one /64 did not ban it")
+	}
+	if b.banned(netip.MustParseAddr("2001:db8:1:3::1"), now) {
+		t.Error("Ban spread to the next /64")
+	}
+	if got := b.scope(netip.MustParseAddr("2001:db8:1:2::1")); got != "2001:db8:1:2::/64" {
+		t.Errorf("Ban scope %q", got)
+	}
+
+	single, _ := newBanList(config.ServerBans{MaxFailures: 2, IPv6Prefix: 128})
+	single.fail(netip.MustParseAddr("2001:db8::1"), now)
+	single.fail(netip.MustParseAddr("2001:db8::2"), now)
+	if single.banned(netip.MustParseAddr("2001:db8::1"), now) {
+		t.Error("ipv6_prefix = 128 still grouped addresses")
+	}
+}
+
+func TestBanListBounded(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b, _ := newBanList(config.ServerBans{MaxFailures: 1})
+	for i := 0; i < maxBanTracked; i++ {
+		addr := netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})
+		until := now.Add(time.Hour)
+		if i%2 == 0 {
+			until = now.Add(-time.Minute) // ended, kept for escalation
+		}
+		b.bans[addr] = &banRecord{Until: until}
+	}
+	addr := netip.MustParseAddr("203.0.113.7")
+	if d := b.fail(addr, now); d == 0 || !b.banned(addr, now) {
+		t.Fatal("A new ban was not recorded with the table full")
+	}
+	if len(b.bans) > maxBanTracked/2+1 {
+		t.Errorf("%d ban records left, want the ended ones dropped", len(b.bans))
+	}
+	if !b.banned(netip.AddrFrom4([4]byte{10, 0, 0, 1}), now) {
+		t.Error("A current ban was dropped while ended ones were left")
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	v1 := "PROXY TCP4 198.51.100.9 192.0.2.1 40000 443\r\nGET / HTTP/1.1\r\n"
+	br := bufio.NewReader(strings.NewReader(v1))
+	src, err := readProxyHeader(br)
+	if err != nil || src.String() != "198.51.100.9:40000" {
+		t.Fatalf("v1 header parsed as %v, %v", src, err)
+	}
+	if rest, _ := br.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+		t.Errorf("v1 header consumed too much: %q", rest)
+	}
+
+	var v2 bytes.Buffer
+	v2.Write(proxyV2Signature)
+	v2.Write([]byte{0x21, 0x21}) // PROXY command, TCP over IPv6
+	binary.Write(&v2, binary.BigEndian, uint16(36))
+	v2.Write(netip.MustParseAddr("2001:db8::1").AsSlice())
+	v2.Write(netip.MustParseAddr("2001:db8::2").AsSlice())
+	binary.Write(&v2, binary.BigEndian, uint16(50000))
+	binary.Write(&v2, binary.BigEndian, uint16(443))
+	v2.WriteString("payload")
+	br = bufio.NewReader(&v2)
+	src, err = readProxyHeader(br)
+	if err != nil || src.String() != "[2001:db8::1]:50000" {
+		t.Fatalf("v2 header parsed as %v, %v", src, err)
+	}
+	if rest, _ := br.ReadString(0); rest != "payload" {
+		t.Errorf("v2 header consumed too much: %q", rest)
+	}
+
+	if _, err := readProxyHeader(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))); err == nil {
+		t.Error("Expected a connection without header to be rejected")
+	}
+}
@@ -0,0 +1,229 @@
+package transport
+
+import (
+	"bytes"
+	stdcrypto "crypto"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"phoenix/pkg/config"
+	"phoenix/pkg/crypto"
+	"slices"
+	"strings"
+)
+
+// streamMeta is the metadata a client sends with a stream request.
+type streamMeta struct {
+	Protocol    string
+	Target      string
+	Token       string
+	Auth        string // HMAC authentication, see signRequest
+	EnrollCode  string
+	EnrollLabel string
+	Inner       string // inner channel handshake of WebSocket and split streams, base64url
+	Session     string // split stream session ID
+	Seq         string // split stream upload sequence number
+}
+
+// fields pairs each value of m with its key name.
+func (m *streamMeta) fields(k config.CamouflageKeys) []struct {
+	key string
+	val *string
+} {
+	return []struct {
+		key string
+		val *string
+	}{
+		{k.Protocol, &m.Protocol},
+		{k.Target, &m.Target},
+		{k.Token, &m.Token},
+		{k.Auth, &m.Auth},
+		{k.EnrollCode, &m.EnrollCode},
+		{k.EnrollLabel, &m.EnrollLabel},
+		{k.Inner, &m.Inner},
+		{k.Session, &m.Session},
+		{k.Seq, &m.Seq},
+	}
+}
+
+// camouflage encodes stream metadata into requests and decodes it again,
+// following config.Camouflage.
+type camouflage struct {
+	cfg config.Camouflage // resolved
+
+	// For carrier "body": the server key preambles are sealed to (client),
+	// and the keys that open them (server).
+	sealTo   stdcrypto.PublicKey
+	openWith []stdcrypto.PrivateKey
+}
+
+func newCamouflage(cfg config.Camouflage) *camouflage {
+	return &camouflage{cfg: cfg.Resolved()}
+}
+
+// newRequest builds a stream request to baseURL (scheme and host) carrying m.
+func (c *camouflage) newRequest(baseURL string, body io.Reader, m streamMeta) (*http.Request, error) {
+	path := c.cfg.Path
+	vals := url.Values{}
+	for _, f := range m.fields(c.cfg.Keys) {
+		if *f.val != "" {
+			vals.Set(f.key, *f.val)
+		}
+	}
+	switch c.cfg.Carrier {
+	case "path":
+		path = strings.TrimSuffix(path, "/") + "/" + base64.RawURLEncoding.EncodeToString([]byte(vals.Encode()))
+	case "body":
+		if c.sealTo == nil {
+			return nil, fmt.Errorf("encrypted metadata requires the server's metadata_key")
+		}
+		preamble, err := crypto.SealMetadata(c.sealTo, []byte(vals.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		if body == nil {
+			body = bytes.NewReader(preamble)
+		} else {
+			body = io.MultiReader(bytes.NewReader(preamble), body)
+		}
+	}
+
+	req, err := http.NewRequest(c.cfg.Method, baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	switch c.cfg.Carrier {
+	case "header":
+		for k, v := range vals {
+			req.Header.Set(k, v[0])
+		}
+	case "cookie":
+		for _, f := range m.fields(c.cfg.Keys) {
+			if *f.val != "" {
+				req.AddCookie(&http.Cookie{Name: f.key, Value: url.QueryEscape(*f.val)})
+			}
+		}
+	case "query":
+		req.URL.RawQuery = vals.Encode()
+	}
+	return req, nil
+}
+
+// decode extracts the stream metadata from r. It reports false when r is not
+// a stream request: wrong method or path, or undecodable metadata. WebSocket
+// requests and split stream downloads are GETs (or CONNECTs) instead of the
+// configured method.
+func (c *camouflage) decode(r *http.Request) (streamMeta, bool) {
+	var m streamMeta
+	if r.Method != c.cfg.Method && r.Method != http.MethodGet && !isWebSocketRequest(r) {
+		return m, false
+	}
+
+	var vals url.Values
+	switch c.cfg.Carrier {
+	case "path":
+		prefix := strings.TrimSuffix(c.cfg.Path, "/") + "/"
+		seg, ok := strings.CutPrefix(r.URL.Path, prefix)
+		if !ok || seg == "" || strings.Contains(seg, "/") {
+			return m, false
+		}
+		raw, err := base64.RawURLEncoding.DecodeString(seg)
+		if err != nil {
+			return m, false
+		}
+		if vals, err = url.ParseQuery(string(raw)); err != nil {
+			return m, false
+		}
+	case "query":
+		if !c.pathMatches(r) {
+			return m, false
+		}
+		vals = r.URL.Query()
+	case "body":
+		if !c.pathMatches(r) {
+			return m, false
+		}
+		var ok bool
+		if vals, ok = c.readPreamble(r); !ok {
+			return m, false
+		}
+	default:
+		if !c.pathMatches(r) {
+			return m, false
+		}
+	}
+
+	for _, f := range m.fields(c.cfg.Keys) {
+		switch c.cfg.Carrier {
+		case "header":
+			*f.val = r.Header.Get(f.key)
+		case "cookie":
+			if ck, err := r.Cookie(f.key); err == nil {
+				*f.val, _ = url.QueryUnescape(ck.Value)
+			}
+		default:
+			*f.val = vals.Get(f.key)
+		}
+	}
+	if r.Method == http.MethodGet && m.Session == "" && !isWebSocketRequest(r) {
+		// A page view, not a split download.
+		return m, false
+	}
+	return m, true
+}
+
+// readPreamble decrypts the metadata at the start of r.Body. If that fails,
+// the bytes read are put back so a decoy sees the request unchanged.
+func (c *camouflage) readPreamble(r *http.Request) (url.Values, bool) {
+	var consumed bytes.Buffer
+	plain, err := crypto.OpenMetadata(c.openWith, io.TeeReader(r.Body, &consumed))
+	if err == nil {
+		if vals, err := url.ParseQuery(string(plain)); err == nil {
+			return vals, true
+		}
+	}
+	restoreBody(r, &consumed)
+	return nil, false
+}
+
+// restoreBody puts consumed back in front of the rest of r.Body.
+func restoreBody(r *http.Request, consumed *bytes.Buffer) {
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(consumed, r.Body), r.Body}
+}
+
+// pathMatches reports whether r is for the stream path. The default path "/"
+// matches every path, as before paths were configurable.
+func (c *camouflage) pathMatches(r *http.Request) bool {
+	return c.cfg.Path == "/" || r.URL.Path == c.cfg.Path
+}
+
+// strip removes the metadata from r, so credentials are not passed on to a
+// decoy upstream.
+func (c *camouflage) strip(r *http.Request) {
+	keys := c.cfg.Keys.List()
+	switch c.cfg.Carrier {
+	case "header":
+		for _, k := range keys {
+			r.Header.Del(k)
+		}
+	case "cookie":
+		cookies := r.Cookies()
+		r.Header.Del("Cookie")
+		for _, ck := range cookies {
+			if !slices.Contains(keys, ck.Name) {
+				r.AddCookie(ck)
+			}
+		}
+	case "query":
+		q := r.URL.Query()
+		for _, k := range keys {
+			q.Del(k)
+		}
+		r.URL.RawQuery = q.Encode()
+	}
+}
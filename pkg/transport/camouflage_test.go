@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"bytes"
+	stdcrypto "crypto"
+	"crypto/ed25519"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"phoenix/pkg/config"
+	"strings"
+	"testing"
+)
+
+func TestCamouflage(t *testing.T) {
+	meta := streamMeta{Protocol: "socks5", Target: "[2001:db8::1]:443", Token: "tok; en=+/ x"}
+	for _, carrier := range []string{"header", "cookie", "query", "path"} {
+		camo := newCamouflage(config.Camouflage{Path: "/api/sync", Method: "put", Carrier: carrier, Keys: config.CamouflageKeys{Token: "session"}})
+		req, err := camo.newRequest("https://example.com", nil, meta)
+		if err != nil {
+			t.Fatalf("%s: newRequest failed: %v", carrier, err)
+		}
+		if req.Method != http.MethodPut || !strings.HasPrefix(req.URL.Path, "/api/sync") {
+			t.Errorf("%s: request is %s %s", carrier, req.Method, req.URL.Path)
+		}
+		if carrier != "header" && req.Header.Get("X-Nerve-Protocol") != "" {
+			t.Errorf("%s: metadata leaked into headers", carrier)
+		}
+
+		// Through the wire format, as the server sees it.
+		srvReq := httptest.NewRequest(req.Method, req.URL.String(), nil)
+		srvReq.Header = req.Header
+		got, ok := camo.decode(srvReq)
+		if !ok || got != meta {
+			t.Errorf("%s: decoded %+v, %v", carrier, got, ok)
+		}
+
+		camo.strip(srvReq)
+		if got, _ := camo.decode(srvReq); got.Token != "" && carrier != "path" {
+			t.Errorf("%s: token survived strip", carrier)
+		}
+
+		if _, ok := camo.decode(httptest.NewRequest("POST", req.URL.String(), nil)); ok {
+			t.Errorf("%s: request with the wrong method accepted", carrier)
+		}
+		if _, ok := camo.decode(httptest.NewRequest("PUT", "https://example.com/other", nil)); ok {
+			t.Errorf("%s: request for another path accepted", carrier)
+		}
+	}
+}
+
+func TestEncryptedMetadata(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	meta := streamMeta{Protocol: "socks5", Target: "example.org:443", Auth: "v1.1.2.3"}
+
+	client := newCamouflage(config.Camouflage{Carrier: "body"})
+	client.sealTo = pub
+	req, err := client.newRequest("https://example.com", strings.NewReader("payload"), meta)
+	if err != nil {
+		t.Fatalf("newRequest failed: %v", err)
+	}
+	wire, _ := io.ReadAll(req.Body)
+	if bytes.Contains(wire, []byte("example.org")) {
+		t.Error("Target visible in request body")
+	}
+
+	server := newCamouflage(config.Camouflage{Carrier: "body"})
+	server.openWith = []stdcrypto.PrivateKey{priv}
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(wire))
+	got, ok := server.decode(r)
+	if !ok || got != meta {
+		t.Fatalf("Decoded %+v, %v", got, ok)
+	}
+	if rest, _ := io.ReadAll(r.Body); string(rest) != "payload" {
+		t.Errorf("Stream data after the preamble is %q", rest)
+	}
+
+	probe := strings.Repeat("x", 100)
+	r = httptest.NewRequest("POST", "/", strings.NewReader(probe))
+	if _, ok := server.decode(r); ok {
+		t.Fatal("Request without a preamble accepted")
+	}
+	if rest, _ := io.ReadAll(r.Body); string(rest) != probe {
+		t.Errorf("Rejected request body not restored for the decoy: %q", rest)
+	}
+}
@@ -0,0 +1,221 @@
+package transport
+
+import (
+	stdcrypto "crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"phoenix/pkg/config"
+	"phoenix/pkg/crypto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// getCertificateFunc is the signature of tls.Config.GetCertificate.
+type getCertificateFunc func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+// serverCertificate returns the certificate source for the TLS listener.
+// cert_file/key_file take precedence and are reloaded when they change on
+// disk, then ACME-issued certificates; otherwise a self-signed certificate
+// is generated from private_key. The ACME manager is returned when in use.
+func serverCertificate(cfg *config.ServerConfig) (getCertificateFunc, *autocert.Manager, error) {
+	sec := cfg.Security
+	if sec.CertFile != "" {
+		r, err := newCertReloader(sec.CertFile, sec.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("Serving certificate chain from %s (reloaded on change)", sec.CertFile)
+		return r.GetCertificate, nil, nil
+	}
+
+	if len(cfg.ACME.Domains) > 0 {
+		m, err := newACMEManager(cfg.ACME)
+		if err != nil {
+			return nil, nil, err
+		}
+		return m.GetCertificate, m, nil
+	}
+
+	// private_key is presented until the first scheduled next_keys entry takes over.
+	keys := append([]config.ServerNextKey{{
+		PrivateKeyPath:       sec.PrivateKeyPath,
+		PrivateKeyPassphrase: sec.PrivateKeyPassphrase,
+	}}, sec.NextKeys...)
+
+	var certs scheduledCerts
+	for _, k := range keys {
+		sc, err := newScheduledCert(k)
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = append(certs, sc)
+	}
+	sort.SliceStable(certs, func(i, j int) bool { return certs[i].notBefore.Before(certs[j].notBefore) })
+
+	return certs.GetCertificate, nil, nil
+}
+
+// scheduledCert is a self-signed certificate presented from notBefore on,
+// to the clients key selects (see config.ServerNextKey.PresentedTo).
+type scheduledCert struct {
+	notBefore time.Time
+	key       config.ServerNextKey
+	cert      tls.Certificate
+}
+
+func newScheduledCert(k config.ServerNextKey) (scheduledCert, error) {
+	priv, err := loadServerKey(k.PrivateKeyPath, k.PrivateKeyPassphrase)
+	if err != nil {
+		return scheduledCert{}, err
+	}
+
+	// Generate Self-Signed Certificate
+	cert, err := crypto.GenerateTLSCertificate(priv)
+	if err != nil {
+		return scheduledCert{}, fmt.Errorf("failed to generate TLS certificate: %v", err)
+	}
+
+	if pin, err := crypto.PublicKeyPin(priv); err == nil {
+		switch {
+		case k.NotBefore.IsZero():
+			log.Printf("Server key pin (server_public_key): %s", pin)
+		case len(k.ServerNames) > 0:
+			log.Printf("Scheduled server key pin from %s for %s: %s", k.NotBefore.Format(time.RFC3339), strings.Join(k.ServerNames, ", "), pin)
+		default:
+			log.Printf("Scheduled server key pin from %s: %s", k.NotBefore.Format(time.RFC3339), pin)
+		}
+	}
+	return scheduledCert{notBefore: k.NotBefore, key: k, cert: cert}, nil
+}
+
+// serverKeys caches loaded server keys by path, so an encrypted key used
+// both for TLS and for stream metadata is only unlocked once.
+var serverKeys sync.Map
+
+// loadServerKey loads the private key at path, prompting for its passphrase
+// if it is encrypted and none is configured.
+func loadServerKey(path, passphrase string) (stdcrypto.PrivateKey, error) {
+	if k, ok := serverKeys.Load(path); ok {
+		return k, nil
+	}
+	priv, err := crypto.LoadPrivateKeyWithPassphrase(path, crypto.PassphraseSource(passphrase, path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load private key %s: %v", path, err)
+	}
+	serverKeys.Store(path, priv)
+	return priv, nil
+}
+
+// metadataKeys loads the keys that decrypt stream metadata: metadata_key,
+// or else private_key and next_keys.
+func metadataKeys(sec config.ServerSecurity) ([]stdcrypto.PrivateKey, error) {
+	keys := []config.ServerNextKey{{PrivateKeyPath: sec.MetadataKeyPath}}
+	if sec.MetadataKeyPath == "" {
+		keys = append([]config.ServerNextKey{{
+			PrivateKeyPath:       sec.PrivateKeyPath,
+			PrivateKeyPassphrase: sec.PrivateKeyPassphrase,
+		}}, sec.NextKeys...)
+	}
+
+	var out []stdcrypto.PrivateKey
+	for _, k := range keys {
+		priv, err := loadServerKey(k.PrivateKeyPath, k.PrivateKeyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		if !crypto.MetadataKeySupported(priv) {
+			return nil, fmt.Errorf("%s: encrypted metadata requires an Ed25519 key", k.PrivateKeyPath)
+		}
+		out = append(out, priv)
+	}
+	return out, nil
+}
+
+// scheduledCerts is sorted by notBefore; the newest one that has started and
+// is presented to the client is served.
+type scheduledCerts []scheduledCert
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (s scheduledCerts) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.at(hello.ServerName, time.Now()), nil
+}
+
+// at returns the certificate for a client connecting with serverName at now.
+func (s scheduledCerts) at(serverName string, now time.Time) *tls.Certificate {
+	current := &s[0].cert
+	for i := range s {
+		if !now.Before(s[i].notBefore) && s[i].key.PresentedTo(serverName, now) {
+			current = &s[i].cert
+		}
+	}
+	return current
+}
+
+// certReloader serves a certificate chain loaded from disk and swaps in the
+// new chain when either file changes, so renewals need no restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	watchFiles([]string{certFile, keyFile}, func() {
+		if err := r.reload(); err != nil {
+			// Keep serving the previous chain; a half-written renewal is
+			// picked up on the next change.
+			log.Printf("Failed to reload certificate (keeping previous): %v", err)
+			return
+		}
+		log.Printf("Reloaded certificate from %s", certFile)
+	})
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate %s: %v", r.certFile, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate %s: %v", r.certFile, err)
+	}
+	cert.Leaf = leaf
+	logCertificatePin(leaf)
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// logCertificatePin prints the value clients can put in server_public_key
+// to pin this certificate's key instead of relying on the CA chain.
+func logCertificatePin(leaf *x509.Certificate) {
+	pin, err := crypto.SPKIPin(leaf.PublicKey)
+	if err != nil {
+		log.Printf("Certificate key (%T) cannot be pinned: %v", leaf.PublicKey, err)
+		return
+	}
+	log.Printf("Certificate key pin (server_public_key): %s", pin)
+}
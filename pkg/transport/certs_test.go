@@ -0,0 +1,114 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"phoenix/pkg/config"
+	"phoenix/pkg/crypto"
+	"testing"
+	"time"
+)
+
+// writeCertPair writes a new self-signed certificate and its key to the
+// given paths and returns the certificate.
+func writeCertPair(t *testing.T, certFile, keyFile string) []byte {
+	t.Helper()
+	keyPEM, _, err := crypto.GenerateKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := crypto.ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := crypto.GenerateTLSCertificate(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert.Certificate[0]
+}
+
+// touch moves the modification time of paths forward so that the watcher
+// sees a change even within the filesystem's timestamp resolution.
+func touch(t *testing.T, at time.Time, paths ...string) {
+	t.Helper()
+	for _, p := range paths {
+		if err := os.Chtimes(p, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	defer func(d time.Duration) { fileWatchInterval = d }(fileWatchInterval)
+	fileWatchInterval = 10 * time.Millisecond
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first := writeCertPair(t, certFile, keyFile)
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader failed: %v", err)
+	}
+	served := func() []byte {
+		cert, _ := r.GetCertificate(&tls.ClientHelloInfo{})
+		return cert.Certificate[0]
+	}
+	if !bytes.Equal(served(), first) {
+		t.Fatal("Initial certificate not served")
+	}
+
+	// A renewed pair is picked up without a restart.
+	second := writeCertPair(t, certFile, keyFile)
+	touch(t, time.Now().Add(time.Minute), certFile, keyFile)
+	for deadline := time.Now().Add(5 * time.Second); !bytes.Equal(served(), second); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Replaced certificate was not picked up")
+		}
+	}
+
+	// A key that does not match the certificate, as seen halfway through a
+	// renewal, keeps the previous pair in service.
+	writeCertPair(t, filepath.Join(dir, "other.pem"), keyFile)
+	touch(t, time.Now().Add(2*time.Minute), keyFile)
+	time.Sleep(20 * fileWatchInterval)
+	if !bytes.Equal(served(), second) {
+		t.Error("Mismatched pair replaced the certificate in service")
+	}
+}
+
+func TestScheduledCerts(t *testing.T) {
+	cert := func(id byte) tls.Certificate { return tls.Certificate{Certificate: [][]byte{{id}}} }
+	rollover := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	allFrom := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	certs := scheduledCerts{
+		{cert: cert(1)},
+		{notBefore: rollover, key: config.ServerNextKey{NotBefore: rollover, ServerNames: []string{"new.example.com"}, AllFrom: allFrom}, cert: cert(2)},
+	}
+
+	for _, tc := range []struct {
+		name string
+		at   time.Time
+		want byte
+	}{
+		{"new.example.com", rollover.Add(-time.Hour), 1},
+		{"new.example.com", rollover, 2},
+		{"example.com", rollover, 1}, // does not pin the new key yet
+		{"", rollover, 1},
+		{"example.com", allFrom, 2},
+	} {
+		if got := certs.at(tc.name, tc.at).Certificate[0][0]; got != tc.want {
+			t.Errorf("%q at %v got key %d, want %d", tc.name, tc.at, got, tc.want)
+		}
+	}
+}
@@ -1,10 +1,10 @@
 package transport
 
 import (
-	"crypto/ed25519"
+	"bytes"
+	stdcrypto "crypto"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -14,6 +14,9 @@ import (
 	"phoenix/pkg/config"
 	"phoenix/pkg/crypto"
 	"phoenix/pkg/protocol"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -25,21 +28,28 @@ import (
 // Client handles outgoing connections to the Server.
 type Client struct {
 	Config       *config.ClientConfig
-	httpClient   *http.Client // Internal HTTP client (protected by mu)
+	privateKey   stdcrypto.PrivateKey // Client key for mTLS, loaded once (may need a passphrase)
+	httpClient   *http.Client         // Internal HTTP client (protected by mu)
 	Scheme       string
-	failureCount uint32       // Atomic counter
-	mu           sync.RWMutex // Protects httpClient
-	lastReset    time.Time    // Timestamp of last reset (for debounce)
+	failureCount uint32              // Atomic counter
+	mu           sync.RWMutex        // Protects httpClient
+	lastReset    time.Time           // Timestamp of last reset (for debounce)
+	camo         *camouflage         // Request path, method and metadata encoding
+	innerKey     stdcrypto.PublicKey // Server key for inner_encryption, or nil
+
+	quotaRemaining int64 // Atomic; last X-Nerve-Quota-Remaining, or -1 if never reported
 }
 
 // NewClient creates a new Phoenix client instance.
 func NewClient(cfg *config.ClientConfig) *Client {
 	c := &Client{
-		Config: cfg,
+		Config:         cfg,
+		camo:           newCamouflage(cfg.Camouflage),
+		quotaRemaining: -1,
 	}
 
 	// Initialize scheme based on config
-	if cfg.TLSMode == "system" || cfg.TLSMode == "insecure" || cfg.PrivateKeyPath != "" || cfg.ServerPublicKey != "" {
+	if cfg.TLSMode == "system" || cfg.TLSMode == "insecure" || cfg.TLSMode == "tofu" || cfg.PrivateKeyPath != "" || cfg.HasServerKeys() {
 		c.Scheme = "https"
 	} else {
 		c.Scheme = "http"
@@ -48,6 +58,37 @@ func NewClient(cfg *config.ClientConfig) *Client {
 	// Log security status
 	c.logSecurityMode()
 
+	if cfg.InnerEncryption {
+		if pub, err := crypto.ParsePublicKey(cfg.MetadataPublicKey()); err != nil {
+			log.Printf("Invalid metadata_key, streams will fail: %v", err)
+		} else {
+			c.innerKey = pub
+			log.Println("Inner channel: ENCRYPTED end-to-end with the server (Noise IK)")
+		}
+	}
+	if cfg.Camouflage.Carrier == "body" {
+		if pub, err := crypto.ParsePublicKey(cfg.MetadataPublicKey()); err != nil {
+			log.Printf("Invalid metadata_key, streams will fail: %v", err)
+		} else {
+			c.camo.sealTo = pub
+			log.Println("Stream metadata: ENCRYPTED (readable only by the server)")
+		}
+	}
+
+	// Load the client key once so an encrypted key is only unlocked (or
+	// prompted for) at startup, not on every transport reset.
+	if cfg.PrivateKeyPath != "" {
+		priv, err := crypto.LoadPrivateKeyWithPassphrase(cfg.PrivateKeyPath, crypto.PassphraseSource(cfg.PrivateKeyPassphrase, cfg.PrivateKeyPath))
+		if err != nil {
+			log.Printf("Failed to load private key: %v", err)
+		} else {
+			c.privateKey = priv
+			if cfg.InnerEncryption && !crypto.MetadataKeySupported(priv) {
+				log.Printf("private_key is not an Ed25519 key; the inner channel will not identify this client")
+			}
+		}
+	}
+
 	// Initialize the first HTTP client
 	c.httpClient = c.createHTTPClient()
 	return c
@@ -55,7 +96,8 @@ func NewClient(cfg *config.ClientConfig) *Client {
 
 // dialWithFingerprint dials a TLS connection using uTLS to spoof a browser fingerprint.
 // If fingerprint is empty, falls back to standard Go TLS.
-// Always negotiates HTTP/2 (ALPN "h2") regardless of fingerprint mode.
+// Negotiates HTTP/2 (ALPN "h2") regardless of fingerprint mode, unless
+// tlsCfg.NextProtos asks for other protocols.
 func dialWithFingerprint(network, addr string, tlsCfg *tls.Config, fingerprint string) (net.Conn, error) {
 	// Ensure ALPN h2 is set (http2.Transport normally does this, but custom DialTLS bypasses it)
 	if tlsCfg == nil {
@@ -93,8 +135,35 @@ func dialWithFingerprint(network, addr string, tlsCfg *tls.Config, fingerprint s
 	if tlsCfg.RootCAs != nil {
 		utlsCfg.RootCAs = tlsCfg.RootCAs
 	}
+	// Present the mTLS client certificate so pinning and fingerprints can be combined.
+	for _, cert := range tlsCfg.Certificates {
+		utlsCfg.Certificates = append(utlsCfg.Certificates, utls.Certificate{
+			Certificate: cert.Certificate,
+			PrivateKey:  cert.PrivateKey,
+		})
+	}
 
-	uConn := utls.UClient(rawConn, utlsCfg, pickHelloID(fingerprint))
+	helloID := pickHelloID(fingerprint)
+	uConn := utls.UClient(rawConn, utlsCfg, helloID)
+	if !slices.Contains(tlsCfg.NextProtos, "h2") {
+		// Browser hellos offer h2 whatever NextProtos says; a server picking
+		// it would then expect a protocol the caller does not speak.
+		spec, err := utls.UTLSIdToSpec(helloID)
+		if err != nil {
+			rawConn.Close()
+			return nil, err
+		}
+		for _, ext := range spec.Extensions {
+			if alpn, ok := ext.(*utls.ALPNExtension); ok {
+				alpn.AlpnProtocols = tlsCfg.NextProtos
+			}
+		}
+		uConn = utls.UClient(rawConn, utlsCfg, utls.HelloCustom)
+		if err := uConn.ApplyPreset(&spec); err != nil {
+			rawConn.Close()
+			return nil, err
+		}
+	}
 	if err := uConn.Handshake(); err != nil {
 		rawConn.Close()
 		return nil, fmt.Errorf("utls handshake failed: %v", err)
@@ -132,7 +201,8 @@ func pickHelloID(fp string) utls.ClientHelloID {
 
 // createHTTPClient creates a fresh http.Client based on configuration.
 func (c *Client) createHTTPClient() *http.Client {
-	var tr *http2.Transport
+	// tlsConfig stays nil in cleartext mode
+	var tlsConfig *tls.Config
 
 	// dialTarget returns the address to actually dial over TCP.
 	// When DialAddr is set (Android pre-resolved IP workaround), it is used for the TCP
@@ -153,55 +223,54 @@ func (c *Client) createHTTPClient() *http.Client {
 	// System TLS Mode (for CDN like Cloudflare)
 	if c.Config.TLSMode == "system" {
 		log.Println("[Transport] Creating SYSTEM TLS transport (System CA verification)")
-		target := dialTarget()
-		baseTLS := &tls.Config{ServerName: sniHost}
-		tr = &http2.Transport{
-			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
-				return dialWithFingerprint(network, target, baseTLS, c.Config.Fingerprint)
-			},
-			StrictMaxConcurrentStreams: true,
-			ReadIdleTimeout:            0,
-			PingTimeout:                5 * time.Second,
-		}
+		tlsConfig = &tls.Config{ServerName: sniHost}
 	} else if c.Config.TLSMode == "insecure" {
 		// Insecure TLS Mode: HTTPS but skip certificate verification.
 		// Use for direct connections to servers with self-signed TLS certs.
 		log.Println("[Transport] Creating INSECURE TLS transport (cert verification DISABLED)")
-		target := dialTarget()
-		baseTLS := &tls.Config{InsecureSkipVerify: true, ServerName: sniHost} //nolint:gosec
-		tr = &http2.Transport{
-			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
-				return dialWithFingerprint(network, target, baseTLS, c.Config.Fingerprint)
-			},
-			StrictMaxConcurrentStreams: true,
-			ReadIdleTimeout:            0,
-			PingTimeout:                5 * time.Second,
-		}
-	} else if c.Config.PrivateKeyPath != "" || c.Config.ServerPublicKey != "" {
-		// Phoenix Secure Mode (mTLS or One-Way TLS with Ed25519 pinning)
-		log.Println("Creating SECURE transport (TLS)")
+		tlsConfig = &tls.Config{InsecureSkipVerify: true, ServerName: sniHost} //nolint:gosec
+	} else if c.Config.TLSMode == "tofu" {
+		// Trust-On-First-Use: pin whatever key the server presents the first
+		// time, and refuse to connect if it ever changes.
+		knownHosts := crypto.NewKnownHosts(c.Config.KnownHostsPath)
+		log.Printf("[Transport] Creating TOFU TLS transport (known hosts: %s)", knownHosts.Path())
+		tlsConfig = &tls.Config{
+			Certificates:       c.clientCertificates(),
+			InsecureSkipVerify: true, // We use custom verification
+			VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+				if len(rawCerts) == 0 {
+					return errors.New("no server certificate presented")
+				}
+				leaf, err := x509.ParseCertificate(rawCerts[0])
+				if err != nil {
+					return fmt.Errorf("failed to parse server cert: %v", err)
+				}
 
-		var certs []tls.Certificate
-		if c.Config.PrivateKeyPath != "" {
-			priv, err := crypto.LoadPrivateKey(c.Config.PrivateKeyPath)
-			if err != nil {
-				log.Printf("Failed to load private key: %v", err) // Should we panic? Maybe just log here to allow retry
-			} else {
-				cert, err := crypto.GenerateTLSCertificate(priv)
+				firstUse, err := knownHosts.Verify(c.Config.RemoteAddr, leaf.PublicKey)
 				if err != nil {
-					log.Printf("Failed to generate TLS cert: %v", err)
-				} else {
-					certs = []tls.Certificate{cert}
+					var changed *crypto.HostKeyChangedError
+					if errors.As(err, &changed) {
+						return fmt.Errorf("%v (or run with -retrust)", err)
+					}
+					return err
 				}
-			}
+				if firstUse {
+					pin, _ := crypto.SPKIPin(leaf.PublicKey)
+					log.Printf("TOFU: trusting new server key for %s: %s", c.Config.RemoteAddr, pin)
+				}
+				return nil
+			},
 		}
+	} else if c.Config.PrivateKeyPath != "" || c.Config.HasServerKeys() {
+		// Phoenix Secure Mode (mTLS or One-Way TLS with key pinning)
+		log.Println("Creating SECURE transport (TLS)")
 
-		tlsConfig := &tls.Config{
-			Certificates:       certs,
+		tlsConfig = &tls.Config{
+			Certificates:       c.clientCertificates(),
 			InsecureSkipVerify: true, // We use custom verification
 			VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-				if c.Config.ServerPublicKey == "" {
-					log.Println("WARNING: server_public_key NOT SET. Connection vulnerable to MITM.")
+				if !c.Config.HasServerKeys() {
+					log.Println("WARNING: server_public_key NOT SET. Connection vulnerable to MITM. Set it, or use tls_mode = \"tofu\".")
 					return nil
 				}
 
@@ -213,53 +282,66 @@ func (c *Client) createHTTPClient() *http.Client {
 					return fmt.Errorf("failed to parse server cert: %v", err)
 				}
 
-				pub := leaf.PublicKey
-				pubBytes, ok := pub.(ed25519.PublicKey)
-				if !ok {
-					return errors.New("server key is not Ed25519")
+				// Any key that is valid right now is accepted, so the server
+				// can roll over to a new key without cutting clients off.
+				accepted := c.Config.AcceptedServerKeys(time.Now())
+				for _, pin := range accepted {
+					if crypto.MatchPin(pin, leaf.PublicKey) {
+						return nil
+					}
 				}
-
-				pubStr := base64.StdEncoding.EncodeToString(pubBytes)
-				if pubStr != c.Config.ServerPublicKey {
-					return fmt.Errorf("server key verification failed. Expected %s, Got %s", c.Config.ServerPublicKey, pubStr)
+				if len(accepted) == 0 {
+					return errors.New("server key verification failed: no configured server key is valid at the current time")
 				}
-				return nil
-			},
-		}
-
-		target := dialTarget()
-		tr = &http2.Transport{
-			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
-				return dialWithFingerprint(network, target, tlsConfig, c.Config.Fingerprint)
+				got, _ := crypto.SPKIPin(leaf.PublicKey)
+				return fmt.Errorf("server key verification failed. Expected one of %v, Got %s", accepted, got)
 			},
-			StrictMaxConcurrentStreams: true,
-			ReadIdleTimeout:            0,
-			PingTimeout:                5 * time.Second,
 		}
-
 	} else {
 		// CLEARTEXT MODE (h2c)
 		log.Println("[Transport] Creating CLEARTEXT transport (h2c)")
-		target := dialTarget()
-		tr = &http2.Transport{
-			AllowHTTP: true,
-			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
-				return net.Dial(network, target)
-			},
-			StrictMaxConcurrentStreams: true,
-			ReadIdleTimeout:            0,
-			PingTimeout:                5 * time.Second,
-		}
 	}
 
+	target := dialTarget()
+	if c.Config.Transport == "websocket" {
+		return &http.Client{Transport: webSocketTransport(target, tlsConfig, c.Config.Fingerprint)}
+	}
+	tr := &http2.Transport{
+		AllowHTTP: tlsConfig == nil,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			if tlsConfig == nil {
+				return net.Dial(network, target)
+			}
+			return dialWithFingerprint(network, target, tlsConfig, c.Config.Fingerprint)
+		},
+		StrictMaxConcurrentStreams: true,
+		ReadIdleTimeout:            0,
+		PingTimeout:                5 * time.Second,
+	}
 	return &http.Client{Transport: tr}
 }
 
+// clientCertificates returns the mTLS client certificate, if a key is loaded.
+func (c *Client) clientCertificates() []tls.Certificate {
+	if c.privateKey == nil {
+		return nil
+	}
+	cert, err := crypto.GenerateTLSCertificate(c.privateKey)
+	if err != nil {
+		log.Printf("Failed to generate TLS cert: %v", err)
+		return nil
+	}
+	return []tls.Certificate{cert}
+}
+
 // logSecurityMode prints a human-readable security status at startup.
+// Secrets such as the auth token are only reported as set or unset.
 func (c *Client) logSecurityMode() {
 	cfg := c.Config
 	tokenStatus := "disabled"
-	if cfg.AuthToken != "" {
+	if cfg.AuthToken != "" && cfg.AuthMode == "hmac" {
+		tokenStatus = "ENABLED (HMAC)"
+	} else if cfg.AuthToken != "" {
 		tokenStatus = "ENABLED"
 	}
 
@@ -269,10 +351,12 @@ func (c *Client) logSecurityMode() {
 	}
 
 	switch {
-	case cfg.PrivateKeyPath != "" && len(cfg.ServerPublicKey) > 0:
-		log.Printf("Security Mode: mTLS (Ed25519 key pinning) | Token Auth: %s | Fingerprint: %s", tokenStatus, fpStatus)
-	case cfg.PrivateKeyPath != "" || cfg.ServerPublicKey != "":
-		log.Printf("Security Mode: ONE-WAY TLS (Ed25519 key pinning) | Token Auth: %s | Fingerprint: %s", tokenStatus, fpStatus)
+	case cfg.TLSMode == "tofu":
+		log.Printf("Security Mode: TOFU TLS (key pinned on first use) | Token Auth: %s | Fingerprint: %s", tokenStatus, fpStatus)
+	case cfg.PrivateKeyPath != "" && cfg.HasServerKeys():
+		log.Printf("Security Mode: mTLS (key pinning) | Token Auth: %s | Fingerprint: %s", tokenStatus, fpStatus)
+	case cfg.PrivateKeyPath != "" || cfg.HasServerKeys():
+		log.Printf("Security Mode: ONE-WAY TLS (key pinning) | Token Auth: %s | Fingerprint: %s", tokenStatus, fpStatus)
 	case cfg.TLSMode == "system":
 		log.Printf("Security Mode: SYSTEM TLS (System CA — use with CDN/Cloudflare) | Token Auth: %s | Fingerprint: %s", tokenStatus, fpStatus)
 	case cfg.TLSMode == "insecure":
@@ -285,6 +369,13 @@ func (c *Client) logSecurityMode() {
 // Dial initiates a tunnel for a specific protocol.
 // It connects to the server and returns the stream to be used by the local listener.
 func (c *Client) Dial(proto protocol.ProtocolType, target string) (io.ReadWriteCloser, error) {
+	switch c.Config.Transport {
+	case "websocket", "websocket-h2":
+		return c.dialWebSocket(proto, target)
+	case "split":
+		return c.dialSplit(proto, target)
+	}
+
 	// Get current HTTP client (Read Lock)
 	c.mu.RLock()
 	client := c.httpClient
@@ -293,20 +384,89 @@ func (c *Client) Dial(proto protocol.ProtocolType, target string) (io.ReadWriteC
 	// We use io.Pipe to bridge the local connection to the request body.
 	pr, pw := io.Pipe()
 
-	req, err := http.NewRequest("POST", c.Scheme+"://"+c.Config.RemoteAddr, pr)
+	meta, err := c.streamMeta(proto, target, c.camo.cfg.Method)
+	if err != nil {
+		return nil, err
+	}
+
+	// The inner handshake's first message goes ahead of the stream data.
+	var body io.Reader = pr
+	inner, msg, err := c.newInner()
+	if err != nil {
+		return nil, err
+	}
+	if inner != nil {
+		body = io.MultiReader(bytes.NewReader(innerFrame(msg)), pr)
+	}
+
+	req, err := c.camo.newRequest(c.Scheme+"://"+c.Config.RemoteAddr, body, meta)
 	if err != nil {
 		return nil, err
 	}
 
-	// Set headers
-	req.Header.Set("X-Nerve-Protocol", string(proto))
-	if target != "" {
-		req.Header.Set("X-Nerve-Target", target)
+	resp, err := c.roundTrip(client, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkResponse(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	var stream io.ReadWriteCloser = &Stream{
+		Writer: pw,
+		Reader: resp.Body,
+		Closer: resp.Body,
 	}
+	if inner != nil {
+		return openInner(inner, stream)
+	}
+	return stream, nil
+}
+
+// streamMeta returns the metadata for a stream request made with method.
+func (c *Client) streamMeta(proto protocol.ProtocolType, target, method string) (streamMeta, error) {
+	// Stream metadata, encoded as configured in [camouflage]
+	meta := streamMeta{Protocol: string(proto), Target: target}
 	if c.Config.AuthToken != "" {
-		req.Header.Set("X-Nerve-Token", c.Config.AuthToken)
+		if c.Config.AuthMode == "hmac" {
+			if err := signStream(&meta, c.Config.AuthToken, method, time.Now()); err != nil {
+				return meta, err
+			}
+		} else {
+			meta.Token = c.Config.AuthToken
+		}
+	}
+	return meta, nil
+}
+
+// newInner starts the inner channel handshake, returning its first message.
+// It returns a nil client when inner_encryption is off.
+func (c *Client) newInner() (*crypto.InnerClient, []byte, error) {
+	if !c.Config.InnerEncryption {
+		return nil, nil, nil
+	}
+	if c.innerKey == nil {
+		return nil, nil, fmt.Errorf("inner_encryption requires the server's metadata_key")
+	}
+	return crypto.NewInnerClient(c.innerKey, c.privateKey)
+}
+
+// openInner finishes the inner channel handshake with the server's reply at
+// the start of stream, and returns the channel. stream is closed on failure.
+func openInner(inner *crypto.InnerClient, stream io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	msg, err := readInnerFrame(stream)
+	if err == nil {
+		var ciphers *crypto.InnerCiphers
+		if ciphers, err = inner.Finish(msg); err == nil {
+			return newInnerConn(stream, stream, ciphers, stream), nil
+		}
 	}
+	stream.Close()
+	return nil, fmt.Errorf("inner channel: %v", err)
+}
 
+// roundTrip sends a stream request, giving up if the server does not answer
+// in time. Failures count towards a reset of the HTTP client.
+func (c *Client) roundTrip(client *http.Client, req *http.Request) (*http.Response, error) {
 	respChan := make(chan *http.Response, 1)
 	errChan := make(chan error, 1)
 
@@ -324,16 +484,7 @@ func (c *Client) Dial(proto protocol.ProtocolType, target string) (io.ReadWriteC
 	case resp := <-respChan:
 		// Connection Successful
 		atomic.StoreUint32(&c.failureCount, 0) // Reset failure count
-
-		if resp.StatusCode != http.StatusOK {
-			resp.Body.Close()
-			return nil, fmt.Errorf("server rejected connection with status: %d", resp.StatusCode)
-		}
-		return &Stream{
-			Writer: pw,
-			Reader: resp.Body,
-			Closer: resp.Body,
-		}, nil
+		return resp, nil
 
 	case err := <-errChan:
 		c.handleConnectionFailure(err)
@@ -346,6 +497,65 @@ func (c *Client) Dial(proto protocol.ProtocolType, target string) (io.ReadWriteC
 	}
 }
 
+// checkResponse records the quota the server reported and turns any status
+// other than want into an error, closing the response.
+func (c *Client) checkResponse(resp *http.Response, want int) error {
+	if v := resp.Header.Get("X-Nerve-Quota-Remaining"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			atomic.StoreInt64(&c.quotaRemaining, n)
+		}
+	}
+	if resp.StatusCode == want {
+		return nil
+	}
+	resp.Body.Close()
+	if retry := resp.Header.Get("Retry-After"); retry != "" {
+		// Admission control: the server or this account is at a stream limit.
+		return fmt.Errorf("server busy (status %d), retry after %ss", resp.StatusCode, retry)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("server rejected connection: traffic quota exhausted")
+	}
+	return fmt.Errorf("server rejected connection with status: %d", resp.StatusCode)
+}
+
+// QuotaRemaining returns the traffic quota left in bytes as last reported by
+// the server, or -1 if the server has not reported a quota.
+func (c *Client) QuotaRemaining() int64 {
+	return atomic.LoadInt64(&c.quotaRemaining)
+}
+
+// Enroll registers the client's key with the server using a one-time
+// enrollment code, returning the label the server recorded it under.
+// The key is proved by the TLS handshake, so private_key must be set.
+func (c *Client) Enroll(code, label string) (string, error) {
+	if c.privateKey == nil {
+		return "", fmt.Errorf("enrollment requires a client key (set private_key, generated with -gen-keys)")
+	}
+
+	c.mu.RLock()
+	client := c.httpClient
+	c.mu.RUnlock()
+
+	meta := streamMeta{Protocol: string(protocol.ProtocolEnroll), EnrollCode: code, EnrollLabel: label}
+	req, err := c.camo.newRequest(c.Scheme+"://"+c.Config.RemoteAddr, nil, meta)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("server rejected enrollment with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
 // handleConnectionFailure increments failure count and triggers Hard Reset if needed.
 func (c *Client) handleConnectionFailure(err error) {
 	newCount := atomic.AddUint32(&c.failureCount, 1)
@@ -0,0 +1,267 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"phoenix/pkg/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a new connection may take to send its
+// PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// clientIPResolver finds the real client address of a request.
+type clientIPResolver struct {
+	header  string
+	trusted []netip.Prefix
+}
+
+func newClientIPResolver(cfg config.ServerClientIP) (*clientIPResolver, error) {
+	trusted, err := cfg.TrustedPrefixes()
+	if err != nil {
+		return nil, err
+	}
+	return &clientIPResolver{header: cfg.Header, trusted: trusted}, nil
+}
+
+// trusts reports whether peer may tell us the client address. With no
+// trusted proxies, no peer is trusted (config validation requires them).
+func (c *clientIPResolver) trusts(peer netip.Addr) bool {
+	for _, p := range c.trusted {
+		if p.Contains(peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the client address of r: the configured header when the
+// peer is a trusted proxy, otherwise the address of the connection (which
+// already reflects a PROXY protocol header).
+func (c *clientIPResolver) clientIP(r *http.Request) netip.Addr {
+	peer := addrOf(r.RemoteAddr)
+	if c == nil || c.header == "" || !peer.IsValid() || !c.trusts(peer) {
+		return peer
+	}
+	v := r.Header.Get(c.header)
+	if i := strings.LastIndexByte(v, ','); i >= 0 {
+		// X-Forwarded-For: the last entry was added by the nearest proxy.
+		v = v[i+1:]
+	}
+	if a := addrOf(strings.TrimSpace(v)); a.IsValid() {
+		return a
+	}
+	return peer
+}
+
+// addrOf parses an address with or without a port.
+func addrOf(s string) netip.Addr {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap()
+	}
+	a, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return a.Unmap()
+}
+
+// proxyListener reads a PROXY protocol header from each accepted connection
+// and reports the address it carries as the connection's remote address.
+// Headers are read in the background so a slow client cannot stall Accept.
+type proxyListener struct {
+	net.Listener
+	resolver *clientIPResolver
+
+	conns     chan net.Conn
+	errs      chan error
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newProxyListener(ln net.Listener, resolver *clientIPResolver) *proxyListener {
+	l := &proxyListener{
+		Listener: ln,
+		resolver: resolver,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *proxyListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			select {
+			case l.errs <- err:
+			case <-l.done:
+			}
+			return
+		}
+		go func() {
+			pc, err := l.readHeader(conn)
+			if err != nil {
+				log.Printf("Dropped connection from %s: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			select {
+			case l.conns <- pc:
+			case <-l.done:
+				pc.Close()
+			}
+		}()
+	}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *proxyListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// readHeader consumes the PROXY header of a connection from a trusted proxy.
+// Connections from other peers are passed through unchanged.
+func (l *proxyListener) readHeader(conn net.Conn) (net.Conn, error) {
+	if !l.resolver.trusts(addrOf(conn.RemoteAddr().String())) {
+		return conn, nil
+	}
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	br := bufio.NewReaderSize(conn, 256)
+	src, err := readProxyHeader(br)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol header: %w", err)
+	}
+	return &proxyConn{Conn: conn, r: br, remote: src}, nil
+}
+
+// readProxyHeader parses a v1 or v2 PROXY header and returns the source
+// address, or nil when the header does not carry one (LOCAL, UNKNOWN).
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	sig, err := br.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(br)
+	}
+	if !bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return nil, errors.New("missing header")
+	}
+	return readProxyV1(br)
+}
+
+// readProxyV1 parses "PROXY TCP4 <src> <dst> <sport> <dport>\r\n".
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errors.New("v1 header too long")
+	}
+	f := strings.Split(s, " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", s)
+	}
+	ap, err := netip.ParseAddrPort(net.JoinHostPort(f[2], f[4]))
+	if err != nil {
+		return nil, fmt.Errorf("malformed v1 source address: %v", err)
+	}
+	return net.TCPAddrFromAddrPort(ap), nil
+}
+
+// readProxyV2 parses the binary v2 header.
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+	if hdr[12]&0x0f == 0 {
+		// LOCAL: a health check from the proxy itself.
+		return nil, nil
+	}
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, errors.New("short v2 IPv4 address block")
+		}
+		ip, _ := netip.AddrFromSlice(body[0:4])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[8:10]))), nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("short v2 IPv6 address block")
+		}
+		ip, _ := netip.AddrFromSlice(body[0:16])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip.Unmap(), binary.BigEndian.Uint16(body[32:34]))), nil
+	default:
+		return nil, nil
+	}
+}
+
+// proxyConn is a connection whose remote address came from a PROXY header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
@@ -0,0 +1,98 @@
+package transport
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"phoenix/pkg/config"
+	"strings"
+	"time"
+)
+
+// decoyMinDelay is the least time between a request arriving and its decoy
+// answer. Streams rejected after checking their credentials, metadata or
+// inner handshake get the decoy later than plain probes would; waiting out
+// the same minimum for every decoy answer hides that work. It is well above
+// what the checks take.
+const decoyMinDelay = 10 * time.Millisecond
+
+// arrivalKey is the request context key of the time a request arrived.
+type arrivalKey struct{}
+
+// withArrival records in r's context that it arrived at t.
+func withArrival(r *http.Request, t time.Time) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), arrivalKey{}, t))
+}
+
+// waitDecoyDelay waits until decoyMinDelay after r arrived.
+func waitDecoyDelay(r *http.Request) {
+	arrived, ok := r.Context().Value(arrivalKey{}).(time.Time)
+	if !ok {
+		return
+	}
+	if d := time.Until(arrived.Add(decoyMinDelay)); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-r.Context().Done():
+		}
+	}
+}
+
+// newDecoyHandler returns the handler for the configured decoy site, or nil.
+// Stream metadata, as encoded by camo, is removed from decoy requests.
+func newDecoyHandler(cfg config.ServerDecoy, camo *camouflage) (http.Handler, error) {
+	switch {
+	case cfg.StaticDir != "":
+		return stripMetadata(staticSite(http.FileServer(http.Dir(cfg.StaticDir))), camo), nil
+	case cfg.Upstream != "":
+		upstream, err := url.Parse(cfg.Upstream)
+		if err != nil {
+			return nil, err
+		}
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(upstream)
+				pr.Out.Host = upstream.Host
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				log.Printf("Decoy upstream %s failed: %v", upstream.Host, err)
+				http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			},
+		}
+		return stripMetadata(proxy, camo), nil
+	default:
+		return nil, nil
+	}
+}
+
+// stripMetadata removes the stream metadata, so tokens never reach the decoy
+// upstream, and drops X-Nerve headers already set on the response.
+func stripMetadata(h http.Handler, camo *camouflage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		camo.strip(r)
+		for k := range w.Header() {
+			if strings.HasPrefix(k, "X-Nerve-") || k == "Retry-After" {
+				w.Header().Del(k)
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// staticSite answers only GET and HEAD with files, like a static web server;
+// other methods, the stream method among them, get 405 Method Not Allowed
+// as from serveDecoy without a decoy.
+func staticSite(files http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
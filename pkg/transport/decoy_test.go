@@ -0,0 +1,92 @@
+package transport
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"phoenix/pkg/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecoy(t *testing.T) {
+	var seen http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Clone()
+		io.WriteString(w, "decoy page")
+	}))
+	defer upstream.Close()
+
+	cfg := &config.ServerConfig{}
+	cfg.Security.AuthToken = "good-token"
+	cfg.Decoy.Upstream = upstream.URL
+	cfg.Bans.MaxFailures = 2
+	srv := NewServer(cfg)
+	var err error
+	if srv.decoy, err = newDecoyHandler(cfg.Decoy, srv.camo); err != nil {
+		t.Fatal(err)
+	}
+	if srv.bans, err = newBanList(cfg.Bans); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := func(token, addr string) *httptest.ResponseRecorder {
+		req, _ := srv.camo.newRequest("http://example.org", strings.NewReader(""), streamMeta{Protocol: "socks5", Token: token})
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		srv.ServeHTTP(rec, req)
+		if rec.Body.String() == "decoy page" && time.Since(start) < decoyMinDelay {
+			t.Errorf("Decoy answered after %v, before decoyMinDelay", time.Since(start))
+		}
+		return rec
+	}
+
+	// A client that proved who it is learns why it was refused (SOCKS5 is
+	// not enabled); a bad token gets the decoy, with the metadata removed.
+	if rec := stream("good-token", "192.0.2.1:1000"); rec.Code != http.StatusForbidden || rec.Body.String() == "decoy page" {
+		t.Errorf("Authenticated refusal answered %d %q", rec.Code, rec.Body)
+	}
+	seen = nil
+	if rec := stream("bad-token", "192.0.2.2:1000"); rec.Body.String() != "decoy page" {
+		t.Errorf("Bad token answered %d %q", rec.Code, rec.Body)
+	}
+	if seen == nil {
+		t.Fatal("The decoy upstream got no request")
+	}
+	for k, v := range seen {
+		if strings.Contains(strings.Join(v, " "), "bad-token") || strings.EqualFold(k, srv.camo.cfg.Keys.Protocol) {
+			t.Errorf("Metadata reached the decoy upstream: %s: %v", k, v)
+		}
+	}
+
+	// Once banned, even the right token gets the decoy.
+	stream("bad-token", "192.0.2.2:1001")
+	if rec := stream("good-token", "192.0.2.2:1002"); rec.Body.String() != "decoy page" {
+		t.Errorf("Banned client answered %d %q", rec.Code, rec.Body)
+	}
+}
+
+func TestStaticDecoy(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("hello"), 0644)
+	h, err := newDecoyHandler(config.ServerDecoy{StaticDir: dir}, newCamouflage(config.Camouflage{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, "/", strings.NewReader("x")))
+		if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, HEAD" {
+			t.Errorf("%s answered %d, Allow %q", method, rec.Code, rec.Header().Get("Allow"))
+		}
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "hello") {
+		t.Errorf("GET answered %d %q", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,177 @@
+package transport
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"phoenix/pkg/config"
+	"phoenix/pkg/crypto"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxEnrollLabelLen bounds the label a client may propose for itself.
+const maxEnrollLabelLen = 64
+
+// enrollLabelChars are the characters kept from a proposed label.
+var enrollLabelChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// enroller redeems one-time enrollment codes, adding the key the client
+// presented in the TLS handshake to the authorized clients file.
+type enroller struct {
+	secret   []byte
+	usedPath string
+	cfg      config.ServerEnrollment
+	keys     *clientKeyStore
+	keysFile string
+
+	// failed is called with each request that presents an invalid code.
+	failed func(r *http.Request)
+
+	mu   sync.Mutex
+	used map[string]time.Time // code ID → code expiry
+}
+
+func newEnroller(cfg *config.ServerConfig, keys *clientKeyStore) (*enroller, error) {
+	e := &enroller{
+		secret:   []byte(cfg.Enrollment.Secret),
+		usedPath: cfg.UsedEnrollmentCodesFile(),
+		cfg:      cfg.Enrollment,
+		keys:     keys,
+		keysFile: cfg.Security.AuthorizedClientsFile,
+		used:     make(map[string]time.Time),
+	}
+	if err := e.loadUsed(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// serve handles an enrollment request. The client's new key is the one it
+// authenticated with in the TLS handshake, which proves it holds the
+// private key; the code comes in the enrollment code metadata field.
+func (e *enroller) serve(w http.ResponseWriter, r *http.Request, m streamMeta) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		http.Error(w, "Client Certificate Required", http.StatusBadRequest)
+		return
+	}
+	pin, err := peerPin(*r.TLS)
+	if err != nil {
+		http.Error(w, "Unsupported Client Key", http.StatusBadRequest)
+		return
+	}
+	if c, err := e.keys.lookup(pin); err == nil {
+		fmt.Fprintln(w, c.label)
+		return
+	}
+
+	id, expires, err := crypto.ParseEnrollmentCode(e.secret, m.EnrollCode, time.Now())
+	if err != nil {
+		log.Printf("Rejected enrollment from %s: %v", r.RemoteAddr, err)
+		if e.failed != nil {
+			e.failed(r)
+		}
+		http.Error(w, "Invalid Enrollment Code", http.StatusForbidden)
+		return
+	}
+
+	label, err := e.redeem(id, expires, pin, m.EnrollLabel)
+	if err != nil {
+		log.Printf("Rejected enrollment from %s: %v", r.RemoteAddr, err)
+		if e.failed != nil {
+			e.failed(r)
+		}
+		http.Error(w, "Invalid Enrollment Code", http.StatusForbidden)
+		return
+	}
+
+	log.Printf("Enrolled client key %s from %s [%s]", pin, r.RemoteAddr, label)
+	fmt.Fprintln(w, label)
+}
+
+// redeem marks the code as used and authorizes pin. The code is recorded
+// before the key is added, so a crash in between cannot allow a second use.
+func (e *enroller) redeem(id string, expires time.Time, pin, proposed string) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.used[id]; ok {
+		return "", fmt.Errorf("enrollment code already used")
+	}
+	e.used[id] = expires
+	if err := e.saveUsed(); err != nil {
+		return "", fmt.Errorf("failed to record used enrollment code: %v", err)
+	}
+
+	label := e.keys.uniqueLabel(enrollLabel(proposed, pin))
+	entry := config.AuthorizedClient{Key: pin, Label: label, Protocols: e.cfg.Protocols}
+	if err := config.AppendAuthorizedClient(e.keysFile, entry); err != nil {
+		return "", fmt.Errorf("failed to update %s: %v", e.keysFile, err)
+	}
+	// Apply now rather than waiting for the file watcher.
+	if err := e.keys.reload(); err != nil {
+		return "", err
+	}
+	return label, nil
+}
+
+// enrollLabel sanitizes the label proposed by a client, falling back to the key pin.
+func enrollLabel(proposed, pin string) string {
+	label := strings.Trim(enrollLabelChars.ReplaceAllString(proposed, "-"), "-")
+	if len(label) > maxEnrollLabelLen {
+		label = label[:maxEnrollLabelLen]
+	}
+	if label == "" {
+		label = "enrolled-" + strings.NewReplacer("/", "", "+", "").Replace(strings.TrimPrefix(shortPin(pin), crypto.SPKIPinPrefix))
+	}
+	return label
+}
+
+// loadUsed reads the used-codes file ("<id> <expiry unix>" per line).
+func (e *enroller) loadUsed() error {
+	f, err := os.Open(e.usedPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read used enrollment codes: %w", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if exp, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			e.used[fields[0]] = time.Unix(exp, 0)
+		}
+	}
+	return sc.Err()
+}
+
+// saveUsed rewrites the used-codes file, dropping codes that have expired
+// since they can no longer be redeemed anyway.
+func (e *enroller) saveUsed() error {
+	var b strings.Builder
+	now := time.Now()
+	for id, exp := range e.used {
+		if now.After(exp) {
+			delete(e.used, id)
+			continue
+		}
+		fmt.Fprintf(&b, "%s %d\n", id, exp.Unix())
+	}
+
+	tmp := e.usedPath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.usedPath)
+}
@@ -0,0 +1,136 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"phoenix/pkg/crypto"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Inner channel framing: every Noise message, handshake or data, is sent as
+//
+//	length (uint16, big endian) || message
+//
+// A data message with no plaintext closes the channel, so that the end of
+// the outer stream cannot be mistaken for the end of the data: a stream cut
+// short without it reads as io.ErrUnexpectedEOF. See crypto.NewInnerClient
+// for the handshake.
+const maxInnerPlaintext = crypto.InnerMaxMessage - chacha20poly1305.Overhead
+
+// innerFrame prefixes msg with its length.
+func innerFrame(msg []byte) []byte {
+	out := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(out, uint16(len(msg)))
+	return append(out, msg...)
+}
+
+// readInnerFrame reads one framed message.
+func readInnerFrame(r io.Reader) ([]byte, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
+
+// innerConn is an established inner channel over a stream.
+type innerConn struct {
+	r       io.Reader
+	w       io.Writer
+	closers []io.Closer
+	ciphers *crypto.InnerCiphers
+
+	rmu  sync.Mutex
+	rbuf []byte // decrypted data not yet returned by Read
+	eof  bool   // the close message arrived
+
+	wmu       sync.Mutex
+	closeOnce sync.Once
+}
+
+func newInnerConn(r io.Reader, w io.Writer, ciphers *crypto.InnerCiphers, closers ...io.Closer) *innerConn {
+	return &innerConn{r: r, w: w, ciphers: ciphers, closers: closers}
+}
+
+func (c *innerConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.rbuf) == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		msg, err := readInnerFrame(c.r)
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		if c.rbuf, err = c.ciphers.Recv.Decrypt(msg[:0], nil, msg); err != nil {
+			return 0, errors.New("inner channel: message failed authentication")
+		}
+		c.eof = len(c.rbuf) == 0
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *innerConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxInnerPlaintext {
+			chunk = chunk[:maxInnerPlaintext]
+		}
+		if err := c.writeMessage(chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// writeMessage encrypts and sends one message; c.wmu must be held.
+func (c *innerConn) writeMessage(plaintext []byte) error {
+	frame := make([]byte, 2, 2+len(plaintext)+chacha20poly1305.Overhead)
+	frame, err := c.ciphers.Send.Encrypt(frame, nil, plaintext)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(frame, uint16(len(frame)-2))
+	_, err = c.w.Write(frame)
+	return err
+}
+
+// Close sends the close message and closes the outer stream. A Write that
+// is blocked holds up no Close: the stream is then closed without the
+// message, which unblocks the Write, and the peer sees the data cut short.
+func (c *innerConn) Close() error {
+	c.closeOnce.Do(func() {
+		if c.wmu.TryLock() {
+			c.writeMessage(nil)
+			c.wmu.Unlock()
+		}
+	})
+	var first error
+	for _, cl := range c.closers {
+		if err := cl.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,91 @@
+package transport
+
+import (
+	"bytes"
+	stdcrypto "crypto"
+	"crypto/ed25519"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"phoenix/pkg/config"
+	"phoenix/pkg/crypto"
+	"strings"
+	"testing"
+)
+
+// innerPair returns the client and server ciphers of a fresh inner channel.
+func innerPair(t *testing.T) (*crypto.InnerCiphers, *crypto.InnerCiphers) {
+	t.Helper()
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	client, msg, err := crypto.NewInnerClient(pub, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, srv, _, err := crypto.AcceptInner([]stdcrypto.PrivateKey{priv}, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := client.Finish(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cli, srv
+}
+
+func TestInnerConnClose(t *testing.T) {
+	cli, srv := innerPair(t)
+	var wire bytes.Buffer
+	sender := newInnerConn(nil, &wire, cli)
+	sender.Write([]byte("hello"))
+	sender.Close()
+	sent := wire.Bytes()
+
+	got, err := io.ReadAll(newInnerConn(bytes.NewReader(sent), nil, srv))
+	if err != nil || string(got) != "hello" {
+		t.Errorf("Read %q, %v after a close message", got, err)
+	}
+
+	// The same stream cut off before the close message is not a clean end.
+	cli, srv = innerPair(t)
+	wire.Reset()
+	newInnerConn(nil, &wire, cli).Write([]byte("hello"))
+	got, err = io.ReadAll(newInnerConn(bytes.NewReader(wire.Bytes()), nil, srv))
+	if err != io.ErrUnexpectedEOF || string(got) != "hello" {
+		t.Errorf("Read %q, %v without a close message, want io.ErrUnexpectedEOF", got, err)
+	}
+}
+
+func TestInnerProbeBody(t *testing.T) {
+	// A POST with stream metadata but no handshake in its body is a probe:
+	// the decoy gets it with the body untouched, and it is no failed login.
+	var seen []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = io.ReadAll(r.Body)
+	}))
+	defer upstream.Close()
+
+	cfg := &config.ServerConfig{}
+	cfg.Decoy.Upstream = upstream.URL
+	cfg.Bans.MaxFailures = 1
+	srv := NewServer(cfg)
+	_, priv, _ := ed25519.GenerateKey(nil)
+	srv.innerKeys = []stdcrypto.PrivateKey{priv}
+	var err error
+	if srv.decoy, err = newDecoyHandler(cfg.Decoy, srv.camo); err != nil {
+		t.Fatal(err)
+	}
+	if srv.bans, err = newBanList(cfg.Bans); err != nil {
+		t.Fatal(err)
+	}
+
+	body := "\x00\x05hello, this is no handshake"
+	req, _ := srv.camo.newRequest("http://example.org", strings.NewReader(body), streamMeta{Protocol: "socks5"})
+	req.RemoteAddr = "192.0.2.1:1000"
+	srv.ServeHTTP(httptest.NewRecorder(), req)
+	if string(seen) != body {
+		t.Errorf("Decoy got body %q, want %q", seen, body)
+	}
+	if len(srv.bans.failures) != 0 || len(srv.bans.bans) != 0 {
+		t.Error("A probe was counted as an authentication failure")
+	}
+}
@@ -0,0 +1,263 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"phoenix/pkg/adapter/socks5"
+	"phoenix/pkg/config"
+	"phoenix/pkg/protocol"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// limitRetryAfter is the Retry-After hint, in seconds, sent with a refused stream.
+const limitRetryAfter = "5"
+
+// memorySampleInterval is how often memory use is compared with the budget.
+const memorySampleInterval = time.Second
+
+// streamKind classifies a stream by the server resources it holds.
+type streamKind int
+
+const (
+	kindOutbound streamKind = iota // an outbound TCP connection
+	kindUDP                        // a UDP socket
+)
+
+func (k streamKind) String() string {
+	if k == kindUDP {
+		return "UDP sessions"
+	}
+	return "outbound connections"
+}
+
+// streamKindFor returns the kind of stream the request opens.
+func streamKindFor(proto, target string) streamKind {
+	if target == "" && protocol.ProtocolType(proto) == protocol.ProtocolSOCKS5UDP {
+		return kindUDP
+	}
+	return kindOutbound
+}
+
+// limitUsage counts the open streams of one scope.
+type limitUsage struct {
+	streams int
+	kinds   [2]int
+}
+
+// errLimitReached is returned by admit when a stream is refused.
+type errLimitReached struct {
+	status int
+	reason string
+}
+
+func (e *errLimitReached) Error() string { return e.reason }
+
+// admission enforces [limits]: it counts open streams globally and per user
+// and refuses new ones once a cap or the memory budget is reached.
+type admission struct {
+	cfg    config.ServerLimits
+	budget uint64
+
+	mu     sync.Mutex
+	global limitUsage
+	users  map[string]*limitUsage
+
+	memInUse atomic.Uint64
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newAdmission(cfg config.ServerLimits) *admission {
+	a := &admission{cfg: cfg, users: make(map[string]*limitUsage), stop: make(chan struct{})}
+	if cfg.MemoryBudget != "" {
+		budget, err := config.ParseByteSize(cfg.MemoryBudget)
+		if err != nil {
+			// Rejected when the config was loaded.
+			log.Printf("Ignoring invalid memory budget: %v", err)
+			return a
+		}
+		a.budget = uint64(budget)
+	}
+	return a
+}
+
+// start applies the memory budget to the process and samples memory use
+// until close. It is called when the server starts, not when it is created.
+func (a *admission) start() {
+	if a.budget == 0 {
+		return
+	}
+	// Let the garbage collector work harder before the budget is hit.
+	debug.SetMemoryLimit(int64(a.budget))
+	a.sampleMemory()
+	go func() {
+		ticker := time.NewTicker(memorySampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.sampleMemory()
+			case <-a.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close stops sampling memory use.
+func (a *admission) close() {
+	a.stopOnce.Do(func() { close(a.stop) })
+}
+
+// sampleMemory records the memory obtained from the OS and not yet returned.
+func (a *admission) sampleMemory() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	a.memInUse.Store(m.Sys - m.HeapReleased)
+}
+
+// admit reserves a stream of kind for user (empty for anonymous streams,
+// which only count against the global limits). The returned func releases it.
+func (a *admission) admit(user string, kind streamKind) (func(), error) {
+	return a.reserve(user, kind, true)
+}
+
+// admitNested reserves a resource of kind that a stream already admitted
+// opens itself, such as a UDP ASSOCIATE inside a SOCKS5 stream. It counts
+// against the limits on kind but not as another stream.
+func (a *admission) admitNested(user string, kind streamKind) (func(), error) {
+	return a.reserve(user, kind, false)
+}
+
+func (a *admission) reserve(user string, kind streamKind, stream bool) (func(), error) {
+	if a.budget > 0 {
+		if used := a.memInUse.Load(); used > a.budget {
+			return nil, &errLimitReached{http.StatusServiceUnavailable,
+				fmt.Sprintf("memory budget exceeded (%d MiB in use)", used>>20)}
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if stream && over(a.global.streams, a.cfg.MaxStreams) {
+		return nil, &errLimitReached{http.StatusServiceUnavailable, "server stream limit reached"}
+	}
+	if over(a.global.kinds[kind], a.globalKindLimit(kind)) {
+		return nil, &errLimitReached{http.StatusServiceUnavailable, fmt.Sprintf("server limit on %s reached", kind)}
+	}
+	u := a.users[user]
+	if user != "" && u != nil {
+		if stream && over(u.streams, a.cfg.MaxStreamsPerUser) {
+			return nil, &errLimitReached{http.StatusTooManyRequests, "per-user stream limit reached"}
+		}
+		if over(u.kinds[kind], a.userKindLimit(kind)) {
+			return nil, &errLimitReached{http.StatusTooManyRequests, fmt.Sprintf("per-user limit on %s reached", kind)}
+		}
+	}
+
+	n := 0
+	if stream {
+		n = 1
+	}
+	a.global.streams += n
+	a.global.kinds[kind]++
+	if user != "" {
+		if u == nil {
+			u = &limitUsage{}
+			a.users[user] = u
+		}
+		u.streams += n
+		u.kinds[kind]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.global.streams -= n
+			a.global.kinds[kind]--
+			if user != "" {
+				u.streams -= n
+				u.kinds[kind]--
+				if *u == (limitUsage{}) {
+					delete(a.users, user)
+				}
+			}
+		})
+	}, nil
+}
+
+func (a *admission) globalKindLimit(kind streamKind) int {
+	if kind == kindUDP {
+		return a.cfg.MaxUDPSessions
+	}
+	return a.cfg.MaxOutbound
+}
+
+func (a *admission) userKindLimit(kind streamKind) int {
+	if kind == kindUDP {
+		return a.cfg.MaxUDPSessionsPerUser
+	}
+	return a.cfg.MaxOutboundPerUser
+}
+
+// over reports whether n open streams already fill limit (0 means unlimited).
+func over(n, limit int) bool {
+	return limit > 0 && n >= limit
+}
+
+// limitedDialer counts the UDP ASSOCIATE sessions opened inside a SOCKS5
+// stream against the UDP session limits, as SOCKS5 UDP streams are.
+type limitedDialer struct {
+	socks5.Dialer
+	limits *admission
+	user   string
+	peer   string
+}
+
+func (d *limitedDialer) Dial(target string) (io.ReadWriteCloser, error) {
+	if target != udpTunnelTarget {
+		return d.Dialer.Dial(target)
+	}
+	release, err := d.limits.admitNested(d.user, kindUDP)
+	if err != nil {
+		log.Printf("Refused UDP ASSOCIATE from %s: %v", d.peer, err)
+		return nil, err
+	}
+	conn, err := d.Dialer.Dial(target)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &releasingConn{ReadWriteCloser: conn, release: release}, nil
+}
+
+// releasingConn releases its admission when closed.
+type releasingConn struct {
+	io.ReadWriteCloser
+	release func()
+}
+
+func (c *releasingConn) Close() error {
+	err := c.ReadWriteCloser.Close()
+	c.release()
+	return err
+}
+
+// rejectLimited answers a stream refused by admit.
+func rejectLimited(w http.ResponseWriter, err error) {
+	status := http.StatusServiceUnavailable
+	if lr, ok := err.(*errLimitReached); ok {
+		status = lr.status
+	}
+	w.Header().Set("Retry-After", limitRetryAfter)
+	http.Error(w, http.StatusText(status), status)
+}
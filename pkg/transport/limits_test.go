@@ -0,0 +1,81 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"phoenix/pkg/config"
+	"testing"
+)
+
+func TestAdmission(t *testing.T) {
+	a := newAdmission(config.ServerLimits{MaxStreams: 3, MaxStreamsPerUser: 2, MaxUDPSessions: 1})
+
+	release, err := a.admit("alice", kindOutbound)
+	if err != nil {
+		t.Fatalf("First stream rejected: %v", err)
+	}
+	if _, err := a.admit("alice", kindOutbound); err != nil {
+		t.Fatalf("Second stream rejected: %v", err)
+	}
+	_, err = a.admit("alice", kindOutbound)
+	if lr, ok := err.(*errLimitReached); !ok || lr.status != http.StatusTooManyRequests {
+		t.Fatalf("Expected per-user limit, got %v", err)
+	}
+
+	if _, err := a.admit("bob", kindUDP); err != nil {
+		t.Fatalf("UDP session rejected: %v", err)
+	}
+	_, err = a.admit("", kindOutbound)
+	if lr, ok := err.(*errLimitReached); !ok || lr.status != http.StatusServiceUnavailable {
+		t.Fatalf("Expected global limit, got %v", err)
+	}
+
+	release()
+	release() // releasing twice must not free a second slot
+	if _, err := a.admit("", kindUDP); err == nil {
+		t.Error("Expected UDP session limit")
+	}
+	if _, err := a.admit("", kindOutbound); err != nil {
+		t.Errorf("Released stream slot not reused: %v", err)
+	}
+	if _, err := a.admit("", kindOutbound); err == nil {
+		t.Error("Expected global limit after the slot was reused")
+	}
+}
+
+// dialerFunc adapts a function to socks5.Dialer.
+type dialerFunc func(target string) (io.ReadWriteCloser, error)
+
+func (f dialerFunc) Dial(target string) (io.ReadWriteCloser, error) { return f(target) }
+
+func TestLimitedDialer(t *testing.T) {
+	a := newAdmission(config.ServerLimits{MaxStreams: 1, MaxUDPSessions: 1})
+	if _, err := a.admit("alice", kindOutbound); err != nil {
+		t.Fatalf("SOCKS5 stream rejected: %v", err)
+	}
+	d := &limitedDialer{
+		Dialer: dialerFunc(func(string) (io.ReadWriteCloser, error) {
+			c, _ := net.Pipe()
+			return c, nil
+		}),
+		limits: a,
+		user:   "alice",
+	}
+
+	// A UDP ASSOCIATE inside the stream is a UDP session, not another stream.
+	udp, err := d.Dial(udpTunnelTarget)
+	if err != nil {
+		t.Fatalf("UDP ASSOCIATE rejected: %v", err)
+	}
+	if _, err := d.Dial(udpTunnelTarget); err == nil {
+		t.Error("Expected the UDP session limit to refuse a second UDP ASSOCIATE")
+	}
+	if _, err := d.Dial("example.com:443"); err != nil {
+		t.Errorf("CONNECT inside the stream was counted: %v", err)
+	}
+	udp.Close()
+	if _, err := d.Dial(udpTunnelTarget); err != nil {
+		t.Errorf("Closed UDP ASSOCIATE did not free its session: %v", err)
+	}
+}
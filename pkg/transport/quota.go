@@ -0,0 +1,223 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"phoenix/pkg/config"
+	"sync"
+	"time"
+)
+
+// quotaFlushInterval is how often changed quota usage is written to disk.
+const quotaFlushInterval = 30 * time.Second
+
+// errQuotaExceeded ends streams that run out of quota when cut_active is set.
+var errQuotaExceeded = errors.New("traffic quota exceeded")
+
+// quotaUsage is the traffic of one account in its current period.
+type quotaUsage struct {
+	PeriodStart time.Time `json:"period_start"`
+	Used        int64     `json:"used"`
+}
+
+// quotaTracker counts traffic per account and persists it to the state file.
+type quotaTracker struct {
+	cfg    config.ServerQuotas
+	path   string
+	limits map[string]int64 // class → bytes per period
+
+	mu    sync.Mutex
+	usage map[string]*quotaUsage
+	dirty bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newQuotaTracker(cfg config.ServerQuotas) (*quotaTracker, error) {
+	q := &quotaTracker{
+		cfg:    cfg,
+		path:   cfg.StatePath(),
+		limits: make(map[string]int64),
+		usage:  make(map[string]*quotaUsage),
+		stop:   make(chan struct{}),
+	}
+	for name, class := range cfg.Classes {
+		limit, err := config.ParseByteSize(class.Limit)
+		if err != nil {
+			return nil, fmt.Errorf("quota class %s: %v", name, err)
+		}
+		q.limits[name] = limit
+	}
+
+	data, err := os.ReadFile(q.path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read quota state: %w", err)
+	default:
+		if err := json.Unmarshal(data, &q.usage); err != nil {
+			return nil, fmt.Errorf("failed to parse quota state %s: %w", q.path, err)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(quotaFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-q.stop:
+				return
+			}
+			if err := q.flush(); err != nil {
+				log.Printf("Failed to save quota state: %v", err)
+			}
+		}
+	}()
+	return q, nil
+}
+
+// quotaAccount is the quota a stream is charged against.
+type quotaAccount struct {
+	name  string
+	class string
+}
+
+// accountFor returns the account of an authenticated stream, or nil if it
+// has no quota. User accounts take precedence over access token claims.
+func (q *quotaTracker) accountFor(id streamIdentity) *quotaAccount {
+	var name, class string
+	switch {
+	case id.user != nil:
+		name, class = id.user.Name, id.user.QuotaClass
+	case id.claims != nil:
+		name, class = id.claims.Subject, id.claims.QuotaClass
+	default:
+		return nil
+	}
+	if class == "" {
+		class = q.cfg.DefaultClass
+	}
+	if _, ok := q.limits[class]; !ok {
+		if class != "" {
+			log.Printf("Unknown quota class %q for %s; traffic is not limited", class, name)
+		}
+		return nil
+	}
+	return &quotaAccount{name: name, class: class}
+}
+
+// current returns the usage of a in the period containing now, resetting
+// it when a new period has begun. A reset alone does not need saving, since
+// a stale period reads as unused on load too. Must hold q.mu.
+func (q *quotaTracker) current(a *quotaAccount, now time.Time) *quotaUsage {
+	start := q.cfg.Classes[a.class].PeriodStart(now)
+	u, ok := q.usage[a.name]
+	if !ok || !u.PeriodStart.Equal(start) {
+		u = &quotaUsage{PeriodStart: start}
+		q.usage[a.name] = u
+	}
+	return u
+}
+
+// remaining returns the bytes a may still transfer in the current period.
+func (q *quotaTracker) remaining(a *quotaAccount) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	left := q.limits[a.class] - q.current(a, time.Now()).Used
+	if left < 0 {
+		return 0
+	}
+	return left
+}
+
+// add charges n bytes to a.
+func (q *quotaTracker) add(a *quotaAccount, n int) {
+	if n <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.current(a, time.Now()).Used += int64(n)
+	q.dirty = true
+}
+
+// flush writes the usage to the state file if it changed.
+func (q *quotaTracker) flush() error {
+	q.mu.Lock()
+	if !q.dirty {
+		q.mu.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(q.usage, "", "  ")
+	q.dirty = false
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
+
+// close stops the periodic flush and saves the usage counted since the
+// last one.
+func (q *quotaTracker) close() error {
+	q.stopOnce.Do(func() { close(q.stop) })
+	return q.flush()
+}
+
+// meteredStream charges the traffic of a stream, in both directions,
+// to a quota account. With cut set, no byte beyond the quota is relayed.
+type meteredStream struct {
+	io.ReadWriteCloser
+	quota   *quotaTracker
+	account *quotaAccount
+	cut     bool
+}
+
+// allowance limits p to the quota left when cut is set.
+func (m *meteredStream) allowance(p []byte) ([]byte, error) {
+	if !m.cut {
+		return p, nil
+	}
+	left := m.quota.remaining(m.account)
+	if left == 0 {
+		return nil, errQuotaExceeded
+	}
+	if int64(len(p)) > left {
+		p = p[:left]
+	}
+	return p, nil
+}
+
+func (m *meteredStream) Read(p []byte) (int, error) {
+	p, err := m.allowance(p)
+	if err != nil {
+		return 0, err
+	}
+	n, err := m.ReadWriteCloser.Read(p)
+	m.quota.add(m.account, n)
+	return n, err
+}
+
+func (m *meteredStream) Write(p []byte) (int, error) {
+	allowed, err := m.allowance(p)
+	if err != nil {
+		return 0, err
+	}
+	n, err := m.ReadWriteCloser.Write(allowed)
+	m.quota.add(m.account, n)
+	if err == nil && n < len(p) {
+		err = errQuotaExceeded
+	}
+	return n, err
+}
@@ -0,0 +1,75 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"phoenix/pkg/config"
+	"strings"
+	"testing"
+)
+
+// rwBuffer is an in-memory stream: reads come from r, writes go to w.
+type rwBuffer struct {
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (b *rwBuffer) Read(p []byte) (int, error)  { return b.r.Read(p) }
+func (b *rwBuffer) Write(p []byte) (int, error) { return b.w.Write(p) }
+func (b *rwBuffer) Close() error                { return nil }
+
+func TestMeteredStreamCut(t *testing.T) {
+	q, err := newQuotaTracker(config.ServerQuotas{
+		Classes:   map[string]config.QuotaClass{"tiny": {Limit: "10", Period: "daily"}},
+		StateFile: filepath.Join(t.TempDir(), "quota.json"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := &quotaAccount{name: "alice", class: "tiny"}
+	if q.remaining(account); q.dirty {
+		t.Error("Looking up an idle account should not mark the state for saving")
+	}
+
+	inner := &rwBuffer{r: strings.NewReader(strings.Repeat("x", 100))}
+	m := &meteredStream{ReadWriteCloser: inner, quota: q, account: account, cut: true}
+	got, err := io.ReadAll(m)
+	if !errors.Is(err, errQuotaExceeded) || len(got) != 10 {
+		t.Fatalf("Expected exactly 10 bytes then errQuotaExceeded, got %d bytes, %v", len(got), err)
+	}
+	if n, err := m.Write([]byte("more")); n != 0 || !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("Expected writes past the quota to fail, got %d, %v", n, err)
+	}
+	if inner.w.Len() != 0 {
+		t.Errorf("Bytes past the quota were relayed: %q", inner.w.String())
+	}
+}
+
+func TestQuotaTrackerClose(t *testing.T) {
+	cfg := config.ServerQuotas{
+		Classes:   map[string]config.QuotaClass{"std": {Limit: "1GB", Period: "monthly"}},
+		StateFile: filepath.Join(t.TempDir(), "quota.json"),
+	}
+	q, err := newQuotaTracker(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := &quotaAccount{name: "alice", class: "std"}
+	m := &meteredStream{ReadWriteCloser: &rwBuffer{r: strings.NewReader("")}, quota: q, account: account}
+	m.Write([]byte("hello"))
+	if err := q.close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	// Usage counted since the last periodic save survives a restart.
+	q2, err := newQuotaTracker(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q2.close()
+	if left := q2.remaining(account); left != 1e9-5 {
+		t.Errorf("Expected 5 bytes used after restart, %d left", left)
+	}
+}
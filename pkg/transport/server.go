@@ -1,8 +1,8 @@
 package transport
 
 import (
-	"crypto/ed25519"
-	"crypto/subtle"
+	"bytes"
+	stdcrypto "crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
@@ -10,14 +10,21 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
+	"os"
 	"phoenix/pkg/adapter/socks5"
 	"phoenix/pkg/adapter/ssh"
 	"phoenix/pkg/config"
 	"phoenix/pkg/crypto"
 	"phoenix/pkg/protocol"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"golang.org/x/crypto/acme"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
 )
@@ -25,37 +32,194 @@ import (
 // Server handles incoming H2C connections and routes them to the appropriate protocol handler.
 type Server struct {
 	Config *config.ServerConfig
+
+	// clientKeys is set when mTLS is enabled.
+	clientKeys *clientKeyStore
+
+	// enroller is set when enrollment codes are enabled.
+	enroller *enroller
+
+	// auth is set when an auth token, token issuer or users file is configured.
+	auth *requestAuth
+
+	// users is set when a users file is configured.
+	users *userStore
+
+	// quotas is set when quota classes are configured.
+	quotas *quotaTracker
+
+	// shaper rate-limits relayed traffic.
+	shaper *bandwidthShaper
+
+	// limits refuses streams beyond the configured caps.
+	limits *admission
+
+	// clientIPs finds the real client address behind a proxy.
+	clientIPs *clientIPResolver
+
+	// bans is set when clients that fail authentication are banned.
+	bans *banList
+
+	// decoy is set when a decoy site is configured.
+	decoy http.Handler
+
+	// camo decodes stream metadata from requests.
+	camo *camouflage
+
+	// innerKeys are set when streams carry an inner channel.
+	innerKeys []stdcrypto.PrivateKey
+
+	// splits are the split-HTTP streams being served.
+	splits splitSessions
+
+	// http is the running server, set by Start.
+	httpServer atomic.Pointer[http.Server]
 }
 
 // NewServer creates a new H2C server instance.
 func NewServer(cfg *config.ServerConfig) *Server {
-	return &Server{Config: cfg}
+	s := &Server{
+		Config: cfg,
+		camo:   newCamouflage(cfg.Camouflage),
+		shaper: newBandwidthShaper(cfg.Bandwidth),
+		limits: newAdmission(cfg.Limits),
+	}
+	if cfg.Security.AuthToken != "" || len(cfg.Security.TokenIssuerKeys) > 0 {
+		s.auth = newRequestAuth(cfg.Security, nil)
+	}
+	return s
 }
 
 // ServeHTTP implements the http.Handler interface.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	r = withArrival(r, time.Now())
+	addr := s.clientIPs.clientIP(r)
+	if s.bans != nil && s.bans.banned(addr, time.Now()) {
+		s.serveDecoy(w, r)
+		return
+	}
+	meta, ok := s.camo.decode(r)
+	if !ok {
+		s.serveDecoy(w, r)
+		return
+	}
+
+	// Uploads of split streams carry nothing but their session and place.
+	if meta.Session != "" && meta.Seq != "" && r.Method == s.camo.cfg.Method {
+		s.serveSplitUpload(w, r, meta)
 		return
 	}
 
+	// Enrollment is the one request a key that is not yet authorized may make.
+	if s.enroller != nil && protocol.ProtocolType(meta.Protocol) == protocol.ProtocolEnroll {
+		s.enroller.serve(w, r, meta)
+		return
+	}
+
+	// Client key authorization is re-checked per stream so that a key revoked
+	// or expired after the handshake cannot open new streams.
+	peer := r.RemoteAddr
+	if addr != addrOf(r.RemoteAddr) {
+		peer = fmt.Sprintf("%s via %s", addr, r.RemoteAddr)
+	}
+	// The inner handshake comes first in the body; its reply is sent once
+	// the stream is accepted. Only requests with stream metadata are taken
+	// for Phoenix clients, and a body that is no handshake is left for the
+	// decoy untouched: an ordinary POST is a probe, not a failed login.
+	var innerReply []byte
+	var inner *crypto.InnerCiphers
+	var innerPin string
+	if s.innerKeys != nil {
+		if meta.Protocol == "" {
+			s.serveDecoy(w, r)
+			return
+		}
+		var err error
+		if innerReply, inner, innerPin, err = s.acceptInner(r, meta); err != nil {
+			log.Printf("Not a Phoenix stream from %s: %v", peer, err)
+			s.serveDecoy(w, r)
+			return
+		}
+	}
+
+	var client *authorizedClient
+	if s.clientKeys != nil {
+		var err error
+		if s.innerKeys != nil && innerPin == "" {
+			err = errors.New("no client key in inner channel handshake")
+		} else if s.innerKeys != nil {
+			client, err = s.clientKeys.lookup(innerPin)
+		} else {
+			client, err = s.clientKeys.clientForRequest(r)
+		}
+		if err != nil {
+			log.Printf("Rejected stream from %s: %v", peer, err)
+			s.reject(w, r, addr)
+			return
+		}
+		if client != nil {
+			peer = fmt.Sprintf("%s [%s]", peer, client.label)
+		}
+	}
+	// authed is set once the stream has proved who it is, by client key or
+	// credential. Only then are refusals explained; see refuse.
+	authed := client != nil
+
+	proto := meta.Protocol
+	target := meta.Target
+
 	// Token Authentication
-	if s.Config.Security.AuthToken != "" {
-		token := r.Header.Get("X-Nerve-Token")
-		if subtle.ConstantTimeCompare([]byte(token), []byte(s.Config.Security.AuthToken)) != 1 {
-			log.Printf("Rejected unauthorized connection from %s", r.RemoteAddr)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	var ident streamIdentity
+	if client != nil && s.users != nil {
+		ident.user = s.users.byClientKey(client.pin)
+	}
+	if s.auth != nil {
+		id, err := s.auth.check(r.Method, meta)
+		switch {
+		case errors.Is(err, errNoCredentials) && ident.user != nil:
+			// The client key identified the user.
+		case errors.Is(err, errNoCredentials) && s.decoy != nil:
+			// Not a Phoenix client: a browser or a prober.
+			s.serveDecoy(w, r)
+			return
+		case err != nil:
+			log.Printf("Rejected unauthorized connection from %s: %v", peer, err)
+			s.reject(w, r, addr)
+			return
+		case ident.user != nil && id.user != nil && id.user != ident.user:
+			log.Printf("Rejected connection from %s: client key belongs to %s but token belongs to %s", peer, ident.user.Name, id.user.Name)
+			s.reject(w, r, addr)
 			return
+		default:
+			ident.claims = id.claims
+			if id.user != nil {
+				ident.user = id.user
+			}
+			authed = true
 		}
 	}
+	user := ident.user
+	var userName string
+	switch {
+	case user != nil:
+		userName = user.Name
+	case ident.claims != nil:
+		userName = ident.claims.Subject
+	}
+	if userName != "" {
+		peer = fmt.Sprintf("%s user=%s", peer, userName)
+	}
 
-	proto := r.Header.Get("X-Nerve-Protocol")
-	if proto == "" {
-		http.Error(w, "Missing Protocol Header", http.StatusBadRequest)
+	if user != nil && !user.Enabled {
+		log.Printf("Rejected connection from %s: account disabled", peer)
+		s.refuse(w, r, authed, http.StatusForbidden, "Account Disabled")
 		return
 	}
 
-	target := r.Header.Get("X-Nerve-Target")
+	if proto == "" {
+		s.refuse(w, r, authed, http.StatusBadRequest, "Missing Protocol Header")
+		return
+	}
 
 	allowed := false
 	switch protocol.ProtocolType(proto) {
@@ -68,49 +232,161 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case protocol.ProtocolSSH:
 		allowed = s.Config.Security.EnableSSH
 	default:
-		log.Printf("Unknown protocol requested: %s", proto)
+		log.Printf("Unknown protocol requested by %s: %s", peer, proto)
 	}
 
+	// Unknown and disabled protocols are refused alike, so that probing
+	// does not reveal which protocols are enabled.
 	if !allowed {
-		log.Printf("Blocked request for protocol %s from %s", proto, r.RemoteAddr)
-		http.Error(w, "Protocol Disabled by Server", http.StatusForbidden)
+		log.Printf("Blocked request for protocol %s from %s", proto, peer)
+		s.refuse(w, r, authed, http.StatusForbidden, "Protocol Disabled by Server")
 		return
 	}
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+	if client != nil && !client.allows(protocol.ProtocolType(proto)) {
+		log.Printf("Blocked request for protocol %s from %s: not allowed for this client", proto, peer)
+		s.refuse(w, r, authed, http.StatusForbidden, "Protocol Not Allowed for Client")
+		return
+	}
+
+	if ident.claims != nil && !ident.claims.AllowsProtocol(proto) {
+		log.Printf("Blocked request for protocol %s from %s: not allowed by access token", proto, peer)
+		s.refuse(w, r, authed, http.StatusForbidden, "Protocol Not Allowed for Token")
 		return
 	}
 
-	log.Printf("Accepted stream for protocol %s from %s (Target: %s)", proto, r.RemoteAddr, target)
-	w.WriteHeader(http.StatusOK)
-	flusher.Flush()
+	if user != nil && !user.AllowsProtocol(protocol.ProtocolType(proto)) {
+		log.Printf("Blocked request for protocol %s from %s: not allowed for this user", proto, peer)
+		s.refuse(w, r, authed, http.StatusForbidden, "Protocol Not Allowed for User")
+		return
+	}
 
-	// Wrap the request body and response writer into a ReadWriteCloser-like interface
-	stream := &H2Stream{
-		Reader:  r.Body,
-		Writer:  w,
-		Flusher: flusher,
+	// Targets chosen inside the stream (SOCKS5 CONNECT, UDP packets) are
+	// checked as they are dialed; see policyDialer.
+	checkTarget := target
+	if checkTarget == "" && protocol.ProtocolType(proto) == protocol.ProtocolSSH {
+		checkTarget = ssh.DefaultTarget
+	}
+	if user != nil && checkTarget != "" && !user.AllowsTarget(checkTarget) {
+		log.Printf("Blocked request for %s from %s: target not allowed for this user", checkTarget, peer)
+		s.refuse(w, r, authed, http.StatusForbidden, "Target Not Allowed")
+		return
+	}
+
+	var account *quotaAccount
+	if s.quotas != nil {
+		if account = s.quotas.accountFor(ident); account != nil {
+			left := s.quotas.remaining(account)
+			w.Header().Set("X-Nerve-Quota-Remaining", strconv.FormatInt(left, 10))
+			if left == 0 {
+				log.Printf("Rejected stream from %s: traffic quota exhausted", peer)
+				s.refuse(w, r, authed, http.StatusTooManyRequests, "Quota Exceeded")
+				return
+			}
+		}
+	}
+
+	release, err := s.limits.admit(userName, streamKindFor(proto, target))
+	if err != nil {
+		log.Printf("Rejected stream from %s: %v", peer, err)
+		if authed {
+			rejectLimited(w, err)
+		} else {
+			s.serveDecoy(w, r)
+		}
+		return
+	}
+	defer release()
+
+	var stream io.ReadWriteCloser
+	if isWebSocketRequest(r) {
+		ws, err := s.acceptWebSocket(w, r)
+		if err != nil {
+			log.Printf("Rejected WebSocket stream from %s: %v", peer, err)
+			return
+		}
+		defer ws.Close()
+		log.Printf("Accepted WebSocket stream for protocol %s from %s (Target: %s)", proto, peer, target)
+		stream = ws
+	} else {
+		// A split stream reads the session's uploads instead of the body.
+		var body io.Reader = r.Body
+		if isSplitDownload(r, meta) {
+			var secret []byte
+			if inner != nil {
+				secret = inner.ExportKey(splitKeyLabel)
+			} else {
+				secret = []byte(ident.secret)
+			}
+			split, err := s.splits.open(r.Context(), meta.Session, splitKey(secret, meta.Session))
+			if err != nil {
+				log.Printf("Rejected stream from %s: %v", peer, err)
+				s.refuse(w, r, authed, http.StatusConflict, "Session Conflict")
+				return
+			}
+			defer s.splits.remove(meta.Session, split)
+			body = split
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Accepted stream for protocol %s from %s (Target: %s)", proto, peer, target)
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		// Wrap the request body and response writer into a ReadWriteCloser-like interface
+		stream = &H2Stream{
+			Reader:  body,
+			Writer:  w,
+			Flusher: flusher,
+		}
+	}
+	if inner != nil {
+		if _, err := stream.Write(innerFrame(innerReply)); err != nil {
+			return
+		}
+		ic := newInnerConn(stream, stream, inner, stream)
+		defer ic.Close()
+		stream = ic
+	}
+
+	shaped := s.shaper.wrap(r.Context(), stream, userName, user)
+	defer s.shaper.release(shaped)
+
+	var tunnel io.ReadWriteCloser = shaped
+	if account != nil {
+		tunnel = &meteredStream{ReadWriteCloser: shaped, quota: s.quotas, account: account, cut: s.Config.Quotas.CutActive}
 	}
 
-	var err error
 	// If target is provided in header, we assume the handshake is already done (e.g. at client side)
 	// and we just need to tunnel to the target.
 	if target != "" {
-		err = ssh.HandleConnection(stream, target)
+		err = ssh.HandleConnection(tunnel, target, peer)
 	} else {
 		switch protocol.ProtocolType(proto) {
 		case protocol.ProtocolSOCKS5:
 			// Server handles SOCKS5 handshake
-			err = socks5.HandleConnection(stream, &socks5.NetDialer{}, s.Config.Security.EnableUDP)
+			var dialer socks5.Dialer = &socks5.NetDialer{}
+			if user != nil {
+				dialer = &policyDialer{Dialer: dialer, user: user, peer: peer}
+			}
+			dialer = &limitedDialer{Dialer: dialer, limits: s.limits, user: userName, peer: peer}
+			err = socks5.HandleConnection(tunnel, dialer, s.Config.Security.EnableUDP, peer)
 		case protocol.ProtocolSOCKS5UDP:
 			// Server handles SOCKS5 UDP Tunnel
 			if !s.Config.Security.EnableUDP {
 				http.Error(w, "UDP Disabled", http.StatusForbidden)
 				return
 			}
-			err = socks5.HandleUDPTunnel(stream)
+			if user != nil {
+				err = socks5.HandleUDPTunnelFiltered(tunnel, user.AllowsTarget, peer)
+			} else {
+				err = socks5.HandleUDPTunnel(tunnel, peer)
+			}
 		case protocol.ProtocolShadowsocks:
 			// SS is decrypted on client side; server gets target in header.
 			// If no target, we can't do anything.
@@ -120,14 +396,101 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			// or we implement SSH handshake parsing.
 			// Revert to default handling or error?
 			// For now, assume SSH forwarding always comes with target or Client is "Smart".
-			err = ssh.HandleConnection(stream, "")
+			err = ssh.HandleConnection(tunnel, "", peer)
 		default:
-			_, err = io.Copy(stream, stream)
+			_, err = io.Copy(tunnel, tunnel)
 		}
 	}
 
 	if err != nil && err != io.EOF {
-		log.Printf("Stream error: %v", err)
+		log.Printf("Stream error from %s: %v", peer, err)
+	}
+}
+
+// acceptInner runs the server side of the inner channel handshake, reading
+// the client's message from r.Body, or from meta for a WebSocket or split
+// stream. It returns
+// the reply, the channel ciphers and the client key pin ("" for an anonymous
+// client). If the body does not start with a valid handshake, the bytes read
+// are put back.
+func (s *Server) acceptInner(r *http.Request, meta streamMeta) ([]byte, *crypto.InnerCiphers, string, error) {
+	var consumed bytes.Buffer
+	var msg []byte
+	var err error
+	if isWebSocketRequest(r) || isSplitDownload(r, meta) {
+		msg, err = base64.RawURLEncoding.DecodeString(meta.Inner)
+		if err == nil && len(msg) == 0 {
+			err = errors.New("no handshake in metadata")
+		}
+	} else {
+		msg, err = readInnerFrame(io.TeeReader(r.Body, &consumed))
+	}
+	if err != nil {
+		restoreBody(r, &consumed)
+		return nil, nil, "", fmt.Errorf("inner channel handshake: %v", err)
+	}
+	reply, ciphers, clientKey, err := crypto.AcceptInner(s.innerKeys, msg)
+	if err != nil {
+		restoreBody(r, &consumed)
+		return nil, nil, "", fmt.Errorf("inner channel handshake: %v", err)
+	}
+	var pin string
+	if clientKey != nil {
+		if pin, err = crypto.SPKIPin(clientKey); err != nil {
+			return nil, nil, "", err
+		}
+	}
+	return reply, ciphers, pin, nil
+}
+
+// serveDecoy answers requests that are not tunnel streams, and every request
+// from a banned client, so a ban looks no different from a probe. The answer
+// waits out decoyMinDelay, so it does not tell how far a request got either.
+func (s *Server) serveDecoy(w http.ResponseWriter, r *http.Request) {
+	waitDecoyDelay(r)
+	if s.decoy != nil {
+		s.decoy.ServeHTTP(w, r)
+		return
+	}
+	if r.Method != s.camo.cfg.Method {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// reject answers a request that failed authentication and counts the failure
+// against the client address. The answer is the one serveDecoy gives, so a
+// failure, a ban and a probe all look alike.
+func (s *Server) reject(w http.ResponseWriter, r *http.Request, addr netip.Addr) {
+	s.recordFailure(addr)
+	s.serveDecoy(w, r)
+}
+
+// refuse answers a stream that is not allowed although it passed (or needed
+// no) authentication. Clients that proved who they are, with authed set, get
+// status and msg so they can tell the user why. Anyone else gets the answer
+// serveDecoy gives, so an open server does not reveal its protocols, targets
+// or limits to probes.
+func (s *Server) refuse(w http.ResponseWriter, r *http.Request, authed bool, status int, msg string) {
+	if !authed {
+		s.serveDecoy(w, r)
+		return
+	}
+	http.Error(w, msg, status)
+}
+
+// recordFailure counts a failed authentication and bans addr when it has
+// failed too often.
+func (s *Server) recordFailure(addr netip.Addr) {
+	if s.bans == nil {
+		return
+	}
+	if d := s.bans.fail(addr, time.Now()); d > 0 {
+		log.Printf("Banned %s for %v after repeated authentication failures", s.bans.scope(addr), d)
+		if err := s.bans.flush(); err != nil {
+			log.Printf("Failed to save ban state: %v", err)
+		}
 	}
 }
 
@@ -157,53 +520,170 @@ func (s *H2Stream) Close() error {
 
 // logServerSecurityMode prints the server's security status at startup.
 func logServerSecurityMode(cfg *config.ServerConfig) {
+	tokenAuth := cfg.Security.AuthToken != "" || len(cfg.Security.TokenIssuerKeys) > 0 || cfg.Security.UsersFile != ""
+	if len(cfg.Security.TokenIssuerKeys) > 0 {
+		log.Printf("Access tokens ENABLED (%d trusted issuer keys)", len(cfg.Security.TokenIssuerKeys))
+	}
+
 	// Auth mode
 	switch {
-	case cfg.Security.AuthToken != "" && len(cfg.Security.AuthorizedClientKeys) > 0:
-		log.Printf("Security Mode: mTLS (Ed25519) + Token Auth ENABLED")
-	case cfg.Security.AuthToken != "":
+	case tokenAuth && cfg.Security.MutualTLS():
+		log.Printf("Security Mode: mTLS (key pinning) + Token Auth ENABLED")
+	case tokenAuth && cfg.Security.ClientKeyAuth():
+		log.Printf("Security Mode: Inner channel client keys + Token Auth ENABLED")
+	case tokenAuth:
 		log.Printf("Security Mode: Token Auth ENABLED (h2c or TLS depending on private_key)")
-	case len(cfg.Security.AuthorizedClientKeys) > 0:
-		log.Printf("Security Mode: mTLS (Ed25519) — %d authorized clients", len(cfg.Security.AuthorizedClientKeys))
+	case cfg.Security.MutualTLS():
+		log.Printf("Security Mode: mTLS (key pinning)")
+	case cfg.Security.ClientKeyAuth():
+		log.Printf("Security Mode: Inner channel client keys")
+	case cfg.Security.CertFile != "":
+		log.Printf("Security Mode: ONE-WAY TLS (certificate chain) — no client auth")
+	case len(cfg.ACME.Domains) > 0:
+		log.Printf("Security Mode: ONE-WAY TLS (ACME certificate) — no client auth")
 	case cfg.Security.PrivateKeyPath != "":
-		log.Printf("Security Mode: ONE-WAY TLS (Ed25519) — no client auth")
+		log.Printf("Security Mode: ONE-WAY TLS (self-signed, key pinning) — no client auth")
 	default:
 		log.Printf("Security Mode: OPEN — No authentication configured!")
 	}
 }
 
-// StartServer starts the H2C/H2 Server.
+// StartServer starts the H2C/H2 Server for cfg.
 func StartServer(cfg *config.ServerConfig) error {
-	srv := NewServer(cfg)
-
-	// Log security status
-	logServerSecurityMode(cfg)
+	return NewServer(cfg).Start()
+}
 
-	// Check if Private Key is configured for TLS
-	if cfg.Security.PrivateKeyPath != "" {
-		// Load Private Key
-		priv, err := crypto.LoadPrivateKey(cfg.Security.PrivateKeyPath)
+// WatchConfig re-reads the config file at path whenever it changes and
+// applies the settings that can change at runtime (currently [bandwidth]).
+func (s *Server) WatchConfig(path string) {
+	watchFiles([]string{path}, func() {
+		cfg, err := config.LoadServerConfig(path)
 		if err != nil {
-			return fmt.Errorf("failed to load private key: %v", err)
+			log.Printf("Failed to reload %s, keeping current settings: %v", path, err)
+			return
 		}
+		s.shaper.update(cfg.Bandwidth)
+		log.Printf("Reloaded bandwidth limits from %s", path)
+	})
+}
 
-		// Generate Self-Signed Certificate
-		cert, err := crypto.GenerateTLSCertificate(priv)
+// Close stops the server started by Start, ending every stream, and saves
+// the quota usage counted since the last periodic save.
+func (srv *Server) Close() error {
+	var err error
+	if s := srv.httpServer.Load(); s != nil {
+		err = s.Close()
+	}
+	srv.limits.close()
+	if srv.quotas != nil {
+		if qerr := srv.quotas.close(); qerr != nil {
+			log.Printf("Failed to save quota state: %v", qerr)
+		}
+	}
+	return err
+}
+
+// Start starts the H2C/H2 server and blocks while it runs. After Close it
+// returns http.ErrServerClosed.
+func (srv *Server) Start() error {
+	cfg := srv.Config
+	if cfg.Security.UsersFile != "" {
+		users, err := newUserStore(cfg.Security.UsersFile, func(u *userStore) { srv.shaper.updateUsers(u) })
+		if err != nil {
+			return err
+		}
+		srv.users = users
+		srv.auth = newRequestAuth(cfg.Security, users)
+	}
+	if cfg.Quotas.Enabled() {
+		quotas, err := newQuotaTracker(cfg.Quotas)
+		if err != nil {
+			return err
+		}
+		srv.quotas = quotas
+		log.Printf("Traffic quotas ENABLED (%d classes, usage saved to %s)", len(cfg.Quotas.Classes), quotas.path)
+	}
+	clientIPs, err := newClientIPResolver(cfg.ClientIP)
+	if err != nil {
+		return err
+	}
+	srv.clientIPs = clientIPs
+	if cfg.Camouflage.Carrier == "body" {
+		if srv.camo.openWith, err = metadataKeys(cfg.Security); err != nil {
+			return err
+		}
+		pub, _ := crypto.MetadataPublicKey(srv.camo.openWith[0])
+		log.Printf("Encrypted stream metadata ENABLED (metadata_key for clients: %s)", pub)
+	}
+	if cfg.Security.InnerEncryption {
+		if srv.innerKeys, err = metadataKeys(cfg.Security); err != nil {
+			return err
+		}
+		pub, _ := crypto.MetadataPublicKey(srv.innerKeys[0])
+		log.Printf("Inner channel encryption ENABLED (metadata_key for clients: %s)", pub)
+		if cfg.Security.ClientKeyAuth() {
+			if srv.clientKeys, err = newClientKeyStore(cfg.Security); err != nil {
+				return err
+			}
+			log.Printf("Client keys are checked in the inner channel (%d authorized clients)", srv.clientKeys.count())
+		}
+	}
+	if srv.decoy, err = newDecoyHandler(cfg.Decoy, srv.camo); err != nil {
+		return err
+	}
+	if srv.decoy != nil {
+		log.Printf("Decoy site ENABLED for non-Phoenix requests")
+	}
+	if cfg.Bans.Enabled() {
+		bans, err := newBanList(cfg.Bans)
 		if err != nil {
-			return fmt.Errorf("failed to generate TLS certificate: %v", err)
+			return err
 		}
+		srv.bans = bans
+		log.Printf("Client bans ENABLED (%d failures within %v)", bans.maxFailures, bans.findTime)
+	}
+	srv.limits.start()
+	ln, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", cfg.ListenAddr, err)
+	}
+	if strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		log.Printf("WebSocket streams ENABLED (HTTP/1.1 Upgrade and HTTP/2 extended CONNECT)")
+	} else {
+		log.Printf("WebSocket streams ENABLED (HTTP/1.1 Upgrade only)")
+		log.Printf("WARNING: HTTP/2 extended CONNECT is off, so clients with transport = \"websocket-h2\" will fail; run with GODEBUG=http2xconnect=1 to accept them")
+	}
+	if cfg.ClientIP.ProxyProtocol {
+		ln = newProxyListener(ln, clientIPs)
+		log.Printf("Expecting PROXY protocol headers on %s", cfg.ListenAddr)
+	}
 
-		// Determine Authorized Public Keys
-		authorizedKeys := make(map[string]bool)
-		for _, k := range cfg.Security.AuthorizedClientKeys {
-			authorizedKeys[k] = true
+	// Log security status
+	logServerSecurityMode(cfg)
+
+	// TLS is enabled by a certificate chain, ACME, or a private key to self-sign with
+	if cfg.TLSEnabled() {
+		getCert, acmeManager, err := serverCertificate(cfg)
+		if err != nil {
+			return err
 		}
 
 		var clientAuth tls.ClientAuthType
 		var verifyPeer func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
 
-		if len(authorizedKeys) > 0 {
-			log.Printf("Starting server in SECURE mode (mTLS) with %d authorized clients", len(authorizedKeys))
+		if cfg.Security.MutualTLS() {
+			srv.clientKeys, err = newClientKeyStore(cfg.Security)
+			if err != nil {
+				return err
+			}
+			log.Printf("Starting server in SECURE mode (mTLS) with %d authorized clients", srv.clientKeys.count())
+			if cfg.Enrollment.Secret != "" {
+				if srv.enroller, err = newEnroller(cfg, srv.clientKeys); err != nil {
+					return err
+				}
+				srv.enroller.failed = func(r *http.Request) { srv.recordFailure(srv.clientIPs.clientIP(r)) }
+				log.Printf("Enrollment codes ENABLED (new keys are added to %s)", cfg.Security.AuthorizedClientsFile)
+			}
 			clientAuth = tls.RequireAnyClientCert
 			verifyPeer = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 				if len(rawCerts) == 0 {
@@ -216,18 +696,15 @@ func StartServer(cfg *config.ServerConfig) error {
 				}
 
 				// Verify Public Key
-				pub := leaf.PublicKey
-				pubBytes, ok := pub.(ed25519.PublicKey)
-				if !ok {
-					// Also support other keys if needed, but we default to Ed25519
-					return errors.New("unsupported public key type (expected Ed25519)")
+				pin, err := crypto.SPKIPin(leaf.PublicKey)
+				if err != nil {
+					return fmt.Errorf("unsupported client key: %v", err)
 				}
-
-				pubStr := base64.StdEncoding.EncodeToString(pubBytes)
-				if !authorizedKeys[pubStr] {
-					return fmt.Errorf("unauthorized client key: %s", pubStr)
+				// With enrollment enabled, unknown keys complete the handshake
+				// but may only make an enrollment request (see ServeHTTP).
+				if _, err := srv.clientKeys.lookup(pin); err != nil && srv.enroller == nil {
+					return err
 				}
-
 				return nil
 			}
 		} else {
@@ -238,17 +715,31 @@ func StartServer(cfg *config.ServerConfig) error {
 
 		// Configure TLS
 		tlsConfig := &tls.Config{
-			Certificates:          []tls.Certificate{cert},
+			GetCertificate:        getCert,
 			ClientAuth:            clientAuth,
-			NextProtos:            []string{"h2"},
+			NextProtos:            []string{"h2", "http/1.1"}, // HTTP/1.1 for WebSocket clients, browsers and scanners
 			VerifyPeerCertificate: verifyPeer,
 		}
 
-		ln, err := tls.Listen("tcp", cfg.ListenAddr, tlsConfig)
-		if err != nil {
-			return fmt.Errorf("failed to listen on %s: %v", cfg.ListenAddr, err)
+		if acmeManager != nil {
+			tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+			if clientAuth != tls.NoClientCert {
+				// TLS-ALPN-01 validation connections come from the CA without a
+				// client certificate, so exempt them from mTLS.
+				tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+					if !isACMEChallenge(hello) {
+						return nil, nil
+					}
+					return &tls.Config{GetCertificate: getCert, NextProtos: []string{acme.ALPNProto}}, nil
+				}
+			}
+			if cfg.ACME.HTTPAddr != "" {
+				serveACMEHTTP(acmeManager, cfg.ACME.HTTPAddr)
+			}
 		}
 
+		ln = tls.NewListener(ln, tlsConfig)
+
 		// Standard HTTP server for TLS (Go handles H2 automatically)
 		s := &http.Server{
 			Handler:      srv, // Direct handler, no h2c
@@ -256,15 +747,26 @@ func StartServer(cfg *config.ServerConfig) error {
 			WriteTimeout: 0,
 			IdleTimeout:  0,
 		}
+		if err := http2.ConfigureServer(s, &http2.Server{
+			MaxConcurrentStreams: cfg.Limits.StreamsPerConnection(),
+			MaxReadFrameSize:     1024 * 1024,
+		}); err != nil {
+			return err
+		}
+		if cfg.Security.MutualTLS() {
+			// Lets revocations close connections that are already open
+			s.ConnState = srv.clientKeys.trackConn
+		}
 
 		log.Printf("Listening on %s (TLS)", cfg.ListenAddr)
+		srv.httpServer.Store(s)
 		return s.Serve(ln)
 
 	} else {
 		log.Println("Starting server in INSECURE mode (h2c)")
 		// Fallback to H2C (Cleartext)
 		h2s := &http2.Server{
-			MaxConcurrentStreams: 500,         // Increase concurrency
+			MaxConcurrentStreams: cfg.Limits.StreamsPerConnection(),
 			MaxReadFrameSize:     1024 * 1024, // 1MB frames if possible
 			IdleTimeout:          10 * time.Second,
 		}
@@ -279,6 +781,7 @@ func StartServer(cfg *config.ServerConfig) error {
 		}
 
 		log.Printf("Listening on %s", cfg.ListenAddr)
-		return s.ListenAndServe()
+		srv.httpServer.Store(s)
+		return s.Serve(ln)
 	}
 }
@@ -0,0 +1,213 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"log"
+	"phoenix/pkg/config"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// minShapingBurst keeps the token bucket at least as large as one relay
+// write, so a full buffer never has to wait for more than the bucket holds.
+const minShapingBurst = 64 * 1024
+
+// rateLimiters is a pair of token buckets, one per direction.
+type rateLimiters struct {
+	down *rate.Limiter
+	up   *rate.Limiter
+}
+
+func newRateLimiters() *rateLimiters {
+	return &rateLimiters{down: rate.NewLimiter(rate.Inf, 0), up: rate.NewLimiter(rate.Inf, 0)}
+}
+
+// set changes the limits in place, so streams already waiting on the
+// buckets pick up the new rate.
+func (l *rateLimiters) set(b config.BandwidthLimit) {
+	down, up, burst, err := b.Rates()
+	if err != nil {
+		// Rejected when the config was loaded; keep the stream usable.
+		log.Printf("Ignoring invalid bandwidth limit: %v", err)
+		down, up = 0, 0
+	}
+	setLimiter(l.down, down, burst)
+	setLimiter(l.up, up, burst)
+}
+
+func setLimiter(l *rate.Limiter, bytesPerSec, burst int64) {
+	if bytesPerSec == 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	if burst == 0 {
+		burst = bytesPerSec
+	}
+	if burst < minShapingBurst {
+		burst = minShapingBurst
+	}
+	l.SetBurst(int(burst))
+	l.SetLimit(rate.Limit(bytesPerSec))
+}
+
+// userRateLimiters are the buckets shared by all open streams of one user.
+type userRateLimiters struct {
+	*rateLimiters
+	user *config.UserAccount // nil for access token subjects
+	refs int
+}
+
+// limit returns the user's own limit, or perUser if it sets none.
+func (u *userRateLimiters) limit(perUser config.BandwidthLimit) config.BandwidthLimit {
+	if u.user == nil {
+		return perUser
+	}
+	return u.user.Bandwidth.Or(perUser)
+}
+
+// bandwidthShaper applies the global, per-user and per-stream limits.
+type bandwidthShaper struct {
+	mu      sync.Mutex
+	cfg     config.ServerBandwidth
+	global  *rateLimiters
+	users   map[string]*userRateLimiters
+	streams map[*shapedStream]bool
+}
+
+func newBandwidthShaper(cfg config.ServerBandwidth) *bandwidthShaper {
+	b := &bandwidthShaper{
+		global:  newRateLimiters(),
+		users:   make(map[string]*userRateLimiters),
+		streams: make(map[*shapedStream]bool),
+	}
+	b.update(cfg)
+	return b
+}
+
+// update applies new limits to every open stream.
+func (b *bandwidthShaper) update(cfg config.ServerBandwidth) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cfg = cfg
+	b.global.set(cfg.Global)
+	for _, u := range b.users {
+		u.set(u.limit(cfg.PerUser))
+	}
+	for s := range b.streams {
+		s.stream.set(cfg.PerStream)
+	}
+}
+
+// updateUsers re-reads per-user overrides after the users file is reloaded.
+func (b *bandwidthShaper) updateUsers(users *userStore) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name, u := range b.users {
+		if acct := users.byUserName(name); acct != nil {
+			u.user = acct
+		}
+		u.set(u.limit(b.cfg.PerUser))
+	}
+}
+
+// wrap shapes the traffic of rw. userName is the users-file account or
+// access token subject the stream belongs to ("" for anonymous streams), and
+// user its account, if any, for per-user overrides. The returned stream must
+// be released when the stream ends.
+func (b *bandwidthShaper) wrap(ctx context.Context, rw io.ReadWriteCloser, userName string, user *config.UserAccount) *shapedStream {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := &shapedStream{ReadWriteCloser: rw, ctx: ctx, shaper: b, stream: newRateLimiters()}
+	s.stream.set(b.cfg.PerStream)
+	s.limiters = []*rateLimiters{b.global, s.stream}
+
+	if userName != "" {
+		u, ok := b.users[userName]
+		if !ok {
+			u = &userRateLimiters{rateLimiters: newRateLimiters()}
+			b.users[userName] = u
+		}
+		if user != nil {
+			u.user = user
+		}
+		u.set(u.limit(b.cfg.PerUser))
+		u.refs++
+		s.user = userName
+		s.limiters = append(s.limiters, u.rateLimiters)
+	}
+
+	b.streams[s] = true
+	return s
+}
+
+func (b *bandwidthShaper) release(s *shapedStream) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.streams[s] {
+		return
+	}
+	delete(b.streams, s)
+	if u, ok := b.users[s.user]; ok && s.user != "" {
+		if u.refs--; u.refs == 0 {
+			delete(b.users, s.user)
+		}
+	}
+}
+
+// shapedStream rate-limits a stream in both directions.
+type shapedStream struct {
+	io.ReadWriteCloser
+	ctx      context.Context
+	shaper   *bandwidthShaper
+	stream   *rateLimiters
+	limiters []*rateLimiters
+	user     string
+}
+
+func (s *shapedStream) Read(p []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Read(p)
+	if n > 0 {
+		for _, l := range s.limiters {
+			if werr := waitBytes(s.ctx, l.up, n); werr != nil {
+				return n, werr
+			}
+		}
+	}
+	return n, err
+}
+
+func (s *shapedStream) Write(p []byte) (int, error) {
+	for _, l := range s.limiters {
+		if err := waitBytes(s.ctx, l.down, len(p)); err != nil {
+			return 0, err
+		}
+	}
+	return s.ReadWriteCloser.Write(p)
+}
+
+func (s *shapedStream) Close() error {
+	s.shaper.release(s)
+	return s.ReadWriteCloser.Close()
+}
+
+// waitBytes takes n tokens from l, in chunks no larger than its burst.
+func waitBytes(ctx context.Context, l *rate.Limiter, n int) error {
+	for n > 0 {
+		if l.Limit() == rate.Inf {
+			return nil
+		}
+		chunk := min(n, l.Burst())
+		if err := l.WaitN(ctx, chunk); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			// The burst shrank concurrently; retry with the new size.
+			continue
+		}
+		n -= chunk
+	}
+	return nil
+}
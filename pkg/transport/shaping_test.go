@@ -0,0 +1,87 @@
+package transport
+
+import (
+	"context"
+	"phoenix/pkg/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+// timedWrite writes n bytes to s and returns how long that took.
+func timedWrite(t *testing.T, s *shapedStream, n int) time.Duration {
+	t.Helper()
+	start := time.Now()
+	if _, err := s.Write(make([]byte, n)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	return time.Since(start)
+}
+
+func newTestStream(b *bandwidthShaper, user string) *shapedStream {
+	return b.wrap(context.Background(), &rwBuffer{r: strings.NewReader("")}, user, nil)
+}
+
+func TestShapingBurst(t *testing.T) {
+	b := newBandwidthShaper(config.ServerBandwidth{
+		PerStream: config.BandwidthLimit{Download: "100KB", Burst: "200KB"},
+	})
+	s := newTestStream(b, "")
+	defer s.Close()
+
+	if d := timedWrite(t, s, 200e3); d > 100*time.Millisecond {
+		t.Errorf("A write within the burst took %v", d)
+	}
+	// The bucket is empty now: 50KB more takes half a second at 100KB/s.
+	if d := timedWrite(t, s, 50e3); d < 300*time.Millisecond {
+		t.Errorf("A write beyond the burst took only %v", d)
+	}
+}
+
+func TestShapingPerUser(t *testing.T) {
+	b := newBandwidthShaper(config.ServerBandwidth{
+		PerUser: config.BandwidthLimit{Download: "100KB", Burst: "100KB"},
+	})
+
+	// Streams of one user, here an access token subject without an account,
+	// share one bucket; other users have their own.
+	first, second := newTestStream(b, "alice"), newTestStream(b, "alice")
+	other := newTestStream(b, "bob")
+	if d := timedWrite(t, first, 100e3); d > 100*time.Millisecond {
+		t.Errorf("A write within the burst took %v", d)
+	}
+	if d := timedWrite(t, other, 100e3); d > 100*time.Millisecond {
+		t.Errorf("Another user's stream was slowed down: %v", d)
+	}
+	if d := timedWrite(t, second, 50e3); d < 300*time.Millisecond {
+		t.Errorf("The user's second stream did not share the bucket (%v)", d)
+	}
+
+	for _, s := range []*shapedStream{first, second, other} {
+		s.Close()
+	}
+	if len(b.users) != 0 || len(b.streams) != 0 {
+		t.Errorf("Buckets left after every stream closed: %d users, %d streams", len(b.users), len(b.streams))
+	}
+}
+
+func TestShapingUpdate(t *testing.T) {
+	limited := config.ServerBandwidth{PerStream: config.BandwidthLimit{Download: "100KB", Burst: "100KB"}}
+	b := newBandwidthShaper(config.ServerBandwidth{})
+	s := newTestStream(b, "")
+	defer s.Close()
+
+	// New limits apply to streams that are already open, in both directions.
+	if d := timedWrite(t, s, 1e6); d > 100*time.Millisecond {
+		t.Errorf("Unlimited write took %v", d)
+	}
+	b.update(limited)
+	timedWrite(t, s, 100e3)
+	if d := timedWrite(t, s, 50e3); d < 300*time.Millisecond {
+		t.Errorf("Limit set at runtime not applied (%v)", d)
+	}
+	b.update(config.ServerBandwidth{})
+	if d := timedWrite(t, s, 1e6); d > 100*time.Millisecond {
+		t.Errorf("Limit lifted at runtime still applied (%v)", d)
+	}
+}
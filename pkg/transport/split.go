@@ -0,0 +1,522 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"phoenix/pkg/crypto"
+	"phoenix/pkg/protocol"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Split-HTTP transport: a stream is one long-lived GET, whose response
+// carries the download, and a series of uploads made with the camouflage
+// method, each carrying a chunk of the upload and its sequence number. A
+// random session ID ties them together. The GET carries the stream metadata
+// and is authenticated like any stream; uploads carry only the session ID,
+// sequence number and a MAC over both and the body (see splitKey), which
+// the server checks before taking the upload. An upload with an empty body
+// ends the upload direction.
+//
+// Uploads may arrive out of order or more than once (retries), so the
+// server puts them back in order and drops duplicates. A missing upload
+// that does not arrive within splitGapTimeout while later ones wait fails
+// the stream.
+
+const (
+	// splitMaxChunk is the largest upload body.
+	splitMaxChunk = 256 * 1024
+
+	// splitMaxInflight is how many uploads a client has outstanding.
+	splitMaxInflight = 4
+
+	// splitWindow is how far ahead of the next expected upload the server
+	// accepts one.
+	splitWindow = 64
+
+	// splitMaxBuffered bounds the out-of-order and unread upload bytes
+	// the server holds per stream.
+	splitMaxBuffered = 4 * 1024 * 1024
+
+	// splitGapTimeout is how long a missing upload is waited for.
+	splitGapTimeout = 30 * time.Second
+
+	// splitUploadTimeout and splitUploadAttempts bound each upload.
+	splitUploadTimeout  = 15 * time.Second
+	splitUploadAttempts = 3
+
+	// splitKeyLabel separates upload keys from other uses of their secret.
+	splitKeyLabel = "phoenix-split-upload\n"
+)
+
+// isSplitDownload reports whether r opens a split stream.
+func isSplitDownload(r *http.Request, meta streamMeta) bool {
+	return r.Method == http.MethodGet && meta.Session != "" && !isWebSocketRequest(r)
+}
+
+// newSessionID returns a random split stream session ID.
+func newSessionID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+// splitKey derives the key that authenticates the uploads of split stream
+// session from the stream's secret: the inner channel's when it has one,
+// else the token the client authenticated with. Without either the session
+// ID remains the uploads' only credential, and splitKey returns nil.
+func splitKey(secret []byte, session string) []byte {
+	if len(secret) == 0 {
+		return nil
+	}
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(splitKeyLabel + session))
+	return m.Sum(nil)
+}
+
+// splitUploadMAC authenticates upload seq of a split stream.
+func splitUploadMAC(key []byte, session string, seq uint64, chunk []byte) string {
+	m := hmac.New(sha256.New, key)
+	fmt.Fprintf(m, "%s\n%d\n", session, seq)
+	m.Write(chunk)
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// splitSessions are the split streams being served, by session ID.
+type splitSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*splitSession
+}
+
+// open registers a session for a download request, whose uploads must be
+// authenticated with key (see splitKey). The ID must look like one
+// newSessionID makes, so that it cannot be guessed.
+func (ss *splitSessions) open(ctx context.Context, id string, key []byte) (*splitSession, error) {
+	if raw, err := base64.RawURLEncoding.DecodeString(id); err != nil || len(raw) < 16 {
+		return nil, errors.New("invalid split session ID")
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.sessions[id] != nil {
+		return nil, errors.New("split session ID already in use")
+	}
+	if ss.sessions == nil {
+		ss.sessions = make(map[string]*splitSession)
+	}
+	s := &splitSession{ctx: ctx, key: key, changed: make(chan struct{}), pending: make(map[uint64][]byte)}
+	ss.sessions[id] = s
+	return s, nil
+}
+
+func (ss *splitSessions) get(id string) *splitSession {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.sessions[id]
+}
+
+// remove ends session s.
+func (ss *splitSessions) remove(id string, s *splitSession) {
+	s.Close()
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.sessions[id] == s {
+		delete(ss.sessions, id)
+	}
+}
+
+// splitSession reassembles the uploads of a split stream. Read returns them
+// in order.
+type splitSession struct {
+	ctx context.Context // the download request's
+	key []byte          // authenticates uploads; nil if they need not be
+
+	mu       sync.Mutex
+	changed  chan struct{}     // closed and replaced on every change
+	next     uint64            // sequence number Read needs next
+	pending  map[uint64][]byte // uploads not yet read, by sequence number
+	buffered int               // bytes in pending, and room reserved for uploads being read
+	cur      []byte            // upload being read
+	gapSince time.Time         // when Read started waiting for a missing upload
+	eof      bool
+	err      error
+}
+
+// notify wakes everything waiting for a change; s.mu must be held.
+func (s *splitSession) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// wait waits for a change, ctx to end or timeout (if non-zero); s.mu must
+// be held, and is released while waiting.
+func (s *splitSession) wait(ctx context.Context, timeout time.Duration) error {
+	changed := s.changed
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	s.mu.Unlock()
+	defer s.mu.Lock()
+	select {
+	case <-changed:
+	case <-expired:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// reserve makes room for upload seq, of up to n bytes, before its body is
+// read, so that uploads waiting for room do not hold their bodies. It
+// reports false for a duplicate of an upload already received, which is
+// dropped. When the server holds too much already, reserve waits for Read
+// to make room, unless seq is the upload Read is waiting for.
+func (s *splitSession) reserve(ctx context.Context, seq uint64, n int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		_, dup := s.pending[seq]
+		switch {
+		case s.err != nil:
+			return false, s.err
+		case seq < s.next || dup:
+			return false, nil
+		case seq-s.next >= splitWindow:
+			return false, fmt.Errorf("upload %d is too far ahead of %d", seq, s.next)
+		case seq == s.next || s.buffered+n <= splitMaxBuffered:
+			s.buffered += n
+			return true, nil
+		}
+		if err := s.wait(ctx, 0); err != nil {
+			return false, err
+		}
+	}
+}
+
+// put adds upload seq, for which reserve made room of n bytes. A duplicate
+// that arrived while the upload was read is dropped.
+func (s *splitSession) put(seq uint64, chunk []byte, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buffered -= n
+	if _, dup := s.pending[seq]; !dup && seq >= s.next && s.err == nil {
+		s.pending[seq] = chunk
+		s.buffered += len(chunk)
+	}
+	s.notify()
+}
+
+// release gives back the room reserve made for an upload that failed.
+func (s *splitSession) release(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buffered -= n
+	s.notify()
+}
+
+func (s *splitSession) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.cur) == 0 {
+		if s.eof {
+			return 0, io.EOF
+		}
+		if s.err != nil {
+			return 0, s.err
+		}
+		if chunk, ok := s.pending[s.next]; ok {
+			delete(s.pending, s.next)
+			s.buffered -= len(chunk)
+			s.next++
+			s.gapSince = time.Time{}
+			s.notify()
+			s.cur = chunk
+			s.eof = len(chunk) == 0
+			continue
+		}
+		var timeout time.Duration
+		if len(s.pending) > 0 {
+			// Later uploads are here, so this one was probably lost.
+			if s.gapSince.IsZero() {
+				s.gapSince = time.Now()
+			}
+			if timeout = splitGapTimeout - time.Since(s.gapSince); timeout <= 0 {
+				s.err = fmt.Errorf("upload %d lost", s.next)
+				s.notify()
+				continue
+			}
+		}
+		if err := s.wait(s.ctx, timeout); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.cur)
+	s.cur = s.cur[n:]
+	return n, nil
+}
+
+// Close fails pending and later uploads and reads.
+func (s *splitSession) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = io.ErrClosedPipe
+	}
+	s.notify()
+	return nil
+}
+
+// serveSplitUpload takes one upload of a split stream.
+func (s *Server) serveSplitUpload(w http.ResponseWriter, r *http.Request, meta streamMeta) {
+	session := s.splits.get(meta.Session)
+	seq, err := strconv.ParseUint(meta.Seq, 10, 64)
+	if session == nil || err != nil {
+		// Most likely an upload that arrived after its stream ended. The
+		// session ID is random, so this is not worth counting as a failure.
+		s.serveDecoy(w, r)
+		return
+	}
+
+	// Content-Length bounds the upload; with the body carrier it also
+	// counts the metadata, which only makes the room reserved too large.
+	n := splitMaxChunk
+	if r.ContentLength >= 0 && r.ContentLength < int64(n) {
+		n = int(r.ContentLength)
+	}
+	fresh, err := session.reserve(r.Context(), seq, n)
+	if err != nil {
+		log.Printf("Refused split upload from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "Upload Refused", http.StatusConflict)
+		return
+	}
+	if !fresh {
+		return
+	}
+	chunk, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(n)))
+	if err != nil {
+		session.release(n)
+		http.Error(w, "Bad Upload", http.StatusBadRequest)
+		return
+	}
+	if session.key != nil && !hmac.Equal([]byte(meta.Auth), []byte(splitUploadMAC(session.key, meta.Session, seq, chunk))) {
+		session.release(n)
+		log.Printf("Refused split upload from %s: invalid MAC", r.RemoteAddr)
+		s.serveDecoy(w, r)
+		return
+	}
+	session.put(seq, chunk, n)
+}
+
+// dialSplit opens a split stream. Like WebSockets, it sends the inner
+// handshake in the metadata of the download request.
+func (c *Client) dialSplit(proto protocol.ProtocolType, target string) (io.ReadWriteCloser, error) {
+	c.mu.RLock()
+	client := c.httpClient
+	c.mu.RUnlock()
+
+	meta, err := c.streamMeta(proto, target, http.MethodGet)
+	if err != nil {
+		return nil, err
+	}
+	meta.Session = newSessionID()
+	inner, msg, err := c.newInner()
+	if err != nil {
+		return nil, err
+	}
+	if inner != nil {
+		meta.Inner = base64.RawURLEncoding.EncodeToString(msg)
+	}
+
+	req, err := c.camo.newRequest(c.Scheme+"://"+c.Config.RemoteAddr, nil, meta)
+	if err != nil {
+		return nil, err
+	}
+	req.Method = http.MethodGet
+	resp, err := c.roundTrip(client, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkResponse(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	// The uploads' key comes from the inner channel, so its handshake is
+	// finished before the first upload.
+	session := meta.Session
+	var ciphers *crypto.InnerCiphers
+	var key []byte
+	if inner != nil {
+		msg, err := readInnerFrame(resp.Body)
+		if err == nil {
+			ciphers, err = inner.Finish(msg)
+		}
+		if err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("inner channel: %v", err)
+		}
+		key = splitKey(ciphers.ExportKey(splitKeyLabel), session)
+	} else {
+		key = splitKey([]byte(c.Config.AuthToken), session)
+	}
+	conn := newSplitConn(resp.Body, func(seq uint64, chunk []byte) error {
+		return c.upload(client, session, key, seq, chunk)
+	})
+	if ciphers != nil {
+		return newInnerConn(conn, conn, ciphers, conn), nil
+	}
+	return conn, nil
+}
+
+// upload sends one upload of a split stream, authenticated with key,
+// retrying when the request fails. The server drops duplicates, so a retry
+// is safe even if an earlier attempt got through.
+func (c *Client) upload(client *http.Client, session string, key []byte, seq uint64, chunk []byte) error {
+	meta := streamMeta{Session: session, Seq: strconv.FormatUint(seq, 10)}
+	if key != nil {
+		meta.Auth = splitUploadMAC(key, session, seq, chunk)
+	}
+	var err error
+	for attempt := 0; attempt < splitUploadAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 500 * time.Millisecond)
+		}
+		var req *http.Request
+		if req, err = c.camo.newRequest(c.Scheme+"://"+c.Config.RemoteAddr, bytes.NewReader(chunk), meta); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), splitUploadTimeout)
+		var resp *http.Response
+		resp, err = client.Do(req.WithContext(ctx))
+		if err != nil {
+			cancel()
+			continue
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		cancel()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("server refused upload %d with status: %d", seq, resp.StatusCode)
+		}
+		return nil
+	}
+	return err
+}
+
+// splitConn is the client end of a split stream. Writes are buffered and
+// sent as uploads, several at a time; Close sends what is left, ends the
+// upload and then closes the download.
+type splitConn struct {
+	download io.ReadCloser
+	upload   func(seq uint64, chunk []byte) error
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte // written but not yet uploaded
+	closed bool
+	err    error // the first failed upload
+}
+
+func newSplitConn(download io.ReadCloser, upload func(seq uint64, chunk []byte) error) *splitConn {
+	c := &splitConn{download: download, upload: upload}
+	c.cond = sync.NewCond(&c.mu)
+	go c.uploadLoop()
+	return c
+}
+
+func (c *splitConn) Read(p []byte) (int, error) {
+	return c.download.Read(p)
+}
+
+func (c *splitConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.buf) >= splitMaxChunk && c.err == nil && !c.closed {
+		c.cond.Wait()
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+	c.buf = append(c.buf, p...)
+	c.cond.Broadcast()
+	return len(p), nil
+}
+
+func (c *splitConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.cond.Broadcast()
+	return nil
+}
+
+// fail stops the stream after an upload failed for good.
+func (c *splitConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+		c.download.Close()
+	}
+	c.cond.Broadcast()
+}
+
+// uploadLoop sends what Write buffers, in chunks of up to splitMaxChunk
+// with up to splitMaxInflight outstanding.
+func (c *splitConn) uploadLoop() {
+	slots := make(chan struct{}, splitMaxInflight)
+	var wg sync.WaitGroup
+	var seq uint64
+	for {
+		slots <- struct{}{}
+		c.mu.Lock()
+		for len(c.buf) == 0 && !c.closed && c.err == nil {
+			c.cond.Wait()
+		}
+		if c.err != nil || len(c.buf) == 0 {
+			c.mu.Unlock()
+			break
+		}
+		n := min(len(c.buf), splitMaxChunk)
+		chunk := bytes.Clone(c.buf[:n])
+		if c.buf = c.buf[n:]; len(c.buf) == 0 {
+			c.buf = nil
+		}
+		c.cond.Broadcast()
+		c.mu.Unlock()
+
+		wg.Add(1)
+		go func(seq uint64) {
+			defer wg.Done()
+			if err := c.upload(seq, chunk); err != nil {
+				c.fail(err)
+			}
+			<-slots
+		}(seq)
+		seq++
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	failed := c.err != nil
+	c.mu.Unlock()
+	if !failed {
+		// Fails harmlessly if the server ended the stream first.
+		c.upload(seq, nil)
+	}
+	c.download.Close()
+}
@@ -0,0 +1,148 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"phoenix/pkg/config"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// putUpload adds an upload to s the way serveSplitUpload does.
+func putUpload(ctx context.Context, s *splitSession, seq uint64, chunk []byte) error {
+	fresh, err := s.reserve(ctx, seq, len(chunk))
+	if fresh {
+		s.put(seq, chunk, len(chunk))
+	}
+	return err
+}
+
+func TestSplitSession(t *testing.T) {
+	var ss splitSessions
+	if _, err := ss.open(context.Background(), "short", nil); err == nil {
+		t.Error("Expected a guessable session ID to be refused")
+	}
+	id := newSessionID()
+	s, err := ss.open(context.Background(), id, nil)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if _, err := ss.open(context.Background(), id, nil); err == nil {
+		t.Error("Expected a session ID in use to be refused")
+	}
+
+	// Out of order, with a retried duplicate and the end marker first.
+	ctx := context.Background()
+	for _, u := range []struct {
+		seq  uint64
+		data string
+	}{{3, ""}, {1, "b"}, {2, "c"}, {1, "b"}, {0, "a"}} {
+		if err := putUpload(ctx, s, u.seq, []byte(u.data)); err != nil {
+			t.Fatalf("put %d failed: %v", u.seq, err)
+		}
+	}
+	if got, err := io.ReadAll(s); err != nil || string(got) != "abc" {
+		t.Errorf("Read %q, %v", got, err)
+	}
+	if err := putUpload(ctx, s, 0, []byte("a")); err != nil {
+		t.Errorf("Expected a late duplicate to be dropped quietly, got %v", err)
+	}
+
+	s2, _ := ss.open(context.Background(), newSessionID(), nil)
+	if err := putUpload(ctx, s2, splitWindow, []byte("x")); err == nil {
+		t.Error("Expected an upload beyond the window to be refused")
+	}
+
+	// Room is reserved before a body is read: once uploads hold the
+	// buffer, the next one waits without its body, except the upload Read
+	// needs next.
+	for seq := uint64(1); seq <= splitMaxBuffered/splitMaxChunk; seq++ {
+		if fresh, err := s2.reserve(ctx, seq, splitMaxChunk); !fresh || err != nil {
+			t.Fatalf("reserve %d: %v, %v", seq, fresh, err)
+		}
+	}
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := s2.reserve(short, 20, 1); err == nil {
+		t.Error("Expected an upload beyond the buffer to wait")
+	}
+	if fresh, err := s2.reserve(ctx, 0, splitMaxChunk); !fresh || err != nil {
+		t.Errorf("The upload Read needs was not let in: %v, %v", fresh, err)
+	}
+
+	ss.remove(id, s)
+	if ss.get(id) != nil {
+		t.Error("Session still registered after remove")
+	}
+	if err := putUpload(ctx, s, 4, []byte("d")); err == nil {
+		t.Error("Expected upload to a removed session to fail")
+	}
+}
+
+func TestSplitConn(t *testing.T) {
+	var ss splitSessions
+	session, _ := ss.open(context.Background(), newSessionID(), nil)
+	down, downW := io.Pipe()
+
+	// Uploads run concurrently and are delayed so they arrive out of order.
+	upload := func(seq uint64, chunk []byte) error {
+		time.Sleep(time.Duration(5-seq%5) * time.Millisecond)
+		return putUpload(context.Background(), session, seq, chunk)
+	}
+	conn := newSplitConn(down, upload)
+
+	data := make([]byte, 5*splitMaxChunk+123)
+	rand.Read(data)
+	go func() {
+		for p := data; len(p) > 0; p = p[min(len(p), 10000):] {
+			conn.Write(p[:min(len(p), 10000)])
+		}
+		conn.Close()
+	}()
+	got, err := io.ReadAll(session)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Server read %d bytes (%v), want %d", len(got), err, len(data))
+	}
+
+	downW.CloseWithError(errors.New("done"))
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Error("Expected Write after Close to fail")
+	}
+}
+
+func TestSplitUploadMAC(t *testing.T) {
+	srv := &Server{camo: newCamouflage(config.Camouflage{})}
+	id := newSessionID()
+	key := splitKey([]byte("secret-token"), id)
+	session, _ := srv.splits.open(context.Background(), id, key)
+
+	upload := func(seq uint64, body, mac string) int {
+		meta := streamMeta{Session: id, Seq: strconv.FormatUint(seq, 10), Auth: mac}
+		req, _ := srv.camo.newRequest("http://example.org", bytes.NewReader([]byte(body)), meta)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := upload(0, "evil", ""); code == http.StatusOK {
+		t.Error("Upload without a MAC was taken")
+	}
+	if code := upload(0, "evil", splitUploadMAC(key, id, 0, []byte("good"))); code == http.StatusOK {
+		t.Error("Upload with a MAC over another body was taken")
+	}
+	if code := upload(0, "good", splitUploadMAC(splitKey([]byte("other"), id), id, 0, []byte("good"))); code == http.StatusOK {
+		t.Error("Upload with a MAC under another key was taken")
+	}
+	if code := upload(0, "good", splitUploadMAC(key, id, 0, []byte("good"))); code != http.StatusOK {
+		t.Errorf("Authentic upload answered with %d", code)
+	}
+	upload(1, "", splitUploadMAC(key, id, 1, nil))
+	if got, err := io.ReadAll(session); err != nil || string(got) != "good" {
+		t.Errorf("Read %q, %v", got, err)
+	}
+}
@@ -0,0 +1,143 @@
+package transport
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"phoenix/pkg/adapter/socks5"
+	"phoenix/pkg/config"
+	"phoenix/pkg/crypto"
+	"sync"
+)
+
+// userStore indexes the accounts of users_file by token, client key and
+// name. The file is reloaded when it changes; a file that fails to load
+// leaves the previous accounts in place.
+type userStore struct {
+	path     string
+	onReload func(*userStore)
+
+	mu         sync.RWMutex
+	byToken    map[[sha256.Size]byte]*config.UserAccount
+	byKey      map[string]*config.UserAccount
+	byName     map[string]*config.UserAccount
+	tokensByID map[string]string // authKeyID(token) → token, for HMAC auth
+}
+
+// onReload, if non-nil, is called after each successful reload from disk.
+func newUserStore(path string, onReload func(*userStore)) (*userStore, error) {
+	s := &userStore{path: path, onReload: onReload}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded %d users from %s", len(s.byName), path)
+
+	watchFiles([]string{path}, func() {
+		if err := s.reload(); err != nil {
+			log.Printf("Failed to reload users, keeping previous accounts: %v", err)
+			return
+		}
+		log.Printf("Reloaded users from %s", path)
+		if s.onReload != nil {
+			s.onReload(s)
+		}
+	})
+	return s, nil
+}
+
+func (s *userStore) reload() error {
+	db, err := config.LoadUsers(s.path)
+	if err != nil {
+		return err
+	}
+
+	byToken := make(map[[sha256.Size]byte]*config.UserAccount)
+	byKey := make(map[string]*config.UserAccount)
+	byName := make(map[string]*config.UserAccount)
+	byKeyID := make(map[string]string)
+	for i := range db.Users {
+		u := &db.Users[i]
+		byName[u.Name] = u
+		for _, t := range u.Tokens {
+			byToken[sha256.Sum256([]byte(t))] = u
+			byKeyID[authKeyID(t)] = t
+		}
+		for _, k := range u.ClientKeys {
+			pin, _ := crypto.NormalizePin(k) // checked by LoadUsers
+			byKey[pin] = u
+		}
+	}
+
+	s.mu.Lock()
+	s.byToken, s.byKey, s.byName, s.tokensByID = byToken, byKey, byName, byKeyID
+	s.mu.Unlock()
+	return nil
+}
+
+// byTokenValue returns the user owning token. Tokens are compared by hash so
+// the lookup time does not depend on how much of a guess is correct.
+func (s *userStore) byTokenValue(token string) *config.UserAccount {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byToken[sha256.Sum256([]byte(token))]
+}
+
+func (s *userStore) byClientKey(pin string) *config.UserAccount {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byKey[pin]
+}
+
+func (s *userStore) byUserName(name string) *config.UserAccount {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byName[name]
+}
+
+// byKeyID returns the user token with HMAC key id, and its user.
+func (s *userStore) byKeyID(id string) (string, *config.UserAccount) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	token, ok := s.tokensByID[id]
+	if !ok {
+		return "", nil
+	}
+	return token, s.byToken[sha256.Sum256([]byte(token))]
+}
+
+// udpTunnelTarget is the target socks5.HandleUDP dials for a UDP ASSOCIATE.
+const udpTunnelTarget = "udp-tunnel"
+
+// policyDialer enforces a user's allowed targets on destinations chosen
+// inside a stream, such as SOCKS5 CONNECT requests and the destinations of
+// datagrams sent through a UDP ASSOCIATE.
+type policyDialer struct {
+	socks5.Dialer
+	user *config.UserAccount
+	peer string
+}
+
+func (d *policyDialer) Dial(target string) (io.ReadWriteCloser, error) {
+	if target == udpTunnelTarget {
+		return d.dialUDP(), nil
+	}
+	if !d.user.AllowsTarget(target) {
+		log.Printf("Blocked connection to %s from %s: target not allowed for this user", target, d.peer)
+		return nil, fmt.Errorf("target %s not allowed for user %s", target, d.user.Name)
+	}
+	return d.Dialer.Dial(target)
+}
+
+// dialUDP relays a UDP ASSOCIATE through an in-process UDP tunnel that drops
+// datagrams to destinations the user may not reach.
+func (d *policyDialer) dialUDP() io.ReadWriteCloser {
+	local, remote := net.Pipe()
+	go func() {
+		if err := socks5.HandleUDPTunnelFiltered(remote, d.user.AllowsTarget, d.peer); err != nil && err != io.EOF {
+			log.Printf("UDP relay for %s ended: %v", d.peer, err)
+		}
+	}()
+	return local
+}
@@ -0,0 +1,68 @@
+package transport
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"phoenix/pkg/config"
+	"testing"
+	"time"
+)
+
+func TestPolicyDialerUDP(t *testing.T) {
+	listen := func() net.PacketConn {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		return pc
+	}
+	allowed, blocked := listen(), listen()
+
+	user := &config.UserAccount{Name: "alice", Targets: []string{allowed.LocalAddr().String()}}
+	d := &policyDialer{user: user, peer: "test"}
+	stream, err := d.Dial(udpTunnelTarget)
+	if err != nil {
+		t.Fatalf("UDP associate refused for a user with targets: %v", err)
+	}
+	defer stream.Close()
+
+	// send writes a datagram for dest in the tunnel framing:
+	// [length][RSV RSV FRAG ATYP=IPv4][addr][port][data]
+	send := func(dest net.Addr, data string) {
+		a := dest.(*net.UDPAddr)
+		pkt := append([]byte{0, 0, 0, 1}, a.IP.To4()...)
+		pkt = binary.BigEndian.AppendUint16(pkt, uint16(a.Port))
+		pkt = append(pkt, data...)
+		if _, err := stream.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(pkt))), pkt...)); err != nil {
+			t.Fatalf("write to tunnel: %v", err)
+		}
+	}
+	send(blocked.LocalAddr(), "blocked")
+	send(allowed.LocalAddr(), "allowed")
+
+	buf := make([]byte, 64)
+	allowed.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := allowed.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "allowed" {
+		t.Fatalf("Expected the datagram to the allowed target, got %q, %v", buf[:n], err)
+	}
+	blocked.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := blocked.ReadFrom(buf); err == nil {
+		t.Errorf("Datagram to a target not allowed was delivered: %q", buf[:n])
+	}
+
+	// Replies come back through the tunnel.
+	if _, err := allowed.WriteTo([]byte("reply"), from); err != nil {
+		t.Fatal(err)
+	}
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(stream, hdr); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	reply := make([]byte, binary.BigEndian.Uint16(hdr))
+	if _, err := io.ReadFull(stream, reply); err != nil || string(reply[10:]) != "reply" {
+		t.Errorf("Unexpected reply %q, %v", reply, err)
+	}
+}
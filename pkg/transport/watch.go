@@ -0,0 +1,51 @@
+package transport
+
+import (
+	"os"
+	"time"
+)
+
+// fileWatchInterval is how often watched files are checked for changes.
+// Polling keeps the binary free of inotify dependencies and also works on
+// filesystems (and Kubernetes secret mounts) that do not deliver events.
+// It is a variable so that tests can poll faster.
+var fileWatchInterval = 10 * time.Second
+
+// fileStamp identifies a version of a file on disk.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFiles(paths []string) []fileStamp {
+	stamps := make([]fileStamp, len(paths))
+	for i, p := range paths {
+		if info, err := os.Stat(p); err == nil {
+			stamps[i] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return stamps
+}
+
+// watchFiles calls onChange whenever any of paths changes on disk.
+// It runs until the process exits.
+func watchFiles(paths []string, onChange func()) {
+	last := statFiles(paths)
+	go func() {
+		ticker := time.NewTicker(fileWatchInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			cur := statFiles(paths)
+			changed := false
+			for i := range cur {
+				if cur[i] != last[i] {
+					changed = true
+				}
+			}
+			if changed {
+				last = cur
+				onChange()
+			}
+		}
+	}()
+}
@@ -0,0 +1,422 @@
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"phoenix/pkg/protocol"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// WebSocket transport (RFC 6455): a stream is the payload of binary
+// messages, opened with an HTTP/1.1 Upgrade or, over HTTP/2, with an
+// extended CONNECT (RFC 8441). Stream metadata travels on the handshake
+// request like on any other stream request; see camouflage.
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	// wsMaxFrame is the largest payload written in one frame.
+	wsMaxFrame = 64 * 1024
+
+	// wsAcceptGUID is appended to the client key to compute the server's
+	// accept value (RFC 6455, section 1.3).
+	wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var errWebSocketClosed = errors.New("websocket: connection closed")
+
+// isWebSocketRequest reports whether r opens a WebSocket.
+func isWebSocketRequest(r *http.Request) bool {
+	if r.Method == http.MethodConnect {
+		return r.ProtoMajor == 2 && r.Header.Get(":protocol") == "websocket"
+	}
+	return r.Method == http.MethodGet &&
+		httpguts.HeaderValuesContainsToken(r.Header["Connection"], "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// newWebSocketKey returns a random Sec-WebSocket-Key value.
+func newWebSocketKey() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return base64.StdEncoding.EncodeToString(b[:])
+}
+
+// webSocketAccept returns the Sec-WebSocket-Accept value for key.
+func webSocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsAcceptGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// acceptWebSocket completes the server side of the WebSocket handshake for
+// an accepted stream request. Headers already set on w are sent with the
+// handshake response. On failure, an error response has been written.
+func (s *Server) acceptWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket Version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported WebSocket version")
+	}
+
+	if r.ProtoMajor == 2 {
+		// RFC 8441: the CONNECT stream itself carries the frames.
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+			return nil, errors.New("response does not support streaming")
+		}
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		stream := &H2Stream{Reader: r.Body, Writer: w, Flusher: flusher}
+		return newWSConn(stream, stream, false, stream), nil
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if raw, err := base64.StdEncoding.DecodeString(key); err != nil || len(raw) != 16 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return nil, errors.New("invalid Sec-WebSocket-Key")
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "Upgrade not supported", http.StatusInternalServerError)
+		return nil, err
+	}
+	closer := io.Closer(conn)
+	if s.clientKeys != nil {
+		// The server stops tracking hijacked connections; track this one
+		// so that revoking its key still closes it.
+		s.clientKeys.trackConn(conn, http.StateActive)
+		closer = closeFunc(func() error {
+			s.clientKeys.trackConn(conn, http.StateClosed)
+			return conn.Close()
+		})
+	}
+
+	h := w.Header().Clone()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", webSocketAccept(key))
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	h.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		closer.Close()
+		return nil, err
+	}
+	return newWSConn(brw.Reader, conn, false, closer), nil
+}
+
+// closeFunc adapts a function to io.Closer.
+type closeFunc func() error
+
+func (f closeFunc) Close() error { return f() }
+
+// wsConn carries a stream in binary WebSocket messages. Each Write is sent
+// as one or more complete frames; Read returns message payloads as a byte
+// stream, answers pings and ends with io.EOF at a close frame. Extensions
+// are not negotiated.
+type wsConn struct {
+	r       io.Reader
+	w       io.Writer
+	client  bool // clients mask their frames, servers must not
+	closers []io.Closer
+
+	rmu       sync.Mutex
+	rerr      error  // sticky, e.g. io.EOF after a close frame
+	remaining uint64 // payload bytes left in the current frame
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+func newWSConn(r io.Reader, w io.Writer, client bool, closers ...io.Closer) *wsConn {
+	return &wsConn{r: r, w: w, client: client, closers: closers}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for c.remaining == 0 {
+		if c.rerr != nil {
+			return 0, c.rerr
+		}
+		c.rerr = c.nextFrame()
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= uint64(n)
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextFrame reads frame headers until one with payload data, handling
+// control frames on the way.
+func (c *wsConn) nextFrame() error {
+	var hdr [8]byte
+	if _, err := io.ReadFull(c.r, hdr[:2]); err != nil {
+		return err
+	}
+	if hdr[0]&0x70 != 0 {
+		return errors.New("websocket: unexpected reserved bits")
+	}
+	op := hdr[0] & 0x0f
+	masked := hdr[1]&0x80 != 0
+	if masked == c.client {
+		return errors.New("websocket: frame masking does not match the peer's role")
+	}
+	size := uint64(hdr[1] & 0x7f)
+	switch size {
+	case 126:
+		if _, err := io.ReadFull(c.r, hdr[:2]); err != nil {
+			return err
+		}
+		size = uint64(binary.BigEndian.Uint16(hdr[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.r, hdr[:8]); err != nil {
+			return err
+		}
+		size = binary.BigEndian.Uint64(hdr[:8])
+	}
+	c.masked, c.maskPos = masked, 0
+	if masked {
+		if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch op {
+	case wsOpContinuation, wsOpText, wsOpBinary:
+		c.remaining = size
+		return nil
+	case wsOpClose, wsOpPing, wsOpPong:
+		if size > 125 {
+			return errors.New("websocket: control frame too large")
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		switch op {
+		case wsOpPing:
+			c.wmu.Lock()
+			defer c.wmu.Unlock()
+			if c.closeSent {
+				return nil
+			}
+			return c.writeFrame(wsOpPong, payload)
+		case wsOpClose:
+			// Echo the close so the peer can finish too.
+			c.wmu.Lock()
+			if !c.closeSent {
+				c.closeSent = true
+				c.writeFrame(wsOpClose, payload[:min(len(payload), 2)])
+			}
+			c.wmu.Unlock()
+			return io.EOF
+		}
+		return nil
+	default:
+		return fmt.Errorf("websocket: unknown opcode %d", op)
+	}
+}
+
+func (c *wsConn) unmask(p []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range p {
+		p[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return 0, errWebSocketClosed
+	}
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), wsMaxFrame)]
+		if err := c.writeFrame(wsOpBinary, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// writeFrame sends one final frame; c.wmu must be held.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|op)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if !c.client {
+		frame = append(frame, payload...)
+	} else {
+		var mask [4]byte
+		rand.Read(mask[:])
+		frame = append(frame, mask[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i&3])
+		}
+	}
+	_, err := c.w.Write(frame)
+	return err
+}
+
+// Close sends a close frame, unless one was already exchanged, and closes
+// the underlying stream.
+func (c *wsConn) Close() error {
+	c.wmu.Lock()
+	if !c.closeSent {
+		c.closeSent = true
+		c.writeFrame(wsOpClose, []byte{0x03, 0xe8}) // 1000, normal closure
+	}
+	c.wmu.Unlock()
+	var first error
+	for _, cl := range c.closers {
+		if err := cl.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// webSocketTransport returns the HTTP/1.1 transport of transport
+// "websocket". Every stream upgrades a connection of its own; tlsConfig is
+// nil for cleartext.
+func webSocketTransport(target string, tlsConfig *tls.Config, fingerprint string) *http.Transport {
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, target)
+		},
+	}
+	if tlsConfig != nil {
+		h1 := tlsConfig.Clone()
+		h1.NextProtos = []string{"http/1.1"}
+		tr.DialTLSContext = func(_ context.Context, network, _ string) (net.Conn, error) {
+			return dialWithFingerprint(network, target, h1, fingerprint)
+		}
+	}
+	return tr
+}
+
+// dialWebSocket opens a stream as a WebSocket: an HTTP/1.1 Upgrade, or with
+// transport "websocket-h2" an extended CONNECT (RFC 8441) on the shared
+// HTTP/2 connection. The inner handshake, which cannot go ahead of a body,
+// is sent in the metadata.
+func (c *Client) dialWebSocket(proto protocol.ProtocolType, target string) (io.ReadWriteCloser, error) {
+	c.mu.RLock()
+	client := c.httpClient
+	c.mu.RUnlock()
+
+	h2 := c.Config.Transport == "websocket-h2"
+	method := http.MethodGet
+	if h2 {
+		method = http.MethodConnect
+	}
+	meta, err := c.streamMeta(proto, target, method)
+	if err != nil {
+		return nil, err
+	}
+	inner, msg, err := c.newInner()
+	if err != nil {
+		return nil, err
+	}
+	if inner != nil {
+		meta.Inner = base64.RawURLEncoding.EncodeToString(msg)
+	}
+
+	// Over HTTP/2 the frames go in the request body, as with other streams.
+	var body io.Reader
+	var pw *io.PipeWriter
+	if h2 {
+		body, pw = io.Pipe()
+	}
+	req, err := c.camo.newRequest(c.Scheme+"://"+c.Config.RemoteAddr, body, meta)
+	if err != nil {
+		return nil, err
+	}
+	req.Method = method
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	key := newWebSocketKey()
+	if h2 {
+		req.Header[":protocol"] = []string{"websocket"}
+	} else {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Key", key)
+	}
+
+	resp, err := c.roundTrip(client, req)
+	if err != nil {
+		if h2 && strings.Contains(err.Error(), "extended connect not supported") {
+			return nil, fmt.Errorf("server does not accept WebSockets over HTTP/2 (it must run with GODEBUG=http2xconnect=1; or use transport = \"websocket\"): %w", err)
+		}
+		return nil, err
+	}
+	var ws *wsConn
+	if h2 {
+		if err := c.checkResponse(resp, http.StatusOK); err != nil {
+			return nil, err
+		}
+		ws = newWSConn(resp.Body, pw, true, resp.Body, pw)
+	} else {
+		if err := c.checkResponse(resp, http.StatusSwitchingProtocols); err != nil {
+			return nil, err
+		}
+		conn, ok := resp.Body.(io.ReadWriteCloser)
+		if !ok || resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+			resp.Body.Close()
+			return nil, errors.New("server sent an invalid WebSocket handshake")
+		}
+		ws = newWSConn(conn, conn, true, conn)
+	}
+	if inner != nil {
+		return openInner(inner, ws)
+	}
+	return ws, nil
+}
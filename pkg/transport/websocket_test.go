@@ -0,0 +1,157 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestWebSocket(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketRequest(r) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Nerve-Quota-Remaining", "42")
+		ws, err := (&Server{}).acceptWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		io.Copy(ws, ws)
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: webSocketTransport(strings.TrimPrefix(srv.URL, "http://"), nil, "")}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/", nil)
+	key := newWebSocketKey()
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		t.Fatalf("Unexpected handshake response: %d %v", resp.StatusCode, resp.Header)
+	}
+	if resp.Header.Get("X-Nerve-Quota-Remaining") != "42" {
+		t.Errorf("Headers set before the upgrade were not sent")
+	}
+	conn := resp.Body.(io.ReadWriteCloser)
+	ws := newWSConn(conn, conn, true, conn)
+
+	// Larger than one frame, with a ping in between that must not show up
+	// in the data.
+	data := make([]byte, 3*wsMaxFrame+100)
+	rand.Read(data)
+	go func() {
+		ws.Write(data[:wsMaxFrame])
+		ws.wmu.Lock()
+		ws.writeFrame(wsOpPing, []byte("hi"))
+		ws.wmu.Unlock()
+		ws.Write(data[wsMaxFrame:])
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(ws, got); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Echoed data differs")
+	}
+
+	ws.Close()
+	if _, err := ws.Write([]byte("x")); err != errWebSocketClosed {
+		t.Errorf("Write after Close returned %v", err)
+	}
+}
+
+func TestWebSocketH2(t *testing.T) {
+	// x/net reads GODEBUG once at init, so the server side of RFC 8441 is
+	// tested in a child process that has it set.
+	if !strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestWebSocketH2$", "-test.v")
+		cmd.Env = append(os.Environ(), "GODEBUG=http2xconnect=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("Child test failed: %v\n%s", err, out)
+		}
+		return
+	}
+
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketRequest(r) {
+			http.NotFound(w, r)
+			return
+		}
+		ws, err := (&Server{}).acceptWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		io.Copy(ws, ws)
+	}), &http2.Server{}))
+	defer srv.Close()
+
+	tr := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest(http.MethodConnect, srv.URL+"/", pr)
+	req.Header[":protocol"] = []string{"websocket"}
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Extended CONNECT failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected handshake status %d", resp.StatusCode)
+	}
+	ws := newWSConn(resp.Body, pw, true, resp.Body, pw)
+	defer ws.Close()
+
+	data := make([]byte, wsMaxFrame+100)
+	rand.Read(data)
+	go ws.Write(data)
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(ws, got); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Echoed data differs")
+	}
+}
+
+func TestWebSocketMasking(t *testing.T) {
+	// A server must refuse unmasked frames from a client, and the reverse.
+	var frame bytes.Buffer
+	newWSConn(nil, &frame, false).Write([]byte("data"))
+	if _, err := newWSConn(bytes.NewReader(frame.Bytes()), io.Discard, false).Read(make([]byte, 8)); err == nil {
+		t.Error("Expected server to refuse an unmasked frame")
+	}
+	frame.Reset()
+	newWSConn(nil, &frame, true).Write([]byte("data"))
+	if _, err := newWSConn(bytes.NewReader(frame.Bytes()), io.Discard, true).Read(make([]byte, 8)); err == nil {
+		t.Error("Expected client to refuse a masked frame")
+	}
+	got := make([]byte, 8)
+	n, err := newWSConn(bytes.NewReader(frame.Bytes()), io.Discard, false).Read(got)
+	if err != nil || string(got[:n]) != "data" {
+		t.Errorf("Masked frame read as %q, %v", got[:n], err)
+	}
+}